@@ -0,0 +1,170 @@
+package wrapper
+
+import (
+	"sort"
+	"strings"
+)
+
+// clangOptionKind describes how a driver option takes its value, mirroring clang's Options.td
+type clangOptionKind int
+
+const (
+	clangFlag             clangOptionKind = iota // No value: -c, -MD
+	clangJoined                                  // Value attached: -std=c11, --sysroot=dir
+	clangSeparate                                // Value is the next argument: -target triple
+	clangJoinedOrSeparate                        // Either form: -I dir, -Idir
+)
+
+// CompilerOption is one parsed driver argument; options are kept in command line order
+type CompilerOption struct {
+	Option   string `json:"option,omitempty"`   // Option as spelled, empty for positional arguments
+	Value    string `json:"value,omitempty"`    // Option value or positional argument
+	Separate bool   `json:"separate,omitempty"` // Value was passed as the next argument
+}
+
+// clangOptionSpec is an entry of the driver option table
+type clangOptionSpec struct {
+	name  string
+	kind  clangOptionKind
+	store func(info *CompilerCommandInfo, value string) // nil keeps the option in Flags
+}
+
+var clangOptionTable = []clangOptionSpec{
+	{"-I", clangJoinedOrSeparate, func(i *CompilerCommandInfo, v string) { i.Includes = append(i.Includes, v) }},
+	{"-D", clangJoinedOrSeparate, func(i *CompilerCommandInfo, v string) { i.Defines = append(i.Defines, v) }},
+	{"-U", clangJoinedOrSeparate, func(i *CompilerCommandInfo, v string) { i.Undefines = append(i.Undefines, v) }},
+	{"-isystem", clangJoinedOrSeparate, func(i *CompilerCommandInfo, v string) { i.SystemIncludes = append(i.SystemIncludes, v) }},
+	{"-cxx-isystem", clangJoinedOrSeparate, func(i *CompilerCommandInfo, v string) { i.SystemIncludes = append(i.SystemIncludes, v) }},
+	{"-iquote", clangJoinedOrSeparate, func(i *CompilerCommandInfo, v string) { i.QuoteIncludes = append(i.QuoteIncludes, v) }},
+	{"-idirafter", clangJoinedOrSeparate, func(i *CompilerCommandInfo, v string) { i.AfterIncludes = append(i.AfterIncludes, v) }},
+	{"-include", clangJoinedOrSeparate, func(i *CompilerCommandInfo, v string) { i.ForcedIncludes = append(i.ForcedIncludes, v) }},
+	{"-imacros", clangJoinedOrSeparate, func(i *CompilerCommandInfo, v string) { i.MacroIncludes = append(i.MacroIncludes, v) }},
+	{"-include-pch", clangSeparate, nil},
+	{"-std=", clangJoined, func(i *CompilerCommandInfo, v string) { i.Standard = v }},
+	{"--std=", clangJoined, func(i *CompilerCommandInfo, v string) { i.Standard = v }},
+	{"--std", clangSeparate, func(i *CompilerCommandInfo, v string) { i.Standard = v }},
+	{"-target", clangSeparate, func(i *CompilerCommandInfo, v string) { i.Target = v }},
+	{"--target=", clangJoined, func(i *CompilerCommandInfo, v string) { i.Target = v }},
+	{"--sysroot=", clangJoined, func(i *CompilerCommandInfo, v string) { i.Sysroot = v }},
+	{"--sysroot", clangSeparate, func(i *CompilerCommandInfo, v string) { i.Sysroot = v }},
+	{"-isysroot", clangJoinedOrSeparate, func(i *CompilerCommandInfo, v string) { i.Sysroot = v }},
+	{"-MF", clangJoinedOrSeparate, func(i *CompilerCommandInfo, v string) { i.DepFile = v }},
+	{"-o", clangJoinedOrSeparate, func(i *CompilerCommandInfo, v string) {
+		if i.OutputFile == "" {
+			i.OutputFile = v
+		}
+	}},
+	{"-MT", clangJoinedOrSeparate, nil},
+	{"-MQ", clangJoinedOrSeparate, nil},
+	{"-x", clangJoinedOrSeparate, nil},
+	{"-arch", clangSeparate, nil},
+	{"-Xclang", clangSeparate, nil},
+	{"-Xlinker", clangSeparate, nil},
+	{"-Xassembler", clangSeparate, nil},
+	{"-Xpreprocessor", clangSeparate, nil},
+	{"-mllvm", clangSeparate, nil},
+	{"-gcc-toolchain", clangSeparate, nil},
+	{"-resource-dir", clangSeparate, nil},
+	{"-ivfsoverlay", clangJoinedOrSeparate, nil},
+	{"-iprefix", clangJoinedOrSeparate, nil},
+	{"-iwithprefix", clangJoinedOrSeparate, nil},
+	{"-iwithprefixbefore", clangJoinedOrSeparate, nil},
+}
+
+// clangOptionsByName indexes the table; clangPrefixOptions holds options that accept a joined
+// value, longest first so -iwithprefixbefore is not mistaken for -iwithprefix
+var clangOptionsByName, clangPrefixOptions = indexClangOptions(clangOptionTable)
+
+func indexClangOptions(table []clangOptionSpec) (map[string]*clangOptionSpec, []*clangOptionSpec) {
+	byName := map[string]*clangOptionSpec{}
+	var prefixes []*clangOptionSpec
+	for i := range table {
+		spec := &table[i]
+		byName[spec.name] = spec
+		if spec.kind == clangJoined || spec.kind == clangJoinedOrSeparate {
+			prefixes = append(prefixes, spec)
+		}
+	}
+	sort.SliceStable(prefixes, func(a, b int) bool {
+		return len(prefixes[a].name) > len(prefixes[b].name)
+	})
+	return byName, prefixes
+}
+
+// lookupClangOption finds the table entry for arg and returns the joined value if any
+func lookupClangOption(arg string) (*clangOptionSpec, string, bool) {
+	if spec, ok := clangOptionsByName[arg]; ok {
+		return spec, "", false
+	}
+	for _, spec := range clangPrefixOptions {
+		if strings.HasPrefix(arg, spec.name) {
+			return spec, arg[len(spec.name):], true
+		}
+	}
+	return nil, "", false
+}
+
+// parseClangArgs parses a clang or gcc driver invocation (args[0] is the driver) into the
+// structured fields of info. Options not modelled by the table are kept in Flags.
+func parseClangArgs(info *CompilerCommandInfo, args []string) {
+	if len(args) == 0 {
+		return
+	}
+
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			info.Options = append(info.Options, CompilerOption{Value: arg})
+			continue
+		}
+
+		spec, value, joined := lookupClangOption(arg)
+		if spec == nil || spec.kind == clangFlag {
+			info.Options = append(info.Options, CompilerOption{Option: arg})
+			info.Flags = append(info.Flags, arg)
+			continue
+		}
+
+		option := CompilerOption{Option: spec.name, Value: value}
+		if !joined {
+			if i+1 >= len(args) {
+				// Missing value, keep the dangling option as a flag
+				info.Options = append(info.Options, CompilerOption{Option: arg})
+				info.Flags = append(info.Flags, arg)
+				continue
+			}
+			i++
+			option.Value = args[i]
+			option.Separate = true
+		}
+		info.Options = append(info.Options, option)
+
+		if spec.store != nil {
+			spec.store(info, option.Value)
+		} else {
+			info.Flags = append(info.Flags, option.Args()...)
+		}
+	}
+}
+
+// Args renders the option back to the arguments it was parsed from
+func (o CompilerOption) Args() []string {
+	switch {
+	case o.Option == "":
+		return []string{o.Value}
+	case o.Separate:
+		return []string{o.Option, o.Value}
+	default:
+		return []string{o.Option + o.Value}
+	}
+}
+
+// reconstructArguments rebuilds the compiler argument vector from parsed options
+func reconstructArguments(program string, options []CompilerOption) []string {
+	args := []string{program}
+	for _, option := range options {
+		args = append(args, option.Args()...)
+	}
+	return args
+}
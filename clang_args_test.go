@@ -0,0 +1,76 @@
+package wrapper
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseClangArgs(t *testing.T) {
+	args := splitCommandLine("clang++ -c -Iinclude -I external/inc -isystem bionic/libc/include -isystemprebuilts/inc " +
+		"-iquote quoted -idirafter after -include config.h -imacros macros.h -include-pch pch.h.pch " +
+		"-DFOO=1 -D BAR -UDEBUG -std=gnu++17 -target aarch64-linux-android10000 --sysroot=prebuilts/sysroot " +
+		"-MD -MF out/a.o.d -x c++ -Xclang -load -O2 -Werror=format src/a.cpp -o out/a.o")
+
+	var info CompilerCommandInfo
+	parseClangArgs(&info, args)
+
+	checks := []struct {
+		name     string
+		got      interface{}
+		expected interface{}
+	}{
+		{"Includes", info.Includes, []string{"include", "external/inc"}},
+		{"SystemIncludes", info.SystemIncludes, []string{"bionic/libc/include", "prebuilts/inc"}},
+		{"QuoteIncludes", info.QuoteIncludes, []string{"quoted"}},
+		{"AfterIncludes", info.AfterIncludes, []string{"after"}},
+		{"ForcedIncludes", info.ForcedIncludes, []string{"config.h"}},
+		{"MacroIncludes", info.MacroIncludes, []string{"macros.h"}},
+		{"Defines", info.Defines, []string{"FOO=1", "BAR"}},
+		{"Undefines", info.Undefines, []string{"DEBUG"}},
+		{"Standard", info.Standard, "gnu++17"},
+		{"Target", info.Target, "aarch64-linux-android10000"},
+		{"Sysroot", info.Sysroot, "prebuilts/sysroot"},
+		{"DepFile", info.DepFile, "out/a.o.d"},
+		{"OutputFile", info.OutputFile, "out/a.o"},
+		{"Flags", info.Flags, []string{"-c", "-include-pch", "pch.h.pch", "-MD", "-x", "c++", "-Xclang", "-load", "-O2", "-Werror=format"}},
+	}
+
+	for _, check := range checks {
+		if !reflect.DeepEqual(check.got, check.expected) {
+			t.Errorf("%s: expected %q, got %q", check.name, check.expected, check.got)
+		}
+	}
+
+	if got := reconstructArguments(args[0], info.Options); !reflect.DeepEqual(got, args) {
+		t.Errorf("Reconstruction mismatch:\nexpected %q\ngot      %q", args, got)
+	}
+}
+
+func TestParseClangArgsEdgeCases(t *testing.T) {
+	var info CompilerCommandInfo
+	info.OutputFile = "from-entry.o"
+	parseClangArgs(&info, []string{"clang", "-ofoo.o", "-", "-MF"})
+
+	if info.OutputFile != "from-entry.o" {
+		t.Errorf("Expected entry output to take precedence, got %q", info.OutputFile)
+	}
+	if !reflect.DeepEqual(info.Flags, []string{"-MF"}) {
+		t.Errorf("Expected dangling -MF to be kept as a flag, got %q", info.Flags)
+	}
+
+	expected := []CompilerOption{{Option: "-o", Value: "foo.o"}, {Value: "-"}, {Option: "-MF"}}
+	if !reflect.DeepEqual(info.Options, expected) {
+		t.Errorf("Expected options %+v, got %+v", expected, info.Options)
+	}
+}
+
+func TestLookupClangOption(t *testing.T) {
+	// The longest joined prefix wins
+	spec, value, joined := lookupClangOption("-iwithprefixbeforeinclude")
+	if spec == nil || spec.name != "-iwithprefixbefore" || value != "include" || !joined {
+		t.Errorf("Expected -iwithprefixbefore with value include, got %+v %q", spec, value)
+	}
+	if spec, _, _ := lookupClangOption("-include-pch"); spec == nil || spec.name != "-include-pch" {
+		t.Errorf("Expected -include-pch to match exactly, got %+v", spec)
+	}
+}
@@ -0,0 +1,153 @@
+package wrapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// commandPipeline applies the rewrites of writeCommandDatabases to one command at a time:
+// header dependencies, response file inlining, the source scope and the path policy, in that
+// order. Response files and depfiles are read relative to the working directory the path
+// policy may change, and the scope is applied after the headers are attached so the generated
+// ones are reported too.
+type commandPipeline struct {
+	result    *Result
+	headers   *headerAttacher // nil unless AttachHeaders
+	inline    bool
+	scope     *sourceScope // nil when every command is in scope
+	generated map[string]bool
+	kept      int
+	dropped   int
+	paths     PathPolicy
+	root      string // Resolved path policy root, empty when the policy rewrites nothing
+}
+
+func newCommandPipeline(config WrapperConfig, result *Result) *commandPipeline {
+	p := &commandPipeline{
+		result:    result,
+		inline:    config.InlineResponseFiles,
+		scope:     newSourceScope(config),
+		generated: map[string]bool{},
+		paths:     config.Paths,
+	}
+	if config.AttachHeaders {
+		p.headers = newHeaderAttacher(config, result)
+	}
+	if p.paths.rewrites() {
+		p.root = p.paths.resolvedRoot()
+	}
+	return p
+}
+
+// process rewrites info in place and reports whether it is written
+func (p *commandPipeline) process(info *CompilerCommandInfo) bool {
+	if p.headers != nil {
+		p.headers.attach(info)
+	}
+	if p.inline {
+		inlineResponseFile(info)
+	}
+	if p.scope != nil {
+		if !p.scope.keep(*info) {
+			p.dropped++
+			return false
+		}
+		p.kept++
+		p.scope.collectGenerated(*info, p.generated)
+	}
+	if p.root != "" {
+		p.paths.rewriteCommand(p.root, info)
+	}
+	return true
+}
+
+// finish reports what the pipeline did and records it in result, once every command went through
+func (p *commandPipeline) finish() {
+	if p.headers != nil {
+		p.headers.report()
+	}
+	if p.scope != nil {
+		p.result.GeneratedIncludes = sortedPaths(p.generated)
+		p.result.OutOfScope = p.dropped
+		fmt.Printf("Kept %d commands under the source roots, dropped %d\n", p.kept, p.dropped)
+	}
+}
+
+// streamFullBuild extracts the commands of a full build and hands each one to the sink streams as
+// soon as it is parsed and rewritten, so neither the raw nor the parsed database is ever held in
+// memory. The incremental cache described by header is written the same way.
+func streamFullBuild(ctx context.Context, config WrapperConfig, ninjaFile, tempNinjaFile string, header compdbCacheHeader,
+	streams *sinkStreams, result *Result) error {
+	cache, err := config.cache.create(config.OutDir, header)
+	if err != nil {
+		fmt.Printf("Warning: Failed to write compile command cache: %v\n", err)
+		result.Warnings = append(result.Warnings, err)
+	}
+
+	layers := newLayerFilter(config, ninjaFile)
+	return streamCommands(ctx, config, streams, cache, result, func(ctx context.Context, emit func(CompilerCommandInfo)) error {
+		err := forEachCompilationCommand(ctx, config, tempNinjaFile, func(info CompilerCommandInfo) {
+			layers.add(info, emit)
+		})
+		layers.flush(emit)
+		return err
+	})
+}
+
+// streamCommands passes every command produce emits through the pipeline to the sink streams,
+// and to cache, which is committed once produce completed. The streams are closed when all
+// commands arrived, or aborted when produce failed or was interrupted without
+// WritePartialResults.
+func streamCommands(ctx context.Context, config WrapperConfig, streams *sinkStreams, cache *compdbCacheWriter, result *Result,
+	produce func(ctx context.Context, emit func(CompilerCommandInfo)) error) error {
+	start := time.Now()
+	pipeline := newCommandPipeline(config, result)
+
+	compdbCtx, cancel := withPhaseTimeout(ctx, config.Timeouts.Compdb)
+	err := produce(compdbCtx, func(info CompilerCommandInfo) {
+		result.Commands++
+		cache.add(info)
+		if pipeline.process(&info) {
+			streams.add(info)
+		}
+	})
+	interrupted := compdbCtx.Err()
+	cancel()
+	result.Durations.Compdb = time.Since(start)
+	if err != nil && interrupted == nil {
+		cache.abort()
+		streams.abort()
+		return err
+	}
+	fmt.Printf("Extracted %d compilation commands\n", result.Commands)
+	fmt.Printf("Reused %d cached compilation commands, parsed %d\n", config.cache.reused, config.cache.parsed)
+
+	writeCtx := ctx
+	if interrupted != nil {
+		result.Partial = true
+		interrupted = fmt.Errorf("%w: %w", ErrInterrupted, interrupted)
+		cache.abort()
+		if !config.WritePartialResults {
+			fmt.Printf("Error: %v, discarding %d collected commands\n", interrupted, result.Commands)
+			streams.abort()
+			return interrupted
+		}
+		fmt.Printf("Warning: %v, writing %d commands collected so far\n", interrupted, result.Commands)
+		// The partial result is still written after the caller cancelled
+		writeCtx = context.WithoutCancel(ctx)
+	} else if err := cache.commit(); err != nil {
+		fmt.Printf("Warning: Failed to write compile command cache: %v\n", err)
+		result.Warnings = append(result.Warnings, err)
+	}
+
+	start = time.Now()
+	writeCtx, cancelWrite := withPhaseTimeout(writeCtx, config.Timeouts.Write)
+	defer cancelWrite()
+	pipeline.finish()
+	err = streams.close(writeCtx, result)
+	result.Durations.Write = time.Since(start)
+
+	return errors.Join(interrupted, err)
+}
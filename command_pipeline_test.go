@@ -0,0 +1,83 @@
+package wrapper
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// bufferedSink hides the Stream method of the sink it wraps
+type bufferedSink struct {
+	Sink
+}
+
+func TestCommandPipeline(t *testing.T) {
+	t.Setenv("ANDROID_BUILD_TOP", "/home/aosp")
+	config := WrapperConfig{
+		SourceRootDirs: []string{"frameworks"},
+		Paths:          PathPolicy{Remap: []PathRemap{{From: "/home/aosp", To: "/src"}}},
+	}
+	commands := []CompilerCommandInfo{
+		{Command: "clang -c frameworks/a.c", InputFiles: []string{"frameworks/a.c"}, WorkingDir: "/home/aosp",
+			Includes: []string{"out/soong/.intermediates/gen"}},
+		{Command: "clang -c external/b.c", InputFiles: []string{"external/b.c"}, WorkingDir: "/home/aosp"},
+	}
+
+	result := &Result{}
+	p := newCommandPipeline(config, result)
+	var kept []CompilerCommandInfo
+	for _, info := range commands {
+		if p.process(&info) {
+			kept = append(kept, info)
+		}
+	}
+	p.finish()
+
+	if len(kept) != 1 || kept[0].WorkingDir != "/src" {
+		t.Errorf("Expected the scoped command with remapped paths, got %+v", kept)
+	}
+	if result.OutOfScope != 1 || !reflect.DeepEqual(result.GeneratedIncludes, []string{"out/soong/.intermediates/gen"}) {
+		t.Errorf("Unexpected scope result %d, %v", result.OutOfScope, result.GeneratedIncludes)
+	}
+}
+
+func TestStreamFullBuild(t *testing.T) {
+	config := setupNativeRun(t)
+	config.CompdbFormat = CompdbFormatInternal | CompdbFormatClang
+
+	streamed, err := RunNinjaWithCommandLogging(context.Background(), config, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if streamed.Commands != 1 || len(streamed.Outputs) != 2 {
+		t.Fatalf("Expected 1 streamed command in 2 outputs, got %+v", streamed)
+	}
+	want := map[string][]byte{}
+	for _, file := range streamed.Outputs {
+		want[file], _ = os.ReadFile(file)
+	}
+
+	// The cache written while streaming is reused
+	cached, err := RunNinjaWithCommandLogging(context.Background(), config, false)
+	if err != nil || cached.Durations.Manifest != 0 || cached.Commands != 1 {
+		t.Errorf("Expected the cached database to be reused, got %+v: %v", cached, err)
+	}
+
+	// A sink that needs the whole database gets the same content collected first
+	config.ForceFullRebuild = true
+	config.Sinks = []Sink{bufferedSink{&FileSink{Dir: config.OutDir, Format: config.CompdbFormat}}}
+	buffered, err := RunNinjaWithCommandLogging(context.Background(), config, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(buffered.Outputs, streamed.Outputs) {
+		t.Errorf("Expected outputs %v, got %v", streamed.Outputs, buffered.Outputs)
+	}
+	for file, data := range want {
+		if got, _ := os.ReadFile(file); string(got) != string(data) {
+			t.Errorf("Expected %s to match the streamed one:\n%s\ngot:\n%s", filepath.Base(file), data, got)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package wrapper
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// maxBatchArgBytes bounds the command line of one compdb-targets invocation, well below the
+// usual 2MB ARG_MAX so the environment still fits
+const maxBatchArgBytes = 128 * 1024
+
+// argPointerBytes approximates the argv pointer each argument costs against ARG_MAX
+const argPointerBytes = 8
+
+// targetBatch is a contiguous range of targets queried by one invocation
+type targetBatch struct {
+	start, end int
+}
+
+// batchTargets splits targets into contiguous batches of at most batchSize targets whose
+// arguments, together with fixedArgs, stay under maxBatchArgBytes
+func batchTargets(targets []string, fixedArgs []string, batchSize int) []targetBatch {
+	fixed := 0
+	for _, arg := range fixedArgs {
+		fixed += len(arg) + 1 + argPointerBytes
+	}
+
+	var batches []targetBatch
+	start, size := 0, fixed
+	for i, target := range targets {
+		cost := len(target) + 1 + argPointerBytes
+		full := i > start && (size+cost > maxBatchArgBytes || (batchSize > 0 && i-start >= batchSize))
+		if full {
+			batches = append(batches, targetBatch{start, i})
+			start, size = i, fixed
+		}
+		size += cost
+	}
+	if start < len(targets) {
+		batches = append(batches, targetBatch{start, len(targets)})
+	}
+	return batches
+}
+
+// compdbBatchSize spreads targets evenly over the workers unless CompdbBatchSize is set, so
+// each worker parses the manifest once
+func compdbBatchSize(config WrapperConfig, targets int) int {
+	if config.CompdbBatchSize > 0 {
+		return config.CompdbBatchSize
+	}
+	workers := compdbWorkers(config)
+	return (targets + workers - 1) / workers
+}
+
+// maxPhonyDepth bounds how many levels of phony targets queryTargetBoundaries follows
+const maxPhonyDepth = 8
+
+// splitBatchOutput attributes the entries of one compdb-targets run to its targets. Ninja walks
+// the targets in order, emitting the edges each one adds in post-order, so the block of a target
+// ends with the edge producing it; a target whose edge was emitted by an earlier block adds
+// nothing. Phony targets have no edge of their own, their block ends with the last of their
+// boundary outputs, see queryTargetBoundaries. It fails when the boundary of a target that isn't
+// phony can't be found.
+func splitBatchOutput(entries []map[string]interface{}, targets []string, boundaries map[string][]string) ([][]map[string]interface{}, bool) {
+	blocks := make([][]map[string]interface{}, len(targets))
+	emitted := map[string]bool{}
+	pos := 0
+
+	for i, target := range targets {
+		outputs, phony := boundaries[target]
+		if !phony {
+			outputs = []string{target}
+		}
+
+		end := pos - 1
+		for _, output := range outputs {
+			if emitted[output] {
+				continue
+			}
+			found := false
+			for j := pos; j < len(entries); j++ {
+				if entryOutput, _ := entries[j]["output"].(string); entryOutput == output {
+					end, found = max(end, j), true
+					break
+				}
+			}
+			// Inputs of phony targets may be source files without an edge
+			if !found && !phony {
+				return nil, false
+			}
+		}
+
+		blocks[i] = entries[pos : end+1]
+		for _, entry := range blocks[i] {
+			if output, ok := entry["output"].(string); ok {
+				emitted[output] = true
+			}
+		}
+		pos = end + 1
+	}
+
+	return blocks, pos == len(entries)
+}
+
+// ninjaQuery is what `-t query` reports about the edge producing a target
+type ninjaQuery struct {
+	rule   string // Empty for source files
+	inputs []string
+}
+
+// parseNinjaQuery parses the output of `-t query`, keyed by target
+func parseNinjaQuery(output string) map[string]ninjaQuery {
+	queries := map[string]ninjaQuery{}
+	var target string
+	inInputs := false
+	for _, line := range strings.Split(output, "\n") {
+		switch {
+		case line == "":
+		case !strings.HasPrefix(line, " "):
+			target = strings.TrimSuffix(line, ":")
+			queries[target] = ninjaQuery{}
+			inInputs = false
+		case strings.HasPrefix(line, "  input: "):
+			queries[target] = ninjaQuery{rule: strings.TrimPrefix(line, "  input: ")}
+			inInputs = true
+		case !strings.HasPrefix(line, "    "):
+			// outputs: and validations: end the inputs
+			inInputs = false
+		case inInputs:
+			input := strings.TrimLeft(strings.TrimSpace(line), "| ")
+			query := queries[target]
+			query.inputs = append(query.inputs, input)
+			queries[target] = query
+		}
+	}
+	return queries
+}
+
+// runNinjaQuery runs `-t query` for targets
+func runNinjaQuery(ctx context.Context, executable, ninjaFile, buildTop string, targets []string) (map[string]ninjaQuery, error) {
+	queries := map[string]ninjaQuery{}
+	for _, batch := range batchTargets(targets, []string{executable, "-f", ninjaFile, "-t", "query"}, 0) {
+		args := append([]string{"-f", ninjaFile, "-t", "query"}, targets[batch.start:batch.end]...)
+		cmd := commandContext(ctx, executable, args...)
+		cmd.Dir = buildTop
+		output, err := cmd.Output()
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(queries, parseNinjaQuery(string(output)))
+	}
+	return queries, nil
+}
+
+// queryTargetBoundaries returns the outputs ending the compdb-targets block of every phony
+// target of targets: the outputs of the edges its inputs lead to, through up to maxPhonyDepth
+// levels of phony targets. Targets that aren't phony are left out. It returns nil when the
+// manifest can't be queried.
+func queryTargetBoundaries(ctx context.Context, executable, ninjaFile, buildTop string, targets []string) map[string][]string {
+	queries := map[string]ninjaQuery{}
+	pending := slices.Clone(targets)
+	for depth := 0; depth <= maxPhonyDepth && len(pending) > 0; depth++ {
+		level, err := runNinjaQuery(ctx, executable, ninjaFile, buildTop, pending)
+		if err != nil {
+			fmt.Printf("Failed to query phony targets: %v\n", err)
+			return nil
+		}
+		maps.Copy(queries, level)
+
+		pending = nil
+		for _, query := range level {
+			if query.rule != "phony" {
+				continue
+			}
+			for _, input := range query.inputs {
+				if _, ok := queries[input]; !ok && !slices.Contains(pending, input) {
+					pending = append(pending, input)
+				}
+			}
+		}
+	}
+
+	var leaves func(target string, depth int, outputs []string) []string
+	leaves = func(target string, depth int, outputs []string) []string {
+		query := queries[target]
+		if query.rule != "phony" || depth > maxPhonyDepth {
+			return append(outputs, target)
+		}
+		for _, input := range query.inputs {
+			outputs = leaves(input, depth+1, outputs)
+		}
+		return outputs
+	}
+
+	boundaries := map[string][]string{}
+	for _, target := range targets {
+		if queries[target].rule == "phony" {
+			boundaries[target] = leaves(target, 0, nil)
+		}
+	}
+	return boundaries
+}
+
+// attributeBatchOutput splits the entries of a compdb-targets run between its targets, querying
+// the inputs of phony targets when the targets themselves don't delimit the blocks
+func attributeBatchOutput(ctx context.Context, executable, ninjaFile, buildTop string, entries []map[string]interface{}, targets []string) ([][]map[string]interface{}, bool) {
+	if blocks, ok := splitBatchOutput(entries, targets, nil); ok {
+		return blocks, true
+	}
+	boundaries := queryTargetBoundaries(ctx, executable, ninjaFile, buildTop, targets)
+	if len(boundaries) == 0 {
+		return nil, false
+	}
+	return splitBatchOutput(entries, targets, boundaries)
+}
+
+// queryTargetBatch runs compdb-targets once for targets and returns the entries of each target.
+// Batches whose output can't be attributed are bisected until it can, or down to a single
+// target owning all of it. Failing batches are bisected the same way to isolate the failing
+// targets, which are returned as errors. Nothing is reported per target once ctx is done.
+func queryTargetBatch(ctx context.Context, executable, ninjaFile, buildTop string, targets []string) ([][]map[string]interface{}, []*TargetError) {
+	entries, err := runCompdbTargets(ctx, executable, ninjaFile, buildTop, targets)
+	switch {
+	case err == nil:
+		if len(targets) == 1 {
+			return [][]map[string]interface{}{entries}, nil
+		}
+		if blocks, ok := attributeBatchOutput(ctx, executable, ninjaFile, buildTop, entries, targets); ok {
+			return blocks, nil
+		}
+		if ctx.Err() != nil {
+			return make([][]map[string]interface{}, len(targets)), nil
+		}
+	case ctx.Err() != nil:
+		// Cancelled, bisecting would only fail again
+		fmt.Printf("Failed to get compilation commands for %d targets: %v\n", len(targets), ctx.Err())
+		return make([][]map[string]interface{}, len(targets)), nil
+	case len(targets) == 1:
+		fmt.Printf("Failed to get compilation commands for target %s: %v\n", targets[0], err)
+		return make([][]map[string]interface{}, 1), []*TargetError{{Target: targets[0], Err: err}}
+	}
+
+	mid := len(targets) / 2
+	left, leftErrors := queryTargetBatch(ctx, executable, ninjaFile, buildTop, targets[:mid])
+	right, rightErrors := queryTargetBatch(ctx, executable, ninjaFile, buildTop, targets[mid:])
+	return append(left, right...), append(leftErrors, rightErrors...)
+}
+
+// runCompdbTargets runs `-t compdb-targets` for targets and decodes its entries
+func runCompdbTargets(ctx context.Context, executable, ninjaFile, buildTop string, targets []string) ([]map[string]interface{}, error) {
+	args := append([]string{"-f", ninjaFile, "-t", "compdb-targets"}, targets...)
+	cmd := commandContext(ctx, executable, args...)
+	cmd.Dir = buildTop
+
+	var compdbEntries []map[string]interface{}
+	err := streamCompdb(cmd, func(entry map[string]interface{}) error {
+		compdbEntries = append(compdbEntries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCompdbFailed, err)
+	}
+	return compdbEntries, nil
+}
@@ -0,0 +1,201 @@
+package wrapper
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBatchTargets(t *testing.T) {
+	targets := []string{"a", "b", "c", "d", "e"}
+
+	if got, expected := batchTargets(targets, nil, 2), []targetBatch{{0, 2}, {2, 4}, {4, 5}}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected batches %v, got %v", expected, got)
+	}
+	if got, expected := batchTargets(targets, nil, 0), []targetBatch{{0, 5}}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected a single batch %v, got %v", expected, got)
+	}
+	if got := batchTargets(nil, nil, 0); len(got) != 0 {
+		t.Errorf("Expected no batches for no targets, got %v", got)
+	}
+
+	// Long target lists are split to stay under the argument limit
+	long := strings.Repeat("x", 1000)
+	many := make([]string, 300)
+	for i := range many {
+		many[i] = long
+	}
+	batches := batchTargets(many, []string{"distninja", "-f", "build.ninja"}, 0)
+	if len(batches) < 3 {
+		t.Fatalf("Expected the argument limit to split 300KB of targets, got %v", batches)
+	}
+	for _, batch := range batches {
+		if size := (batch.end - batch.start) * (len(long) + 1 + argPointerBytes); size > maxBatchArgBytes {
+			t.Errorf("Batch %v exceeds the argument limit: %d bytes", batch, size)
+		}
+	}
+	if last := batches[len(batches)-1]; last.end != len(many) {
+		t.Errorf("Expected batches to cover every target, last is %v", last)
+	}
+}
+
+func TestSplitBatchOutput(t *testing.T) {
+	entry := func(output string) map[string]interface{} {
+		return map[string]interface{}{"output": output}
+	}
+	entries := []map[string]interface{}{entry("x.o"), entry("a"), entry("y.o"), entry("b")}
+
+	// a is listed twice and c was already built as part of b's block
+	blocks, ok := splitBatchOutput(append(entries[:2:2], entry("c"), entries[2], entries[3]), []string{"a", "a", "b", "c"}, nil)
+	if !ok {
+		t.Fatal("Expected the output to be attributed")
+	}
+	lengths := []int{len(blocks[0]), len(blocks[1]), len(blocks[2]), len(blocks[3])}
+	if !reflect.DeepEqual(lengths, []int{2, 0, 3, 0}) {
+		t.Errorf("Expected block lengths [2 0 3 0], got %v", lengths)
+	}
+
+	if _, ok := splitBatchOutput(entries, []string{"a", "phony-module"}, nil); ok {
+		t.Error("Expected attribution to fail for a target without an edge in the output")
+	}
+	if _, ok := splitBatchOutput(entries, []string{"a"}, nil); ok {
+		t.Error("Expected attribution to fail with unattributed trailing entries")
+	}
+
+	// The block of a phony target ends with the last of its inputs, x.o is built by a's block
+	// and the source file has no edge
+	boundaries := map[string][]string{"phony-module": {"y.o", "x.o", "phony.c", "b"}}
+	blocks, ok = splitBatchOutput(entries, []string{"a", "phony-module"}, boundaries)
+	if !ok || len(blocks[0]) != 2 || len(blocks[1]) != 2 {
+		t.Errorf("Expected phony-module to own y.o and b, got %v", blocks)
+	}
+}
+
+func TestParseNinjaQuery(t *testing.T) {
+	output := `phony-module:
+  input: phony
+    out/a.o
+    | out/b.o
+    || out/gen.h
+  outputs:
+    droid
+hello.c:
+  outputs:
+    out/a.o
+`
+	want := map[string]ninjaQuery{
+		"phony-module": {rule: "phony", inputs: []string{"out/a.o", "out/b.o", "out/gen.h"}},
+		"hello.c":      {},
+	}
+	if got := parseNinjaQuery(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestGetCompilationDatabaseBatched(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "invocations.log")
+
+	// Emulates compdb-targets: edges shared between targets are emitted once per invocation
+	script := `#!/bin/sh
+if [ "$4" = query ]; then
+	shift 4
+	echo "query $*" >> ` + logFile + `
+	for t in "$@"; do
+		case "$t" in
+		m) printf 'm:\n  input: phony\n    m.o\n    | nested\n  outputs:\n' ;;
+		nested) printf 'nested:\n  input: phony\n    shared.o\n' ;;
+		*) printf '%s:\n  input: cc\n' "$t" ;;
+		esac
+	done
+	exit 0
+fi
+shift 4
+echo "$*" >> ` + logFile + `
+out=''
+seen=' '
+emit() {
+	case "$seen" in *" $2 "*) return ;; esac
+	seen="$seen$2 "
+	[ -n "$out" ] && out="$out,"
+	out="$out{\"directory\":\"/src\",\"command\":\"clang -c $1 -o $2\",\"file\":\"$1\",\"output\":\"$2\"}"
+}
+for t in "$@"; do
+	case "$t" in
+	a) emit shared.c shared.o; emit a.c a ;;
+	b) emit b.c b ;;
+	c) emit shared.c shared.o; emit c.c c ;;
+	m) emit shared.c shared.o; emit m.c m.o ;;
+	*) echo "unknown target '$t'" >&2; exit 1 ;;
+	esac
+done
+echo "[$out]"
+`
+	tool := filepath.Join(dir, "fake-ninja")
+	if err := os.WriteFile(tool, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	outputs := func(commands CommandDatabase) []string {
+		var result []string
+		for _, command := range commands.Commands {
+			result = append(result, command.OutputFile)
+		}
+		return result
+	}
+	invocations := func() []string {
+		data, err := os.ReadFile(logFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = os.Remove(logFile)
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+
+	config := WrapperConfig{NinjaTool: tool, Parallelism: 1}
+	ninjaFile := filepath.Join(dir, "build.ninja")
+	expected := []string{"shared.o", "a", "b", "c"}
+
+	commands, targetErrors, err := getCompilationDatabase(context.Background(), config, ninjaFile, []string{"a", "b", "c"})
+	if err != nil || len(targetErrors) != 0 {
+		t.Fatalf("Unexpected failures: %v %v", err, targetErrors)
+	}
+	if got := outputs(commands); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected outputs %q, got %q", expected, got)
+	}
+	if got := invocations(); !reflect.DeepEqual(got, []string{"a b c"}) {
+		t.Errorf("Expected a single batched invocation, got %q", got)
+	}
+
+	// An unknown target fails its batch, which is bisected to keep the other targets
+	commands, targetErrors, _ = getCompilationDatabase(context.Background(), config, ninjaFile, []string{"a", "b", "c", "missing"})
+	if len(targetErrors) != 1 || targetErrors[0].Target != "missing" || !errors.Is(targetErrors[0], ErrCompdbFailed) {
+		t.Errorf("Expected only target missing to fail, got %v", targetErrors)
+	}
+	if got := outputs(commands); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected outputs %q, got %q", expected, got)
+	}
+	if got, want := invocations(), []string{"a b c missing", "a b", "c missing", "c", "missing"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected invocations %q, got %q", want, got)
+	}
+
+	// The phony target m owns the edges of its inputs, the ones a didn't build first
+	commands, targetErrors, err = getCompilationDatabase(context.Background(), config, ninjaFile, []string{"a", "m", "b"})
+	if err != nil || len(targetErrors) != 0 {
+		t.Fatalf("Unexpected failures: %v %v", err, targetErrors)
+	}
+	var attributed []string
+	for _, command := range commands.Commands {
+		attributed = append(attributed, command.OutputFile+"@"+command.BuildTarget)
+	}
+	if want := []string{"shared.o@a", "a@a", "m.o@m", "b@b"}; !reflect.DeepEqual(attributed, want) {
+		t.Errorf("Expected commands attributed as %q, got %q", want, attributed)
+	}
+	if got, want := invocations(), []string{"a m b", "query a m b", "query m.o nested", "query shared.o"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected invocations %q, got %q", want, got)
+	}
+}
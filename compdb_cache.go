@@ -0,0 +1,439 @@
+package wrapper
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// CompdbCacheFile is the OutDir file holding the incremental extraction cache
+const CompdbCacheFile = ".compdb_cache.json"
+
+// compdbCacheVersion invalidates caches written by wrappers that parsed commands differently
+const compdbCacheVersion = 2
+
+// maxIncrementalBatches bounds the compdb-targets runs of an incremental extraction. Every run
+// loads the whole manifest again, past this extracting everything is cheaper.
+const maxIncrementalBatches = 4
+
+// compdbCache remembers the commands of the previous run. The cache file holds a header line
+// followed by one line per compdb entry, so it is read and written one command at a time.
+//
+// When the fingerprint of the manifest files and the request are unchanged the cached database
+// is replayed as is. Otherwise scan compares the compdb entry of every edge with the cache: the
+// commands of unchanged edges are replayed, and only the changed edges are extracted again.
+type compdbCache struct {
+	compdbCacheHeader
+	path  string          // Cache file the commands are replayed from, empty without one
+	known map[string]bool // Entry hashes of the cached database, true for compile commands
+
+	files     map[string]string // Content hash of the manifest files this run read
+	unchanged map[string]bool   // Hashes of the cached commands whose edges are unchanged
+	changed   []string          // First output of every edge whose entry isn't cached
+	edges     int               // Edges with a compdb entry
+
+	mu         sync.Mutex
+	newSkipped map[string]bool
+	reused     int64
+	parsed     int64
+}
+
+// compdbCacheHeader describes the extraction a cache was written by
+type compdbCacheHeader struct {
+	Version     int      `json:"version"`
+	Fingerprint string   `json:"fingerprint"` // Content of the manifest and module-info files the database was extracted from
+	Request     string   `json:"request"`     // Build arguments and options that select the commands
+	Files       []string `json:"files"`       // Manifest files the parser read, see manifestFingerprint
+	Targets     []string `json:"targets,omitempty"`
+}
+
+// cachedCommand is one line of the cache: a parsed command together with the hash of the compdb
+// entry it came from, or the hash of an entry that is not a compile command
+type cachedCommand struct {
+	Hash string `json:"hash"`
+	Skip bool   `json:"skip,omitempty"`
+	*CompilerCommandInfo
+}
+
+// newCompdbCache returns an empty cache, every entry is parsed
+func newCompdbCache() *compdbCache {
+	return &compdbCache{known: map[string]bool{}, newSkipped: map[string]bool{}}
+}
+
+// loadCompdbCache reads the entry hashes of the cache of outDir, the commands stay on disk until
+// they are replayed. A missing or unreadable cache is empty.
+func loadCompdbCache(outDir string) *compdbCache {
+	cacheFile := filepath.Join(outDir, CompdbCacheFile)
+	file, err := os.Open(cacheFile)
+	if err != nil {
+		return newCompdbCache()
+	}
+	defer func() { _ = file.Close() }()
+
+	cache := newCompdbCache()
+	decoder := json.NewDecoder(bufio.NewReaderSize(file, 1<<20))
+	err = decoder.Decode(&cache.compdbCacheHeader)
+	for err == nil && cache.Version == compdbCacheVersion {
+		var record struct {
+			Hash string `json:"hash"`
+			Skip bool   `json:"skip"`
+		}
+		if err = decoder.Decode(&record); err == nil {
+			cache.known[record.Hash] = !record.Skip
+		}
+	}
+	if !errors.Is(err, io.EOF) || cache.Version != compdbCacheVersion {
+		fmt.Printf("Ignoring stale compile command cache: %s\n", cacheFile)
+		return newCompdbCache()
+	}
+
+	cache.path = cacheFile
+	return cache
+}
+
+// upToDate reports whether the cached database can be reused without extraction
+func (c *compdbCache) upToDate(fingerprint, request string) bool {
+	return c.Version == compdbCacheVersion && c.Fingerprint != "" && c.Fingerprint == fingerprint && c.Request == request
+}
+
+// cachedFingerprint is the manifestFingerprint of the files the cached database was extracted
+// from, as they are now
+func (c *compdbCache) cachedFingerprint(config WrapperConfig) string {
+	files := make(map[string]string, len(c.Files))
+	for _, file := range c.Files {
+		files[file] = ""
+	}
+	return manifestFingerprint(config, files)
+}
+
+// replay passes the cached commands whose hash keep accepts to fn, in the order they were
+// cached. A nil keep replays every command. Cancelling ctx stops early without an error.
+func (c *compdbCache) replay(ctx context.Context, keep func(hash string) bool, fn func(CompilerCommandInfo)) error {
+	if c.path == "" {
+		return nil
+	}
+	file, err := os.Open(c.path)
+	if err != nil {
+		return fmt.Errorf("failed to read compile command cache: %v", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	decoder := json.NewDecoder(bufio.NewReaderSize(file, 1<<20))
+	var header compdbCacheHeader
+	if err := decoder.Decode(&header); err != nil {
+		return fmt.Errorf("failed to read compile command cache: %v", err)
+	}
+	for ctx.Err() == nil {
+		var record cachedCommand
+		if err := decoder.Decode(&record); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read compile command cache: %v", err)
+		}
+		if record.Skip || record.CompilerCommandInfo == nil || (keep != nil && !keep(record.Hash)) {
+			continue
+		}
+
+		info := *record.CompilerCommandInfo
+		info.hash = record.Hash
+		atomic.AddInt64(&c.reused, 1)
+		fn(info)
+	}
+	return nil
+}
+
+// database returns the cached compile commands
+func (c *compdbCache) database() (CommandDatabase, error) {
+	commands := CommandDatabase{Commands: []CompilerCommandInfo{}}
+	err := c.replay(context.Background(), nil, func(info CompilerCommandInfo) {
+		commands.Commands = append(commands.Commands, info)
+	})
+	return commands, err
+}
+
+// useManifest records the files manifest read for the fingerprint. The synthesized top-level
+// manifest lives in a temporary directory; what it is made of is covered by the configured
+// manifests it copies.
+func (c *compdbCache) useManifest(manifest *NinjaManifest, synthesized string) {
+	c.files = make(map[string]string, len(manifest.Hashes))
+	for file, hash := range manifest.Hashes {
+		c.files[file] = hash
+	}
+	delete(c.files, manifest.resolve(synthesized))
+}
+
+// scan reads the manifest files of this run for the fingerprint. With edges, the compdb entry of
+// every edge is also compared with the cache, see planExtraction.
+func (c *compdbCache) scan(ctx context.Context, ninjaFile, rootDir string, edges bool) error {
+	var fn func(*NinjaEdge)
+	if edges {
+		c.unchanged = map[string]bool{}
+		fn = func(edge *NinjaEdge) {
+			entry, ok := edgeCompileCommand(rootDir, edge)
+			if !ok {
+				return
+			}
+			c.edges++
+			hash := compdbEntryHash(compileCommandEntries([]CompileCommand{entry})[0], rootDir)
+			command, known := c.known[hash]
+			switch {
+			case !known:
+				c.changed = append(c.changed, edge.Outputs[0])
+			case command:
+				c.unchanged[hash] = true
+			default:
+				c.newSkipped[hash] = true
+			}
+		}
+	}
+
+	manifest, err := scanNinjaManifest(ctx, ninjaFile, rootDir, fn)
+	if err != nil {
+		c.unchanged, c.changed = nil, nil
+		return err
+	}
+	c.useManifest(manifest, ninjaFile)
+
+	if manifest.rebound {
+		// The scanned commands may not be the ones ninja runs
+		fmt.Printf("Ninja variables change after the edges reading them, extracting every edge\n")
+		c.unchanged, c.changed, c.newSkipped = nil, nil, map[string]bool{}
+	}
+	return nil
+}
+
+// planExtraction returns the first output of every edge whose compdb entry changed since the
+// cached run, and whether extracting only those, with compdb-targets runs whose fixed arguments
+// are fixedArgs, is cheaper than extracting everything. When it isn't, no cached command is
+// replayed and every entry is parsed again.
+func (c *compdbCache) planExtraction(fixedArgs []string) ([]string, bool) {
+	incremental := c.unchanged != nil && len(c.known) > 0 && len(c.changed)*4 <= c.edges &&
+		len(batchTargets(c.changed, fixedArgs, 0)) <= maxIncrementalBatches
+	if !incremental {
+		c.unchanged = nil
+		return nil, false
+	}
+	return c.changed, true
+}
+
+// parseEntry is parseCompdbEntry that skips entries known not to be compile commands, and the
+// entries of unchanged edges, whose commands are replayed from the cache. A nil cache always
+// parses.
+func (c *compdbCache) parseEntry(entry map[string]interface{}, defaultWorkingDir string) CompilerCommandInfo {
+	if c == nil {
+		return parseCompdbEntry(entry, defaultWorkingDir)
+	}
+
+	hash := compdbEntryHash(entry, defaultWorkingDir)
+	if c.unchanged[hash] {
+		return CompilerCommandInfo{}
+	}
+	if command, known := c.known[hash]; known && !command {
+		atomic.AddInt64(&c.reused, 1)
+		c.mu.Lock()
+		c.newSkipped[hash] = true
+		c.mu.Unlock()
+		return CompilerCommandInfo{}
+	}
+
+	atomic.AddInt64(&c.parsed, 1)
+	info := parseCompdbEntry(entry, defaultWorkingDir)
+	info.hash = hash
+	if info.CompilerType == "" || len(info.InputFiles) == 0 {
+		c.mu.Lock()
+		c.newSkipped[hash] = true
+		c.mu.Unlock()
+	}
+	return info
+}
+
+// header describes this run for the cache it writes
+func (c *compdbCache) header(fingerprint, request string, targets []string) compdbCacheHeader {
+	files := make([]string, 0, len(c.files))
+	for file := range c.files {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	return compdbCacheHeader{
+		Version:     compdbCacheVersion,
+		Fingerprint: fingerprint,
+		Request:     request,
+		Files:       files,
+		Targets:     targets,
+	}
+}
+
+// save replaces the cache of outDir with the database extracted by this run
+func (c *compdbCache) save(outDir string, header compdbCacheHeader, commands CommandDatabase) error {
+	w, err := c.create(outDir, header)
+	if err != nil {
+		return err
+	}
+	for _, info := range commands.Commands {
+		w.add(info)
+	}
+	return w.commit()
+}
+
+// compdbCacheWriter streams the commands of this run to the cache file, which replaces the
+// previous one when committed. The methods of a nil writer do nothing.
+type compdbCacheWriter struct {
+	cache   *compdbCache
+	file    *atomicFile
+	encoder *json.Encoder
+	err     error // First write error, reported by commit
+}
+
+// create starts the cache of outDir for the commands of this run
+func (c *compdbCache) create(outDir string, header compdbCacheHeader) (*compdbCacheWriter, error) {
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %v", err)
+	}
+	file, err := createAtomicFile(outDir, CompdbCacheFile)
+	if err != nil {
+		return nil, err
+	}
+	w := &compdbCacheWriter{cache: c, file: file, encoder: json.NewEncoder(file)}
+	w.encoder.SetEscapeHTML(false)
+	w.err = w.encoder.Encode(header)
+	return w, nil
+}
+
+// add appends one command
+func (w *compdbCacheWriter) add(info CompilerCommandInfo) {
+	if w == nil || w.err != nil {
+		return
+	}
+	w.err = w.encoder.Encode(cachedCommand{Hash: info.hash, CompilerCommandInfo: &info})
+}
+
+// commit appends the entries that are not compile commands and replaces the previous cache
+func (w *compdbCacheWriter) commit() error {
+	if w == nil {
+		return nil
+	}
+
+	skipped := make([]string, 0, len(w.cache.newSkipped))
+	for hash := range w.cache.newSkipped {
+		skipped = append(skipped, hash)
+	}
+	sort.Strings(skipped)
+	for _, hash := range skipped {
+		if w.err != nil {
+			break
+		}
+		w.err = w.encoder.Encode(cachedCommand{Hash: hash, Skip: true})
+	}
+
+	if w.err != nil {
+		w.file.abort()
+		return fmt.Errorf("JSON encoding failed: %v", w.err)
+	}
+	return w.file.commit()
+}
+
+// abort discards the cache written so far, leaving the previous one in place
+func (w *compdbCacheWriter) abort() {
+	if w != nil {
+		w.file.abort()
+	}
+}
+
+// compdbEntryHash identifies a compdb entry together with the response files its command reads,
+// whose contents end up in the parsed command
+func compdbEntryHash(entry map[string]interface{}, defaultWorkingDir string) string {
+	h := sha256.New()
+
+	directory, _ := entry["directory"].(string)
+	if directory == "" {
+		directory = defaultWorkingDir
+	}
+	command, _ := entry["command"].(string)
+	file, _ := entry["file"].(string)
+	output, _ := entry["output"].(string)
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00", directory, command, file, output)
+
+	for _, field := range strings.Fields(command) {
+		if !strings.HasPrefix(field, "@") || len(field) == 1 {
+			continue
+		}
+		rspFile := strings.Trim(field[1:], `'"`)
+		if !filepath.IsAbs(rspFile) {
+			rspFile = filepath.Join(directory, rspFile)
+		}
+		if stat, err := os.Stat(rspFile); err == nil {
+			fmt.Fprintf(h, "%s\x00%d\x00%d\x00", rspFile, stat.Size(), stat.ModTime().UnixNano())
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// manifestFingerprint identifies the inputs of an extraction by the content of every manifest
+// file the parser read, of the configured top-level ninja files and of module-info.json. files
+// maps the manifest files to their content hash, or to "" when it has to be computed.
+func manifestFingerprint(config WrapperConfig, files map[string]string) string {
+	hashes := make(map[string]string, len(files)+3)
+	for file, hash := range files {
+		hashes[file] = hash
+	}
+	for _, file := range []string{config.SoongNinjaFile, config.CombinedNinjaFile, findModuleInfoFile(config)} {
+		if _, ok := hashes[file]; !ok && file != "" {
+			hashes[file] = ""
+		}
+	}
+
+	paths := make([]string, 0, len(hashes))
+	for file := range hashes {
+		paths = append(paths, file)
+	}
+	sort.Strings(paths)
+
+	h := sha256.New()
+	for _, file := range paths {
+		hash := hashes[file]
+		if hash == "" {
+			hash = fileContentHash(file)
+		}
+		fmt.Fprintf(h, "%s\x00%s\x00", file, hash)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// fileContentHash is the SHA-256 of the content of file, "missing" when it can't be read
+func fileContentHash(file string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return "missing"
+	}
+	defer func() { _ = f.Close() }()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "missing"
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cacheRequest describes the options that select which commands are extracted. Module builds
+// also depend on the working directory and the environment mm and detectModuleTargets read.
+func cacheRequest(config WrapperConfig, compileType string) string {
+	request := config.NinjaTool + "\x00" + strings.Join(config.BuildArguments, "\x00")
+	if compileType != "full" {
+		cwd, _ := os.Getwd()
+		request += "\x00" + cwd + "\x00" + os.Getenv("MODULES") + "\x00" + os.Getenv("ONE_SHOT_MAKEFILE")
+	}
+	return request
+}
@@ -0,0 +1,332 @@
+package wrapper
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompdbEntryHash(t *testing.T) {
+	dir := t.TempDir()
+	rspFile := filepath.Join(dir, "a.rsp")
+	if err := os.WriteFile(rspFile, []byte("-DA\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entry := map[string]interface{}{"directory": dir, "command": "clang @a.rsp -c a.c -o a.o", "file": "a.c", "output": "a.o"}
+	hash := compdbEntryHash(entry, "/default")
+
+	if got := compdbEntryHash(entry, "/default"); got != hash {
+		t.Errorf("Expected a stable hash, got %s and %s", hash, got)
+	}
+
+	changed := map[string]interface{}{"directory": dir, "command": "clang @a.rsp -O2 -c a.c -o a.o", "file": "a.c", "output": "a.o"}
+	if compdbEntryHash(changed, "/default") == hash {
+		t.Error("Expected a changed command to change the hash")
+	}
+
+	// Response file contents end up in the parsed command
+	if err := os.WriteFile(rspFile, []byte("-DA -DB\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if compdbEntryHash(entry, "/default") == hash {
+		t.Error("Expected a changed response file to change the hash")
+	}
+}
+
+func TestCompdbCacheParseEntry(t *testing.T) {
+	outDir := t.TempDir()
+	compile := map[string]interface{}{"directory": "/src", "command": "clang -Iinclude -c a.c -o a.o", "file": "a.c", "output": "a.o"}
+	link := map[string]interface{}{"directory": "/src", "command": "ld a.o -o app", "file": "a.o", "output": "app"}
+
+	cache := loadCompdbCache(outDir)
+	info := cache.parseEntry(compile, "/src")
+	if skipped := cache.parseEntry(link, "/src"); skipped.CompilerType != "" {
+		t.Fatalf("Expected the link command not to be a compile command, got %+v", skipped)
+	}
+	if cache.parsed != 2 || cache.reused != 0 {
+		t.Errorf("Expected 2 parsed entries, got %d parsed and %d reused", cache.parsed, cache.reused)
+	}
+
+	cache.files = map[string]string{"/src/build.ninja": "hash"}
+	header := cache.header("fingerprint", "request", []string{"app"})
+	if err := cache.save(outDir, header, CommandDatabase{Commands: []CompilerCommandInfo{info}}); err != nil {
+		t.Fatalf("Failed to save cache: %v", err)
+	}
+
+	cache = loadCompdbCache(outDir)
+	if !cache.upToDate("fingerprint", "request") || cache.upToDate("other", "request") {
+		t.Error("Expected the cache to match only its own fingerprint")
+	}
+	if !reflect.DeepEqual(cache.Targets, []string{"app"}) || !reflect.DeepEqual(cache.Files, []string{"/src/build.ninja"}) {
+		t.Errorf("Expected cached targets [app] read from /src/build.ninja, got %v from %v", cache.Targets, cache.Files)
+	}
+	if db, err := cache.database(); err != nil || !reflect.DeepEqual(db.Commands, []CompilerCommandInfo{info}) {
+		t.Errorf("Expected the cached command %+v, got %+v: %v", info, db.Commands, err)
+	}
+
+	// Entries known not to be compile commands aren't parsed again
+	cache.parseEntry(link, "/src")
+	if cache.parsed != 0 || cache.reused != 2 {
+		t.Errorf("Expected 2 reused entries, got %d parsed and %d reused", cache.parsed, cache.reused)
+	}
+
+	// A corrupt cache is ignored
+	if err := os.WriteFile(filepath.Join(outDir, CompdbCacheFile), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cache := loadCompdbCache(outDir); len(cache.known) != 0 || cache.upToDate("fingerprint", "request") {
+		t.Error("Expected a corrupt cache to be empty")
+	}
+}
+
+func TestRunNinjaWithCommandLoggingIncremental(t *testing.T) {
+	config := setupNativeRun(t)
+	config.BuildArguments = []string{"m", "hello"}
+
+	if _, err := RunNinjaWithCommandLogging(context.Background(), config, false); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(config.OutDir, CompdbCacheFile)); err != nil {
+		t.Fatalf("Expected the cache to be written: %v", err)
+	}
+
+	// An unchanged manifest skips extraction
+	result, err := RunNinjaWithCommandLogging(context.Background(), config, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Durations.Manifest != 0 || result.Commands != 1 || !reflect.DeepEqual(result.Targets, []string{"hello"}) {
+		t.Errorf("Expected the cached database to be reused, got %+v", result)
+	}
+	if len(result.Outputs) != 1 {
+		t.Errorf("Expected the database to be written, got %v", result.Outputs)
+	}
+
+	// A manifest regenerated with the same content is still up to date
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(config.SoongNinjaFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	result, err = RunNinjaWithCommandLogging(context.Background(), config, false)
+	if err != nil || result.Durations.Manifest != 0 {
+		t.Errorf("Expected a touched manifest to reuse the cache, got %+v: %v", result, err)
+	}
+
+	// A changed manifest is extracted again
+	content, err := os.ReadFile(config.SoongNinjaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(config.SoongNinjaFile, append(content, "# regenerated\n"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err = RunNinjaWithCommandLogging(context.Background(), config, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Durations.Manifest == 0 || result.Commands != 1 {
+		t.Errorf("Expected the changed manifest to be extracted, got %+v", result)
+	}
+
+	config.ForceFullRebuild = true
+	result, err = RunNinjaWithCommandLogging(context.Background(), config, false)
+	if err != nil || result.Durations.Manifest == 0 || result.Commands != 1 {
+		t.Errorf("Expected a forced full extraction, got %+v: %v", result, err)
+	}
+}
+
+func TestCacheRequest(t *testing.T) {
+	t.Setenv("MODULES", "")
+	full := WrapperConfig{NinjaTool: "distninja", BuildArguments: []string{"m"}}
+	module := WrapperConfig{NinjaTool: "distninja", BuildArguments: []string{"mm"}}
+
+	fullRequest, moduleRequest := cacheRequest(full, "full"), cacheRequest(module, "module")
+
+	// mm in another directory, or other MODULES, selects other targets
+	origDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(origDir); err != nil {
+			t.Errorf("Failed to restore working directory: %v", err)
+		}
+	}()
+	if cacheRequest(module, "module") == moduleRequest {
+		t.Error("Expected the working directory to be part of module build requests")
+	}
+	if cacheRequest(full, "full") != fullRequest {
+		t.Error("Expected full builds not to depend on the working directory")
+	}
+
+	request := cacheRequest(module, "module")
+	t.Setenv("MODULES", "libfoo")
+	if cacheRequest(module, "module") == request {
+		t.Error("Expected MODULES to be part of module build requests")
+	}
+}
+
+func TestCacheNotReusedAfterTargetErrors(t *testing.T) {
+	config := setupNativeRun(t)
+	config.CompdbFormat = CompdbFormatInternal
+	config.BuildArguments = []string{"m", "hello"}
+
+	// One of the two targets hello resolves to fails
+	bin := t.TempDir()
+	script := "#!/bin/sh\ncase \"$4\" in\n" +
+		"targets) echo 'hello: phony'; echo 'hello_test: phony' ;;\n" +
+		"*) for t; do [ \"$t\" = hello_test ] && exit 1; done\n" +
+		"   echo '[{\"directory\":\"/src\",\"command\":\"clang -c hello.c -o hello.o\",\"file\":\"hello.c\",\"output\":\"hello.o\"}]' ;;\n" +
+		"esac\n"
+	if err := os.WriteFile(filepath.Join(bin, "distninja"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+
+	for run := 0; run < 2; run++ {
+		result, err := RunNinjaWithCommandLogging(context.Background(), config, false)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(result.TargetErrors) != 1 || result.Durations.Manifest == 0 {
+			t.Errorf("Run %d: expected extraction to run again and report the failed target, got %+v", run, result)
+		}
+	}
+}
+
+func TestIncrementalExtraction(t *testing.T) {
+	manifest := "rule cc\n  command = clang -c $in -o $out\n"
+	for _, name := range []string{"a", "b", "c", "d"} {
+		manifest += "build out/" + name + ".o: cc " + name + ".c\n"
+	}
+	dir := writeNinjaFiles(t, map[string]string{"build.ninja": manifest})
+	t.Setenv("ANDROID_BUILD_TOP", "")
+	t.Setenv("ANDROID_PRODUCT_OUT", "")
+
+	// distninja prints the entries of entries/<output>.json and logs the tool it ran
+	entries := filepath.Join(dir, "entries")
+	writeEntry := func(name, command string) {
+		entry := `{"command":"` + command + `","file":"` + name + `.c","output":"out/` + name + `.o"}`
+		if err := os.MkdirAll(entries, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(entries, name+".o.json"), []byte(entry), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		writeEntry(name, "clang -c "+name+".c -o out/"+name+".o")
+	}
+	logFile := filepath.Join(dir, "distninja.log")
+	bin := t.TempDir()
+	script := `#!/bin/sh
+tool=$4
+shift 4
+echo "$tool $*" >> ` + logFile + `
+[ "$tool" = compdb ] && set -- out/a.o out/b.o out/c.o out/d.o
+sep='['
+for t; do printf '%s' "$sep"; read -r entry < "` + entries + `/${t##*/}.json"; printf '%s' "$entry"; sep=','; done
+echo ']'
+`
+	if err := os.WriteFile(filepath.Join(bin, "distninja"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+
+	config := WrapperConfig{
+		OutDir:         filepath.Join(dir, "out"),
+		SoongNinjaFile: filepath.Join(dir, "build.ninja"),
+		CompdbFormat:   CompdbFormatClang,
+	}
+	run := func() (*Result, string) {
+		t.Helper()
+		_ = os.Remove(logFile)
+		result, err := RunNinjaWithCommandLogging(context.Background(), config, false)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		log, _ := os.ReadFile(logFile)
+		return result, strings.TrimSpace(string(log))
+	}
+
+	if result, log := run(); result.Commands != 4 || log != "compdb" {
+		t.Fatalf("Expected a full extraction of 4 commands, got %d from %q", result.Commands, log)
+	}
+
+	// Only the edge whose command changed is extracted again
+	manifest = strings.Replace(manifest, "build out/d.o: cc d.c\n", "build out/d.o: cc d.c\n  command = clang -O2 -c $in -o $out\n", 1)
+	if err := os.WriteFile(config.SoongNinjaFile, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeEntry("d", "clang -O2 -c d.c -o out/d.o")
+	result, log := run()
+	if result.Commands != 4 || log != "compdb-targets out/d.o" {
+		t.Errorf("Expected out/d.o to be extracted again, got %d commands from %q", result.Commands, log)
+	}
+
+	data, err := os.ReadFile(filepath.Join(config.OutDir, ClangCompileCommandsDir, CompileCommandsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var db []CompileCommand
+	if err := json.Unmarshal(data, &db); err != nil {
+		t.Fatal(err)
+	}
+	optimized := 0
+	for _, entry := range db {
+		if strings.Contains(strings.Join(entry.Arguments, " ")+entry.Command, "-O2") {
+			optimized++
+		}
+	}
+	if len(db) != 4 || optimized != 1 {
+		t.Errorf("Expected 4 commands with d built at -O2, got %+v", db)
+	}
+
+	// Unchanged manifests are replayed without running distninja
+	if result, log := run(); result.Durations.Manifest != 0 || log != "" {
+		t.Errorf("Expected the cache to be reused, got %+v running %q", result, log)
+	}
+}
+
+func TestManifestFingerprint(t *testing.T) {
+	dir := writeNinjaFiles(t, map[string]string{
+		"build.ninja": "subninja sub.ninja\n",
+		"sub.ninja":   "rule cc\n  command = clang -c $in -o $out\n",
+	})
+	config := WrapperConfig{OutDir: filepath.Join(dir, "out"), SoongNinjaFile: filepath.Join(dir, "build.ninja")}
+
+	cache := newCompdbCache()
+	if err := cache.scan(context.Background(), config.SoongNinjaFile, dir, false); err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	fingerprint := manifestFingerprint(config, cache.files)
+	cache.compdbCacheHeader = cache.header(fingerprint, "request", nil)
+	if cache.cachedFingerprint(config) != fingerprint {
+		t.Error("Expected the cached files to have the fingerprint of the scanned ones")
+	}
+
+	// Only the content of the files counts
+	sub := filepath.Join(dir, "sub.ninja")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(sub, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if cache.cachedFingerprint(config) != fingerprint {
+		t.Error("Expected a touched subninja to keep the fingerprint")
+	}
+	if err := os.WriteFile(sub, []byte("rule cc\n  command = clang -O2 -c $in -o $out\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cache.cachedFingerprint(config) == fingerprint {
+		t.Error("Expected a changed subninja to change the fingerprint")
+	}
+}
@@ -0,0 +1,180 @@
+package wrapper
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// invocationOrigin describes the build invocation that contributed commands in merge mode
+func invocationOrigin(config WrapperConfig) string {
+	if len(config.BuildArguments) == 0 {
+		return "m"
+	}
+	origin := strings.Join(config.BuildArguments, " ")
+	if config.BuildArguments[0] == "mm" || config.BuildArguments[0] == "mma" {
+		// mm builds the modules of the current directory
+		if dir, err := os.Getwd(); err == nil {
+			origin += " (" + dir + ")"
+		}
+	}
+	return origin
+}
+
+// mergeKey identifies the entries an upsert replaces
+func mergeKey(info CompilerCommandInfo) string {
+	return strings.Join(info.InputFiles, ",") + "\x00" + info.OutputFile
+}
+
+// loadExistingDatabase reads the database a previous run wrote to config.OutDir: the internal
+// layout, or the clang layout when only that was written. A missing database is empty.
+func loadExistingDatabase(config WrapperConfig) (CommandDatabase, error) {
+	var commands CommandDatabase
+
+	data, err := os.ReadFile(filepath.Join(config.OutDir, CompileCommandsFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &commands); err != nil {
+			return CommandDatabase{}, fmt.Errorf("failed to parse %s: %v", CompileCommandsFile, err)
+		}
+		return commands, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return CommandDatabase{}, err
+	}
+
+	clangFile := filepath.Join(config.OutDir, ClangCompileCommandsDir, CompileCommandsFile)
+	data, err = os.ReadFile(clangFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return commands, nil
+	} else if err != nil {
+		return CommandDatabase{}, err
+	}
+
+	var entries []CompileCommand
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return CommandDatabase{}, fmt.Errorf("failed to parse %s: %v", clangFile, err)
+	}
+	set := commandSet{}
+	for _, entry := range compileCommandEntries(entries) {
+		cmdInfo := parseCompdbEntry(entry, os.Getenv("ANDROID_BUILD_TOP"))
+		if cmdInfo.CompilerType != "" && len(cmdInfo.InputFiles) > 0 {
+			set.add(&commands, cmdInfo)
+		}
+	}
+	return commands, nil
+}
+
+// graphOutputs returns whether the output of a command is still built by the current ninja
+// graph, or nil when the graph is unknown and nothing should be evicted
+func graphOutputs(ctx context.Context, config WrapperConfig, ninjaFile string) func(CompilerCommandInfo) bool {
+	rootDir := os.Getenv("ANDROID_BUILD_TOP")
+	var has func(string) bool
+
+	if config.manifest != nil {
+		rootDir = config.manifest.RootDir
+		has = config.manifest.Graph().Has
+	} else {
+		cmd := commandContext(ctx, config.NinjaTool, "-f", ninjaFile, "-t", "targets", "all")
+		var outBuf bytes.Buffer
+		cmd.Stdout = &outBuf
+		cmd.Dir = rootDir
+		if err := cmd.Run(); err != nil {
+			fmt.Printf("Failed to list ninja outputs, keeping every existing command: %v\n", err)
+			return nil
+		}
+
+		outputs := map[string]bool{}
+		scanner := bufio.NewScanner(&outBuf)
+		for scanner.Scan() {
+			// Lines are "output: rule"
+			if output, _, ok := strings.Cut(scanner.Text(), ": "); ok {
+				outputs[output] = true
+			}
+		}
+		if len(outputs) == 0 {
+			return nil
+		}
+		has = func(output string) bool { return outputs[canonicalizeNinjaPath(output)] }
+	}
+
+	return func(info CompilerCommandInfo) bool {
+		if info.OutputFile == "" {
+			return true
+		}
+		// Previous commands were written with the path policy applied
+		output := config.Paths.unmap(info.OutputFile)
+		if !filepath.IsAbs(output) {
+			output = filepath.Join(config.Paths.unmap(info.WorkingDir), output)
+		}
+		if rel, err := filepath.Rel(rootDir, output); err == nil && !strings.HasPrefix(rel, "..") {
+			output = rel
+		}
+		return has(output)
+	}
+}
+
+// mergeCommandDatabases upserts current into existing. Existing entries keep their position
+// unless replaced, entries new to the database are appended, and existing entries live rejects
+// are evicted; a nil live keeps them all. It returns the merged database and the evicted count.
+func mergeCommandDatabases(existing, current CommandDatabase, live func(CompilerCommandInfo) bool) (CommandDatabase, int) {
+	updates := make(map[string]int, len(current.Commands))
+	for i, info := range current.Commands {
+		updates[mergeKey(info)] = i
+	}
+
+	merged := CommandDatabase{Commands: make([]CompilerCommandInfo, 0, len(existing.Commands)+len(current.Commands))}
+	used := make([]bool, len(current.Commands))
+	evicted := 0
+
+	for _, info := range existing.Commands {
+		if i, ok := updates[mergeKey(info)]; ok {
+			if !used[i] {
+				used[i] = true
+				merged.Commands = append(merged.Commands, current.Commands[i])
+			}
+			continue
+		}
+		if live != nil && !live(info) {
+			evicted++
+			continue
+		}
+		merged.Commands = append(merged.Commands, info)
+	}
+
+	for i, info := range current.Commands {
+		if !used[i] {
+			merged.Commands = append(merged.Commands, info)
+		}
+	}
+
+	return merged, evicted
+}
+
+// mergeExistingDatabase merges the commands of this run into the database of previous runs,
+// see WrapperConfig.MergeDatabase
+func mergeExistingDatabase(config WrapperConfig, commands CommandDatabase, live func(CompilerCommandInfo) bool, result *Result) CommandDatabase {
+	existing, err := loadExistingDatabase(config)
+	if err != nil {
+		fmt.Printf("Warning: Failed to read existing compilation database, replacing it: %v\n", err)
+		result.Warnings = append(result.Warnings, err)
+	}
+
+	origin := invocationOrigin(config)
+	current := CommandDatabase{Commands: make([]CompilerCommandInfo, len(commands.Commands))}
+	for i, info := range commands.Commands {
+		info.Origin = origin
+		current.Commands[i] = info
+	}
+
+	merged, evicted := mergeCommandDatabases(existing, current, live)
+	fmt.Printf("Merged %d commands into %d existing, evicted %d stale commands\n",
+		len(current.Commands), len(existing.Commands), evicted)
+	result.Evicted = evicted
+
+	return merged
+}
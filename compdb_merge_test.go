@@ -0,0 +1,122 @@
+package wrapper
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMergeCommandDatabases(t *testing.T) {
+	command := func(file, output, cmd string) CompilerCommandInfo {
+		return CompilerCommandInfo{Command: cmd, InputFiles: []string{file}, OutputFile: output}
+	}
+	existing := CommandDatabase{Commands: []CompilerCommandInfo{
+		command("a.c", "a.o", "clang -c a.c"),
+		command("b.c", "b.o", "clang -c b.c"),
+		command("gone.c", "gone.o", "clang -c gone.c"),
+	}}
+	current := CommandDatabase{Commands: []CompilerCommandInfo{
+		command("c.c", "c.o", "clang -c c.c"),
+		command("b.c", "b.o", "clang -O2 -c b.c"),
+	}}
+	live := func(info CompilerCommandInfo) bool { return info.OutputFile != "gone.o" }
+
+	merged, evicted := mergeCommandDatabases(existing, current, live)
+	var commands []string
+	for _, info := range merged.Commands {
+		commands = append(commands, info.Command)
+	}
+	if want := []string{"clang -c a.c", "clang -O2 -c b.c", "clang -c c.c"}; !reflect.DeepEqual(commands, want) {
+		t.Errorf("Expected merged commands %q, got %q", want, commands)
+	}
+	if evicted != 1 {
+		t.Errorf("Expected 1 evicted command, got %d", evicted)
+	}
+
+	// Without a graph nothing is evicted
+	if merged, evicted := mergeCommandDatabases(existing, current, nil); len(merged.Commands) != 4 || evicted != 0 {
+		t.Errorf("Expected 4 commands and no eviction, got %d and %d", len(merged.Commands), evicted)
+	}
+}
+
+func TestRunNinjaWithCommandLoggingMerge(t *testing.T) {
+	config := setupNativeRun(t)
+	config.CompdbFormat = CompdbFormatClang | CompdbFormatJavaProjects
+	config.MergeDatabase = true
+
+	manifest := `build out/world/main.o: cc world/main.c
+build world: phony out/world/main.o
+`
+	writeManifest := func(content string) {
+		if err := os.WriteFile(config.SoongNinjaFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	original, err := os.ReadFile(config.SoongNinjaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeManifest(string(original) + manifest)
+
+	outputs := func() map[string]string {
+		data, err := os.ReadFile(filepath.Join(config.OutDir, ClangCompileCommandsDir, CompileCommandsFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []CompileCommand
+		if err := json.Unmarshal(data, &entries); err != nil {
+			t.Fatal(err)
+		}
+		result := map[string]string{}
+		for _, entry := range entries {
+			result[entry.Output] = entry.File
+		}
+		return result
+	}
+
+	for _, module := range []string{"hello", "world"} {
+		config.BuildArguments = []string{"m", module}
+		if _, err := RunNinjaWithCommandLogging(context.Background(), config, false); err != nil {
+			t.Fatalf("Unexpected error building %s: %v", module, err)
+		}
+	}
+	want := map[string]string{"out/hello/main.o": "hello/main.c", "out/world/main.o": "world/main.c"}
+	if got := outputs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected both modules to be kept, got %v", got)
+	}
+
+	// Without the internal layout the clang layout is merged; hello left the graph
+	writeManifest("rule cc\n  command = clang -c $in -o $out\n" + manifest)
+	result, err := RunNinjaWithCommandLogging(context.Background(), config, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Evicted != 1 {
+		t.Errorf("Expected hello to be evicted, got %d evictions", result.Evicted)
+	}
+	if got := outputs(); !reflect.DeepEqual(got, map[string]string{"out/world/main.o": "world/main.c"}) {
+		t.Errorf("Expected only world to be kept, got %v", got)
+	}
+}
+
+func TestMergeRecordsOrigin(t *testing.T) {
+	config := setupNativeRun(t)
+	config.CompdbFormat = CompdbFormatInternal
+	config.MergeDatabase = true
+	config.BuildArguments = []string{"m", "hello"}
+
+	if _, err := RunNinjaWithCommandLogging(context.Background(), config, false); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	existing, err := loadExistingDatabase(config)
+	if err != nil || len(existing.Commands) != 1 {
+		t.Fatalf("Expected 1 existing command, got %v: %v", existing.Commands, err)
+	}
+	if origin := existing.Commands[0].Origin; origin != "m hello" {
+		t.Errorf("Expected origin %q, got %q", "m hello", origin)
+	}
+}
@@ -0,0 +1,227 @@
+package wrapper
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// CompdbShardDir is the OutDir subdirectory holding the sharded clang layout
+	CompdbShardDir = "compdb"
+	// CompdbShardIndexFile maps source files to their shards within CompdbShardDir
+	CompdbShardIndexFile = "index.json"
+)
+
+// ShardMode selects how CompdbFormatShards splits the database
+type ShardMode int
+
+const (
+	// ShardByModule writes one database per CompilerCommandInfo.Module
+	ShardByModule ShardMode = iota
+	// ShardBySourceDir writes one database per source file directory
+	ShardBySourceDir
+)
+
+func (m ShardMode) String() string {
+	if m == ShardBySourceDir {
+		return "directory"
+	}
+	return "module"
+}
+
+// unknownShard holds commands without a module
+const unknownShard = "_unknown"
+
+// shardIndex is the content of CompdbShardIndexFile
+type shardIndex struct {
+	ShardBy string              `json:"shardBy"`
+	Shards  map[string]string   `json:"shards"` // Shard name -> database path relative to the index
+	Files   map[string][]string `json:"files"`  // Source path -> shards compiling it
+}
+
+// shardName returns the shard of a clang entry
+func shardName(mode ShardMode, info CompilerCommandInfo, file string) string {
+	if mode == ShardBySourceDir {
+		dir := filepath.Clean(filepath.Dir(file))
+		if dir == "." || dir == "/" || strings.HasPrefix(dir, "..") {
+			return unknownShard
+		}
+		return strings.TrimPrefix(dir, "/")
+	}
+
+	if info.Module == "" {
+		return unknownShard
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("._+-", r) {
+			return r
+		}
+		return '_'
+	}, info.Module)
+}
+
+// shardIndexPath is the index key of a clang entry, its file resolved against its directory
+func shardIndexPath(directory, file string) string {
+	if !filepath.IsAbs(file) && directory != "" {
+		file = filepath.Join(directory, file)
+	}
+	return filepath.Clean(file)
+}
+
+// writeShardedCompileCommands writes the clang layout split into outputDir/<shard>/compile_commands.json
+// and the index mapping source files to shards. The previous shards are replaced as a whole.
+func writeShardedCompileCommands(outputDir string, commands CommandDatabase, mode ShardMode, useArguments bool) error {
+	shards := map[string][]CompileCommand{}
+	index := shardIndex{ShardBy: mode.String(), Shards: map[string]string{}, Files: map[string][]string{}}
+
+	for _, info := range commands.Commands {
+		for _, entry := range toClangCompileCommands(CommandDatabase{Commands: []CompilerCommandInfo{info}}, useArguments) {
+			shard := shardName(mode, info, entry.File)
+			shards[shard] = append(shards[shard], entry)
+
+			path := shardIndexPath(entry.Directory, entry.File)
+			if !slices.Contains(index.Files[path], shard) {
+				index.Files[path] = append(index.Files[path], shard)
+			}
+		}
+	}
+
+	// Shards are written next to the previous ones and swapped in once complete
+	tempDir := outputDir + ".tmp"
+	if err := os.RemoveAll(tempDir); err != nil {
+		return fmt.Errorf("failed to clear temporary directory: %v", err)
+	}
+
+	for shard, entries := range shards {
+		shardDir := filepath.Join(tempDir, shard)
+		if err := os.MkdirAll(shardDir, 0755); err != nil {
+			return fmt.Errorf("failed to create shard directory: %v", err)
+		}
+		jsonData, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return fmt.Errorf("JSON encoding failed: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(shardDir, CompileCommandsFile), jsonData, 0644); err != nil {
+			return fmt.Errorf("failed to write shard %s: %v", shard, err)
+		}
+		index.Shards[shard] = filepath.Join(shard, CompileCommandsFile)
+	}
+
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %v", err)
+	}
+	jsonData, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("JSON encoding failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, CompdbShardIndexFile), jsonData, 0644); err != nil {
+		return fmt.Errorf("failed to write shard index: %v", err)
+	}
+
+	if err := os.RemoveAll(outputDir); err != nil {
+		return fmt.Errorf("failed to remove previous shards: %v", err)
+	}
+	if err := os.Rename(tempDir, outputDir); err != nil {
+		return fmt.Errorf("failed to rename shard directory: %v", err)
+	}
+
+	return nil
+}
+
+// ShardedDatabase resolves source files to the commands of a sharded database, reading only
+// the index up front and each shard the first time a file in it is looked up
+type ShardedDatabase struct {
+	Dir   string
+	index shardIndex
+
+	mu     sync.Mutex
+	loaded map[string][]CompileCommand
+}
+
+// OpenShardedDatabase reads the index of a directory written by CompdbFormatShards
+func OpenShardedDatabase(dir string) (*ShardedDatabase, error) {
+	data, err := os.ReadFile(filepath.Join(dir, CompdbShardIndexFile))
+	if err != nil {
+		return nil, err
+	}
+
+	db := &ShardedDatabase{Dir: dir, loaded: map[string][]CompileCommand{}}
+	if err := json.Unmarshal(data, &db.index); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", CompdbShardIndexFile, err)
+	}
+	return db, nil
+}
+
+// Files returns the indexed source paths, sorted
+func (d *ShardedDatabase) Files() []string {
+	files := make([]string, 0, len(d.index.Files))
+	for file := range d.index.Files {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// ShardsFor returns the shards compiling file, a path as resolved against the entry directories
+func (d *ShardedDatabase) ShardsFor(file string) []string {
+	return d.index.Files[filepath.Clean(file)]
+}
+
+// ShardPath returns the database file of shard
+func (d *ShardedDatabase) ShardPath(shard string) string {
+	if rel, ok := d.index.Shards[shard]; ok {
+		return filepath.Join(d.Dir, rel)
+	}
+	return ""
+}
+
+// CommandsFor returns the entries compiling file, loading the shards holding them as needed
+func (d *ShardedDatabase) CommandsFor(file string) ([]CompileCommand, error) {
+	file = filepath.Clean(file)
+
+	var result []CompileCommand
+	for _, shard := range d.ShardsFor(file) {
+		entries, err := d.shard(shard)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if shardIndexPath(entry.Directory, entry.File) == file {
+				result = append(result, entry)
+			}
+		}
+	}
+	return result, nil
+}
+
+// shard loads a shard once
+func (d *ShardedDatabase) shard(shard string) ([]CompileCommand, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if entries, ok := d.loaded[shard]; ok {
+		return entries, nil
+	}
+
+	path := d.ShardPath(shard)
+	if path == "" {
+		return nil, fmt.Errorf("shard %s is not in the index", shard)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []CompileCommand
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse shard %s: %v", shard, err)
+	}
+
+	d.loaded[shard] = entries
+	return entries, nil
+}
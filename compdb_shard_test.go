@@ -0,0 +1,111 @@
+package wrapper
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func shardTestDatabase() CommandDatabase {
+	command := func(module, file, output string) CompilerCommandInfo {
+		return CompilerCommandInfo{
+			Command:      "clang -c " + file + " -o " + output,
+			CompilerType: "clang",
+			InputFiles:   []string{file},
+			OutputFile:   output,
+			WorkingDir:   "/src",
+			Module:       module,
+		}
+	}
+	return CommandDatabase{Commands: []CompilerCommandInfo{
+		command("libfoo", "foo/a.c", "out/foo/a.o"),
+		command("libfoo", "foo/sub/b.c", "out/foo/b.o"),
+		command("libbar", "bar/c.c", "out/bar/c.o"),
+		// Compiled again by a second module
+		command("libbar", "foo/a.c", "out/bar/a.o"),
+		command("", "gen.c", "out/gen.o"),
+	}}
+}
+
+func TestWriteShardedCompileCommands(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), CompdbShardDir)
+
+	// Shards of a previous run are replaced
+	stale := filepath.Join(dir, "libstale")
+	if err := os.MkdirAll(stale, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeShardedCompileCommands(dir, shardTestDatabase(), ShardByModule, false); err != nil {
+		t.Fatalf("Failed to write shards: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("Expected the stale shard to be removed, got %v", err)
+	}
+	for _, shard := range []string{"libfoo", "libbar", unknownShard} {
+		if _, err := os.Stat(filepath.Join(dir, shard, CompileCommandsFile)); err != nil {
+			t.Errorf("Expected shard %s: %v", shard, err)
+		}
+	}
+
+	db, err := OpenShardedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open shards: %v", err)
+	}
+	if got := db.ShardsFor("/src/foo/a.c"); !reflect.DeepEqual(got, []string{"libfoo", "libbar"}) {
+		t.Errorf("Expected foo/a.c in libfoo and libbar, got %v", got)
+	}
+	if got := len(db.Files()); got != 4 {
+		t.Errorf("Expected 4 indexed files, got %d", got)
+	}
+
+	// Only the shards holding the file are read
+	entries, err := db.CommandsFor("/src/foo/sub/../sub/b.c")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Output != "out/foo/b.o" {
+		t.Errorf("Expected the entry of foo/sub/b.c, got %+v", entries)
+	}
+	if len(db.loaded) != 1 {
+		t.Errorf("Expected only libfoo to be loaded, got %d shards", len(db.loaded))
+	}
+
+	entries, _ = db.CommandsFor("/src/foo/a.c")
+	if len(entries) != 2 || len(db.loaded) != 2 {
+		t.Errorf("Expected 2 entries from 2 loaded shards, got %+v and %d shards", entries, len(db.loaded))
+	}
+	if entries, _ := db.CommandsFor("/src/missing.c"); len(entries) != 0 {
+		t.Errorf("Expected no entries for an unknown file, got %+v", entries)
+	}
+}
+
+func TestShardBySourceDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), CompdbShardDir)
+	if err := writeShardedCompileCommands(dir, shardTestDatabase(), ShardBySourceDir, true); err != nil {
+		t.Fatalf("Failed to write shards: %v", err)
+	}
+
+	db, err := OpenShardedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open shards: %v", err)
+	}
+	for file, shard := range map[string]string{
+		"/src/foo/a.c":     "foo",
+		"/src/foo/sub/b.c": "foo/sub",
+		"/src/gen.c":       unknownShard,
+	} {
+		if got := db.ShardsFor(file); !reflect.DeepEqual(got, []string{shard}) {
+			t.Errorf("Expected %s in shard %s, got %v", file, shard, got)
+		}
+	}
+
+	entries, err := db.CommandsFor("/src/foo/a.c")
+	if err != nil || len(entries) != 2 || len(entries[0].Arguments) == 0 {
+		t.Errorf("Expected 2 entries with arguments, got %+v: %v", entries, err)
+	}
+	if got := db.ShardPath("foo/sub"); got != filepath.Join(dir, "foo", "sub", CompileCommandsFile) {
+		t.Errorf("Unexpected shard path %s", got)
+	}
+}
@@ -0,0 +1,266 @@
+package wrapper
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// decodeCompdbStream decodes a JSON compilation database array from r, passing each entry to fn
+// as soon as it is read. An error from fn stops decoding.
+func decodeCompdbStream(r io.Reader, fn func(entry map[string]interface{}) error) error {
+	dec := json.NewDecoder(r)
+
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("expected a JSON array, got %v", token)
+	}
+
+	for dec.More() {
+		var entry map[string]interface{}
+		if err := dec.Decode(&entry); err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+
+	// Closing bracket
+	_, err = dec.Token()
+	return err
+}
+
+// streamCompdb runs cmd and passes each entry of the JSON compilation database it prints to fn
+// while it runs. A failing command takes precedence over decoding errors.
+func streamCompdb(cmd *exec.Cmd, fn func(entry map[string]interface{}) error) error {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	decodeErr := decodeCompdbStream(stdout, fn)
+	// Drain what the decoder left so the child doesn't block on a full pipe
+	_, _ = io.Copy(io.Discard, stdout)
+
+	if err := cmd.Wait(); err != nil {
+		return err
+	}
+	if decodeErr != nil {
+		return fmt.Errorf("failed to parse JSON: %v", decodeErr)
+	}
+	return nil
+}
+
+// jsonArrayWriter writes a JSON array one element at a time, indented like json.MarshalIndent
+// with a two space indent would at the given nesting depth
+type jsonArrayWriter struct {
+	w      io.Writer
+	indent string
+	prefix string
+	count  int
+}
+
+// Add encodes v as the next element
+func (a *jsonArrayWriter) Add(v interface{}) error {
+	data, err := json.MarshalIndent(v, a.prefix, "  ")
+	if err != nil {
+		return fmt.Errorf("JSON encoding failed: %v", err)
+	}
+
+	separator := ",\n"
+	if a.count == 0 {
+		separator = "\n"
+	}
+	a.count++
+
+	if _, err := io.WriteString(a.w, separator+a.prefix); err != nil {
+		return err
+	}
+	_, err = a.w.Write(data)
+	return err
+}
+
+// openJSONArray starts a JSON array after header at depth levels of nesting, see writeJSONArray
+func openJSONArray(w io.Writer, header string, depth int) (*jsonArrayWriter, error) {
+	indent := strings.Repeat("  ", depth)
+	array := &jsonArrayWriter{w: w, indent: indent, prefix: indent + "  "}
+	_, err := io.WriteString(w, header+"[")
+	return array, err
+}
+
+// close ends the array, followed by footer
+func (a *jsonArrayWriter) close(footer string) error {
+	closing := "]"
+	if a.count > 0 {
+		closing = "\n" + a.indent + "]"
+	}
+	_, err := io.WriteString(a.w, closing+footer)
+	return err
+}
+
+// writeJSONArray streams the elements produce adds to w as a JSON array, surrounded by header
+// and footer, at depth levels of nesting
+func writeJSONArray(w io.Writer, header, footer string, depth int, produce func(array *jsonArrayWriter) error) error {
+	array, err := openJSONArray(w, header, depth)
+	if err != nil {
+		return err
+	}
+	if err := produce(array); err != nil {
+		return err
+	}
+	return array.close(footer)
+}
+
+// atomicFile is a buffered temporary file that replaces its destination only once committed
+type atomicFile struct {
+	*bufio.Writer
+	file     *os.File
+	path     string
+	tempPath string
+}
+
+// createAtomicFile starts writing dir/name through a temporary file in dir
+func createAtomicFile(dir, name string) (*atomicFile, error) {
+	tempFile := atomicTempFile(dir, name)
+	file, err := os.Create(tempFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write temporary file: %v", err)
+	}
+	return &atomicFile{
+		Writer:   bufio.NewWriterSize(file, 1<<20),
+		file:     file,
+		path:     filepath.Join(dir, name),
+		tempPath: tempFile,
+	}, nil
+}
+
+// commit flushes the content and renames the temporary file into place
+func (f *atomicFile) commit() error {
+	err := f.Flush()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(f.tempPath)
+		return fmt.Errorf("failed to write temporary file: %v", err)
+	}
+
+	if err := os.Rename(f.tempPath, f.path); err != nil {
+		_ = os.Remove(f.tempPath)
+		return fmt.Errorf("failed to rename file: %v", err)
+	}
+	return nil
+}
+
+// abort removes the temporary file, leaving the destination as it was
+func (f *atomicFile) abort() {
+	_ = f.file.Close()
+	_ = os.Remove(f.tempPath)
+}
+
+// writeStreamAtomic is writeFileAtomic for content produced by write: it goes to a buffered
+// temporary file that replaces dir/name only once write succeeded. Writing fails once ctx is
+// done, leaving dir/name as it was.
+func writeStreamAtomic(ctx context.Context, dir, name string, write func(w io.Writer) error) error {
+	file, err := createAtomicFile(dir, name)
+	if err != nil {
+		return err
+	}
+	err = write(contextWriter{ctx: ctx, w: file})
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		file.abort()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	return file.commit()
+}
+
+// contextWriter fails every write once ctx is done
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// commandEncoder writes the internal or the clang layout one command at a time
+type commandEncoder struct {
+	array        *jsonArrayWriter
+	footer       string
+	clang        bool // Clang layout, see toClangCompileCommands
+	useArguments bool
+}
+
+// newCommandEncoder starts a database in the layout of format, CompdbFormatInternal or
+// CompdbFormatClang, on w
+func newCommandEncoder(w io.Writer, format CompdbFormat, useArguments bool) (*commandEncoder, error) {
+	if format == CompdbFormatClang {
+		array, err := openJSONArray(w, "", 0)
+		return &commandEncoder{array: array, clang: true, useArguments: useArguments}, err
+	}
+	array, err := openJSONArray(w, "{\n  \"commands\": ", 1)
+	return &commandEncoder{array: array, footer: "\n}"}, err
+}
+
+// add encodes info, as one clang entry per input file in the clang layout
+func (e *commandEncoder) add(info CompilerCommandInfo) error {
+	if !e.clang {
+		return e.array.Add(info)
+	}
+	for _, entry := range toClangCompileCommands(CommandDatabase{Commands: []CompilerCommandInfo{info}}, e.useArguments) {
+		if err := e.array.Add(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close ends the database
+func (e *commandEncoder) close() error {
+	return e.array.close(e.footer)
+}
+
+// encodeCommands writes commands in the layout of format, one command at a time
+func encodeCommands(w io.Writer, commands CommandDatabase, format CompdbFormat, useArguments bool) error {
+	encoder, err := newCommandEncoder(w, format, useArguments)
+	if err != nil {
+		return err
+	}
+	for _, info := range commands.Commands {
+		if err := encoder.add(info); err != nil {
+			return err
+		}
+	}
+	return encoder.close()
+}
+
+// encodeCommandDatabase writes commands like json.MarshalIndent of the CommandDatabase, one
+// command at a time
+func encodeCommandDatabase(w io.Writer, commands CommandDatabase) error {
+	return encodeCommands(w, commands, CompdbFormatInternal, false)
+}
+
+// encodeClangCompileCommands writes the clang layout of commands, converting one command at a time
+func encodeClangCompileCommands(w io.Writer, commands CommandDatabase, useArguments bool) error {
+	return encodeCommands(w, commands, CompdbFormatClang, useArguments)
+}
@@ -0,0 +1,145 @@
+package wrapper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteStreamAtomic(t *testing.T) {
+	dir := t.TempDir()
+	info := CompilerCommandInfo{Command: "clang -c a.c", CompilerType: "clang", InputFiles: []string{"a.c"}, Flags: []string{"-c"}}
+
+	for _, n := range []int{0, 1, 3} {
+		commands := CommandDatabase{Commands: []CompilerCommandInfo{}}
+		for i := 0; i < n; i++ {
+			commands.Commands = append(commands.Commands, info)
+		}
+
+		// The streamed database reads exactly like the marshalled one
+		err := writeStreamAtomic(context.Background(), dir, CompileCommandsFile, func(w io.Writer) error {
+			return encodeCommandDatabase(w, commands)
+		})
+		if err != nil {
+			t.Fatalf("Failed to write %d commands: %v", n, err)
+		}
+
+		got, err := os.ReadFile(filepath.Join(dir, CompileCommandsFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := json.MarshalIndent(commands, "", "  ")
+		if string(got) != string(want) {
+			t.Errorf("Streamed %d commands differ from json.MarshalIndent:\n%s\nwant:\n%s", n, got, want)
+		}
+	}
+
+	// A failing producer leaves the previous file in place
+	err := writeStreamAtomic(context.Background(), dir, CompileCommandsFile, func(w io.Writer) error {
+		return writeJSONArray(w, "", "", 0, func(array *jsonArrayWriter) error {
+			return errors.New("interrupted")
+		})
+	})
+	if err == nil {
+		t.Error("Expected the producer error")
+	}
+	if _, err := os.Stat(atomicTempFile(dir, CompileCommandsFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected the temporary file to be removed, got %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, CompileCommandsFile)); !strings.Contains(string(data), "clang -c a.c") {
+		t.Errorf("Expected the previous database to be kept, got %s", data)
+	}
+}
+
+func TestDecodeCompdbStream(t *testing.T) {
+	var files []string
+	collect := func(entry map[string]interface{}) error {
+		files = append(files, entry["file"].(string))
+		return nil
+	}
+
+	err := decodeCompdbStream(strings.NewReader(`[{"file":"a.c"}, {"file":"b.c"}]`), collect)
+	if err != nil || strings.Join(files, ",") != "a.c,b.c" {
+		t.Errorf("Expected a.c and b.c, got %v: %v", files, err)
+	}
+
+	if err := decodeCompdbStream(strings.NewReader(`{"file":"a.c"}`), collect); err == nil {
+		t.Error("Expected an error for a JSON object")
+	}
+	if err := decodeCompdbStream(strings.NewReader(`[{"file":"a.c"},`), collect); err == nil {
+		t.Error("Expected an error for truncated output")
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = decodeCompdbStream(strings.NewReader(`[{"file":"a.c"}, {"file":"b.c"}]`), func(map[string]interface{}) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("Expected decoding to stop after the first entry, got %d calls: %v", calls, err)
+	}
+}
+
+func TestStreamCompdb(t *testing.T) {
+	count := 0
+	countEntries := func(map[string]interface{}) error {
+		count++
+		return nil
+	}
+
+	// Large enough to fill the pipe while entries are decoded
+	script := `i=0; printf '['; while [ $i -lt 5000 ]; do [ $i -gt 0 ] && printf ','; printf '{"file":"f%d.c","command":"clang -c f%d.c"}' $i $i; i=$((i+1)); done; printf ']'`
+	if err := streamCompdb(exec.Command("sh", "-c", script), countEntries); err != nil || count != 5000 {
+		t.Errorf("Expected 5000 entries, got %d: %v", count, err)
+	}
+
+	// The exit status is reported rather than the empty output
+	err := streamCompdb(exec.Command("sh", "-c", "echo unknown target >&2; exit 1"), countEntries)
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Errorf("Expected the exit error, got %v", err)
+	}
+
+	// Output left after a decoding error is drained
+	err = streamCompdb(exec.Command("sh", "-c", `printf '[oops'; head -c 200000 /dev/zero`), countEntries)
+	if err == nil || !strings.Contains(err.Error(), "failed to parse JSON") {
+		t.Errorf("Expected a JSON error, got %v", err)
+	}
+}
+
+func TestGetCompilationDatabaseWhole(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("ANDROID_BUILD_TOP", dir)
+
+	// Emulates compdb: entries without a directory run in the source root
+	tool := filepath.Join(dir, "fake-ninja")
+	script := `#!/bin/sh
+[ "$4" = compdb ] || exit 1
+printf '[{"command":"clang -c a.c -o a.o","file":"a.c","output":"a.o"},'
+printf '{"command":"cp a b","file":"a","output":"b"}]'
+`
+	if err := os.WriteFile(tool, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	config := WrapperConfig{NinjaTool: tool}
+	commands, _, err := getCompilationDatabase(context.Background(), config, filepath.Join(dir, "build.ninja"), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(commands.Commands) != 1 || commands.Commands[0].OutputFile != "a.o" || commands.Commands[0].WorkingDir != dir {
+		t.Errorf("Expected the a.o command run in %s, got %+v", dir, commands.Commands)
+	}
+
+	config.NinjaTool = "false"
+	if _, _, err := getCompilationDatabase(context.Background(), config, filepath.Join(dir, "build.ninja"), nil); !errors.Is(err, ErrCompdbFailed) {
+		t.Errorf("Expected ErrCompdbFailed, got %v", err)
+	}
+}
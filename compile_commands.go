@@ -0,0 +1,173 @@
+package wrapper
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CompdbFormat selects which compilation database layouts are written
+type CompdbFormat int
+
+const (
+	// CompdbFormatInternal is the {"commands":[...]} layout consumed by proxy
+	CompdbFormatInternal CompdbFormat = 1 << iota
+	// CompdbFormatClang is the JSON Compilation Database layout read by clangd, clang-tidy and IDEs
+	CompdbFormatClang
+	// CompdbFormatJavaProjects is the per-module Java project description written to java_projects.json
+	CompdbFormatJavaProjects
+	// CompdbFormatRustProject is the rust-analyzer description written to rust-project.json
+	CompdbFormatRustProject
+	// CompdbFormatShards is the clang layout split per module or directory under CompdbShardDir
+	CompdbFormatShards
+)
+
+const (
+	// CompileCommandsFile is the file name used for every compilation database layout
+	CompileCommandsFile = "compile_commands.json"
+	// ClangCompileCommandsDir is the OutDir subdirectory holding the clang layout,
+	// suitable for clangd --compile-commands-dir
+	ClangCompileCommandsDir = "clangd"
+)
+
+// CompileCommand is one entry of a clang JSON Compilation Database
+// (https://clang.llvm.org/docs/JSONCompilationDatabase.html)
+type CompileCommand struct {
+	Directory string   `json:"directory"`
+	File      string   `json:"file"`
+	Arguments []string `json:"arguments,omitempty"`
+	Command   string   `json:"command,omitempty"`
+	Output    string   `json:"output,omitempty"`
+}
+
+// compileCommandEntries converts clang entries to the generic form read by parseCompdbEntry
+func compileCommandEntries(entries []CompileCommand) []map[string]interface{} {
+	result := make([]map[string]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		m := map[string]interface{}{
+			"directory": entry.Directory,
+			"file":      entry.File,
+			"command":   entry.Command,
+		}
+		if entry.Output != "" {
+			m["output"] = entry.Output
+		}
+		result = append(result, m)
+	}
+	return result
+}
+
+// Has reports whether all formats in other are selected
+func (f CompdbFormat) Has(other CompdbFormat) bool {
+	return f&other == other
+}
+
+// effectiveCompdbFormat returns the configured format, defaulting to the internal layout
+func effectiveCompdbFormat(config WrapperConfig) CompdbFormat {
+	if config.CompdbFormat == 0 {
+		return CompdbFormatInternal
+	}
+	return config.CompdbFormat
+}
+
+// clangCompilerTypes are the tool families clangd can index, see toClangCompileCommands
+var clangCompilerTypes = map[string]bool{
+	"clang": true, "clang++": true, "gcc": true, "g++": true, "bpf-clang": true,
+}
+
+// toClangCompileCommands converts the C-family commands of the internal database to clang
+// entries, one per input file. Java, Rust and generator commands have no place in a database
+// clangd reads.
+func toClangCompileCommands(commands CommandDatabase, useArguments bool) []CompileCommand {
+	entries := make([]CompileCommand, 0, len(commands.Commands))
+
+	for _, info := range commands.Commands {
+		if !clangCompilerTypes[info.CompilerType] {
+			continue
+		}
+		args := clangArguments(info)
+		if len(args) == 0 {
+			continue
+		}
+
+		for _, file := range info.InputFiles {
+			entry := CompileCommand{
+				Directory: info.WorkingDir,
+				File:      file,
+				Output:    info.OutputFile,
+			}
+			if useArguments {
+				entry.Arguments = args
+			} else {
+				entry.Command = joinCommandLine(args)
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// clangArguments returns the compiler argv of an entry without environment assignments and launchers
+func clangArguments(info CompilerCommandInfo) []string {
+	if len(info.Arguments) > 0 {
+		return info.Arguments
+	}
+	_, _, args := unwrapCommand(compilerInvocation(info.Command))
+	return args
+}
+
+// joinCommandLine joins arguments into a shell command, quoting where required
+func joinCommandLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellQuote quotes a single argument for a POSIX shell if it contains special characters
+func shellQuote(arg string) string {
+	if arg == "" {
+		return "''"
+	}
+	if !strings.ContainsAny(arg, " \t\n\"'\\$`&|;<>()*?[]#~{}!") {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// writeClangCompileCommands writes the clang layout to outputDir/compile_commands.json
+func writeClangCompileCommands(ctx context.Context, outputDir string, commands CommandDatabase, useArguments bool) error {
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %v", err)
+	}
+
+	return writeStreamAtomic(ctx, outputDir, CompileCommandsFile, func(w io.Writer) error {
+		return encodeClangCompileCommands(w, commands, useArguments)
+	})
+}
+
+// atomicTempFile is the temporary file name is written to before it is renamed
+func atomicTempFile(dir, name string) string {
+	return filepath.Join(dir, "."+strings.TrimSuffix(name, filepath.Ext(name))+".tmp")
+}
+
+// writeFileAtomic writes data to a temporary file in dir and renames it to name
+func writeFileAtomic(dir, name string, data []byte) error {
+	tempFile := atomicTempFile(dir, name)
+	if err := os.WriteFile(tempFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write temporary file: %v", err)
+	}
+
+	finalPath := filepath.Join(dir, name)
+	if err := os.Rename(tempFile, finalPath); err != nil {
+		_ = os.Remove(tempFile)
+		return fmt.Errorf("failed to rename file: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package wrapper
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestToClangCompileCommands(t *testing.T) {
+	commands := CommandDatabase{
+		Commands: []CompilerCommandInfo{
+			{
+				Command:      "PWD=/proc/self/cwd clang -Iinclude -DNAME=\"a b\" -c foo.c bar.c -o out.o",
+				CompilerType: "clang",
+				InputFiles:   []string{"foo.c", "bar.c"},
+				OutputFile:   "out.o",
+				WorkingDir:   "/src",
+			},
+			{
+				Command:      "",
+				CompilerType: "clang",
+				InputFiles:   []string{"skipped.c"},
+			},
+			{
+				Command:      "javac -d out/classes src/A.java",
+				CompilerType: "javac",
+				InputFiles:   []string{"src/A.java"},
+			},
+			{
+				Command:      "rustc --crate-type=lib src/lib.rs -o out/lib.rlib",
+				CompilerType: "rustc",
+				InputFiles:   []string{"src/lib.rs"},
+			},
+		},
+	}
+
+	expectedArgs := []string{"clang", "-Iinclude", "-DNAME=a b", "-c", "foo.c", "bar.c", "-o", "out.o"}
+
+	entries := toClangCompileCommands(commands, true)
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(entries))
+	}
+
+	for i, file := range []string{"foo.c", "bar.c"} {
+		entry := entries[i]
+		if entry.File != file {
+			t.Errorf("Expected file %q, got %q", file, entry.File)
+		}
+		if entry.Directory != "/src" || entry.Output != "out.o" {
+			t.Errorf("Unexpected directory/output: %q %q", entry.Directory, entry.Output)
+		}
+		if !reflect.DeepEqual(entry.Arguments, expectedArgs) {
+			t.Errorf("Expected arguments %v, got %v", expectedArgs, entry.Arguments)
+		}
+		if entry.Command != "" {
+			t.Errorf("Expected empty command in arguments mode, got %q", entry.Command)
+		}
+	}
+
+	entries = toClangCompileCommands(commands, false)
+	expectedCommand := "clang -Iinclude '-DNAME=a b' -c foo.c bar.c -o out.o"
+	if entries[0].Command != expectedCommand {
+		t.Errorf("Expected command %q, got %q", expectedCommand, entries[0].Command)
+	}
+	if entries[0].Arguments != nil {
+		t.Errorf("Expected no arguments in command mode, got %v", entries[0].Arguments)
+	}
+}
+
+func TestWriteClangCompileCommands(t *testing.T) {
+	tempDir := t.TempDir()
+
+	commands := CommandDatabase{
+		Commands: []CompilerCommandInfo{
+			{
+				Command:      "clang -c foo.c -o foo.o",
+				CompilerType: "clang",
+				InputFiles:   []string{"foo.c"},
+				OutputFile:   "foo.o",
+				WorkingDir:   "/src",
+			},
+		},
+	}
+
+	if err := writeClangCompileCommands(context.Background(), tempDir, commands, false); err != nil {
+		t.Fatalf("writeClangCompileCommands failed: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(tempDir, CompileCommandsFile))
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+
+	var parsed []map[string]interface{}
+	if err := json.Unmarshal(content, &parsed); err != nil {
+		t.Fatalf("Output is not a top-level JSON array: %v", err)
+	}
+
+	if len(parsed) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(parsed))
+	}
+
+	for _, key := range []string{"directory", "file", "command", "output"} {
+		if _, ok := parsed[0][key]; !ok {
+			t.Errorf("Expected key %q in entry %v", key, parsed[0])
+		}
+	}
+	if _, ok := parsed[0]["arguments"]; ok {
+		t.Errorf("Did not expect arguments key in command mode")
+	}
+}
+
+func TestCompdbFormatHas(t *testing.T) {
+	both := CompdbFormatInternal | CompdbFormatClang
+	if !both.Has(CompdbFormatClang) || !both.Has(CompdbFormatInternal) {
+		t.Errorf("Expected combined format to include both layouts")
+	}
+	if CompdbFormatClang.Has(CompdbFormatInternal) {
+		t.Errorf("Clang format must not include the internal layout")
+	}
+	if got := effectiveCompdbFormat(WrapperConfig{}); got != CompdbFormatInternal {
+		t.Errorf("Expected default format internal, got %v", got)
+	}
+}
@@ -0,0 +1,42 @@
+package wrapper
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNinjaNotFound is returned when the distninja tool is not on PATH
+	ErrNinjaNotFound = errors.New("distninja tool not found")
+	// ErrManifestFailed is returned when the ninja manifest can't be prepared or parsed
+	ErrManifestFailed = errors.New("failed to prepare ninja manifest")
+	// ErrNoTargetsMatched is returned when none of the requested modules resolve to ninja targets
+	ErrNoTargetsMatched = errors.New("no ninja targets matched the requested modules")
+	// ErrUnknownTarget is reported for targets the ninja manifest does not define
+	ErrUnknownTarget = errors.New("unknown ninja target")
+	// ErrCompdbFailed is returned when compile commands can't be extracted or decoded
+	ErrCompdbFailed = errors.New("failed to extract compile commands")
+	// ErrInterrupted is returned when cancellation or a phase timeout cut extraction short
+	ErrInterrupted = errors.New("compile command extraction interrupted")
+	// ErrWriteFailed is returned when a compilation database can't be written
+	ErrWriteFailed = errors.New("failed to write compilation database")
+	// ErrProxyFailed is returned when the proxy command fails on the written database
+	ErrProxyFailed = errors.New("proxy failed")
+	// ErrSinkSkipped is reported by a sink that could not run, e.g. because its executable is
+	// not installed. The run records it in Result.Warnings instead of failing.
+	ErrSinkSkipped = errors.New("sink skipped")
+)
+
+// TargetError reports a ninja target whose compile commands could not be extracted
+type TargetError struct {
+	Target string
+	Err    error
+}
+
+func (e *TargetError) Error() string {
+	return fmt.Sprintf("target %s: %v", e.Target, e.Err)
+}
+
+func (e *TargetError) Unwrap() error {
+	return e.Err
+}
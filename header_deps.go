@@ -0,0 +1,220 @@
+package wrapper
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// parseDepfile returns the prerequisites of every rule of a Makefile style depfile, as written
+// by clang and gcc -MD. Escaped spaces, \# and $$ are unescaped. Targets, including the phony
+// header targets -MP adds, are skipped.
+func parseDepfile(data []byte) []string {
+	var deps []string
+	seen := map[string]bool{}
+	var token strings.Builder
+	haveToken, inPrereqs := false, false
+
+	flush := func() {
+		if !haveToken {
+			return
+		}
+		if dep := token.String(); inPrereqs && !seen[dep] {
+			seen[dep] = true
+			deps = append(deps, dep)
+		}
+		token.Reset()
+		haveToken = false
+	}
+	separator := func(i int) bool {
+		return i >= len(data) || data[i] == ' ' || data[i] == '\t' || data[i] == '\n' || data[i] == '\r'
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '\\' && i+1 < len(data) && data[i+1] == '\n':
+			// Line continuation
+			flush()
+			i++
+		case c == '\\' && i+2 < len(data) && data[i+1] == '\r' && data[i+2] == '\n':
+			flush()
+			i += 2
+		case c == '\\' && i+1 < len(data) && (data[i+1] == ' ' || data[i+1] == '#'):
+			token.WriteByte(data[i+1])
+			haveToken = true
+			i++
+		case c == '$' && i+1 < len(data) && data[i+1] == '$':
+			token.WriteByte('$')
+			haveToken = true
+			i++
+		case c == ':' && !inPrereqs && separator(i+1):
+			flush()
+			inPrereqs = true
+		case c == ' ' || c == '\t':
+			flush()
+		case c == '\n' || c == '\r':
+			// The next rule starts with its targets
+			flush()
+			inPrereqs = false
+		default:
+			token.WriteByte(c)
+			haveToken = true
+		}
+	}
+	flush()
+
+	return deps
+}
+
+// rebasePath resolves path against from and expresses it relative to to when it lies below
+func rebasePath(path, from, to string) string {
+	if !filepath.IsAbs(path) {
+		if from == to {
+			return filepath.Clean(path)
+		}
+		path = filepath.Join(from, path)
+	}
+	path = filepath.Clean(path)
+	if to != "" && filepath.IsAbs(path) {
+		if rel, err := filepath.Rel(to, path); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return rel
+		}
+	}
+	return path
+}
+
+// commandWorkingDir returns the absolute working directory of a command
+func commandWorkingDir(root string, info CompilerCommandInfo) string {
+	if info.WorkingDir == "" {
+		return root
+	}
+	if !filepath.IsAbs(info.WorkingDir) && root != "" {
+		return filepath.Join(root, info.WorkingDir)
+	}
+	return filepath.Clean(info.WorkingDir)
+}
+
+// headerAttacher sets the Headers of commands one at a time, see attachHeaders
+type headerAttacher struct {
+	root     string
+	depsLog  map[string][]string
+	attached int
+	seen     int
+}
+
+// newHeaderAttacher reads the ninja dependency log in OutDir, problems reading it are warnings
+func newHeaderAttacher(config WrapperConfig, result *Result) *headerAttacher {
+	depsLog, err := readNinjaDeps(filepath.Join(config.OutDir, NinjaDepsFile))
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Warning: Failed to read ninja dependency log, using depfiles only: %v\n", err)
+		result.Warnings = append(result.Warnings, err)
+	}
+	return &headerAttacher{root: os.Getenv("ANDROID_BUILD_TOP"), depsLog: depsLog}
+}
+
+// attach sets the Headers of info from the dependency log, or from its depfile when the log
+// doesn't know it
+func (a *headerAttacher) attach(info *CompilerCommandInfo) {
+	a.seen++
+	workingDir := commandWorkingDir(a.root, *info)
+
+	// Ninja records paths relative to the directory it runs in, the source root
+	var deps []string
+	base := a.root
+	if info.OutputFile != "" {
+		deps = a.depsLog[canonicalizeNinjaPath(rebasePath(info.OutputFile, workingDir, a.root))]
+	}
+	if deps == nil && info.DepFile != "" {
+		depFile := info.DepFile
+		if !filepath.IsAbs(depFile) {
+			depFile = filepath.Join(workingDir, depFile)
+		}
+		if data, err := os.ReadFile(depFile); err == nil {
+			deps, base = parseDepfile(data), workingDir
+		}
+	}
+	if deps == nil {
+		return
+	}
+
+	inputs := map[string]bool{}
+	for _, input := range info.InputFiles {
+		inputs[rebasePath(input, workingDir, workingDir)] = true
+	}
+	seen := map[string]bool{}
+	headers := []string{}
+	for _, dep := range deps {
+		header := rebasePath(dep, base, workingDir)
+		if inputs[header] || seen[header] {
+			continue
+		}
+		seen[header] = true
+		headers = append(headers, header)
+	}
+	info.Headers = headers
+	a.attached++
+}
+
+// report prints how many commands got their headers
+func (a *headerAttacher) report() {
+	fmt.Printf("Attached header dependencies to %d of %d commands\n", a.attached, a.seen)
+}
+
+// attachHeaders sets the Headers of every command from the ninja dependency log in OutDir, or
+// from the depfile of commands the log doesn't know, see WrapperConfig.AttachHeaders
+func attachHeaders(config WrapperConfig, commands *CommandDatabase, result *Result) {
+	a := newHeaderAttacher(config, result)
+	for i := range commands.Commands {
+		a.attach(&commands.Commands[i])
+	}
+	a.report()
+}
+
+// HeaderIndex finds the translation units that include a header, from the Headers of the
+// commands of a database
+type HeaderIndex struct {
+	root     string
+	commands []CompilerCommandInfo
+	units    map[string][]int // Header relative to the source root, indexes into commands
+}
+
+// NewHeaderIndex indexes the headers of db. Paths are resolved against $ANDROID_BUILD_TOP.
+func NewHeaderIndex(db CommandDatabase) *HeaderIndex {
+	index := &HeaderIndex{
+		root:     os.Getenv("ANDROID_BUILD_TOP"),
+		commands: db.Commands,
+		units:    map[string][]int{},
+	}
+	for i, info := range db.Commands {
+		workingDir := commandWorkingDir(index.root, info)
+		for _, header := range info.Headers {
+			key := rebasePath(header, workingDir, index.root)
+			index.units[key] = append(index.units[key], i)
+		}
+	}
+	return index
+}
+
+// Headers returns every indexed header relative to the source root, sorted
+func (x *HeaderIndex) Headers() []string {
+	headers := make([]string, 0, len(x.units))
+	for header := range x.units {
+		headers = append(headers, header)
+	}
+	sort.Strings(headers)
+	return headers
+}
+
+// TranslationUnits returns the commands whose translation unit includes header, given relative
+// to the source root or absolute
+func (x *HeaderIndex) TranslationUnits(header string) []CompilerCommandInfo {
+	indexes := x.units[rebasePath(header, x.root, x.root)]
+	units := make([]CompilerCommandInfo, len(indexes))
+	for i, index := range indexes {
+		units[i] = x.commands[index]
+	}
+	return units
+}
@@ -0,0 +1,84 @@
+package wrapper
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseDepfile(t *testing.T) {
+	depfile := "out/obj/main.o: hello/main.c hello/include/a.h \\\n" +
+		"  hello/include/with\\ space.h \\\r\n" +
+		"  hello/include/a.h out/gen/$$var.h\n" +
+		"\n" +
+		"hello/include/a.h:\n" +
+		"out/gen/$$var.h:\n"
+
+	want := []string{"hello/main.c", "hello/include/a.h", "hello/include/with space.h", "out/gen/$var.h"}
+	if got := parseDepfile([]byte(depfile)); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	if got := parseDepfile([]byte("main.o:\n")); len(got) != 0 {
+		t.Errorf("Expected no prerequisites, got %q", got)
+	}
+}
+
+func TestAttachHeaders(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("ANDROID_BUILD_TOP", root)
+
+	w := newNinjaDepsWriter(4)
+	w.deps("out/hello/main.o", "hello/main.c", "hello/include/a.h", "out/gen/b.h")
+	if err := os.MkdirAll(filepath.Join(root, "out"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "out", NinjaDepsFile), w.data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Only the depfile knows about world, which compiles in its own directory
+	if err := os.MkdirAll(filepath.Join(root, "world"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	depfile := "main.o: main.c include/w.h ../hello/include/a.h\n"
+	if err := os.WriteFile(filepath.Join(root, "world", "main.o.d"), []byte(depfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	commands := CommandDatabase{Commands: []CompilerCommandInfo{
+		{InputFiles: []string{"hello/main.c"}, OutputFile: "out/hello/main.o", WorkingDir: root},
+		{InputFiles: []string{"main.c"}, OutputFile: "main.o", DepFile: "main.o.d", WorkingDir: filepath.Join(root, "world")},
+		{InputFiles: []string{"never/built.c"}, OutputFile: "out/never/built.o", DepFile: "out/never/built.o.d"},
+	}}
+	result := &Result{}
+	attachHeaders(WrapperConfig{OutDir: filepath.Join(root, "out")}, &commands, result)
+
+	want := [][]string{
+		{"hello/include/a.h", "out/gen/b.h"},
+		{"include/w.h", "../hello/include/a.h"},
+		nil,
+	}
+	for i, info := range commands.Commands {
+		if !reflect.DeepEqual(info.Headers, want[i]) {
+			t.Errorf("Expected headers %q for %s, got %q", want[i], info.OutputFile, info.Headers)
+		}
+	}
+	if len(result.Warnings) != 0 {
+		t.Errorf("Unexpected warnings %v", result.Warnings)
+	}
+
+	// Both translation units include a.h, however their commands spell it
+	index := NewHeaderIndex(commands)
+	units := index.TranslationUnits(filepath.Join(root, "hello/include/a.h"))
+	if len(units) != 2 || units[0].OutputFile != "out/hello/main.o" || units[1].OutputFile != "main.o" {
+		t.Errorf("Expected hello and world to include a.h, got %v", units)
+	}
+	if units := index.TranslationUnits("world/include/w.h"); len(units) != 1 {
+		t.Errorf("Expected world to include w.h, got %v", units)
+	}
+	wantHeaders := []string{"hello/include/a.h", "out/gen/b.h", "world/include/w.h"}
+	if got := index.Headers(); !reflect.DeepEqual(got, wantHeaders) {
+		t.Errorf("Expected headers %q, got %q", wantHeaders, got)
+	}
+}
@@ -0,0 +1,331 @@
+package wrapper
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// JavaProjectsFile is the OutDir file written for CompdbFormatJavaProjects
+const JavaProjectsFile = "java_projects.json"
+
+// JavaCommand is the structured view of a javac, kotlinc or turbine invocation
+type JavaCommand struct {
+	Classpath          []string `json:"classpath,omitempty"`
+	Bootclasspath      []string `json:"bootclasspath,omitempty"`
+	System             string   `json:"system,omitempty"` // --system JDK image
+	Sourcepath         []string `json:"sourcepath,omitempty"`
+	ProcessorPath      []string `json:"processorPath,omitempty"`
+	Processors         []string `json:"processors,omitempty"`
+	ProcessorOptions   []string `json:"processorOptions,omitempty"` // -Akey=value
+	Source             string   `json:"source,omitempty"`
+	Target             string   `json:"target,omitempty"`
+	Release            string   `json:"release,omitempty"`
+	OutputDir          string   `json:"outputDir,omitempty"`          // -d class output
+	GeneratedSourceDir string   `json:"generatedSourceDir,omitempty"` // -s annotation processor output
+	SourceFiles        []string `json:"sourceFiles,omitempty"`
+	Srcjars            []string `json:"srcjars,omitempty"`
+}
+
+// JavaProject describes one module for Java IDEs and language servers
+type JavaProject struct {
+	Module        string   `json:"module"`
+	SourceRoots   []string `json:"sourceRoots,omitempty"`
+	SourceFiles   []string `json:"sourceFiles,omitempty"`
+	Srcjars       []string `json:"srcjars,omitempty"`
+	Classpath     []string `json:"classpath,omitempty"`
+	Bootclasspath []string `json:"bootclasspath,omitempty"`
+	System        string   `json:"system,omitempty"`
+	ProcessorPath []string `json:"processorPath,omitempty"`
+	Processors    []string `json:"processors,omitempty"`
+	LanguageLevel string   `json:"languageLevel,omitempty"` // --release, else -source
+	TargetLevel   string   `json:"targetLevel,omitempty"`
+	OutputDirs    []string `json:"outputDirs,omitempty"`
+	WorkingDir    string   `json:"workingDir,omitempty"`
+}
+
+// javaOptionSpec is an entry of the javac/kotlinc/turbine option table
+type javaOptionSpec struct {
+	names []string
+	store func(java *JavaCommand, value string) // nil keeps the option and its value in Flags
+	multi bool                                  // Turbine style: values continue until the next --option
+}
+
+func appendPaths(list *[]string, value string) {
+	for _, entry := range strings.Split(value, string(os.PathListSeparator)) {
+		if entry != "" {
+			*list = append(*list, entry)
+		}
+	}
+}
+
+var javaOptionTable = []javaOptionSpec{
+	{names: []string{"-classpath", "-cp", "--class-path"}, store: func(j *JavaCommand, v string) { appendPaths(&j.Classpath, v) }},
+	{names: []string{"-bootclasspath", "--boot-class-path"}, store: func(j *JavaCommand, v string) { appendPaths(&j.Bootclasspath, v) }},
+	{names: []string{"--system"}, store: func(j *JavaCommand, v string) { j.System = v }},
+	{names: []string{"-sourcepath", "--source-path"}, store: func(j *JavaCommand, v string) { appendPaths(&j.Sourcepath, v) }},
+	{names: []string{"-processorpath", "--processor-path"}, store: func(j *JavaCommand, v string) { appendPaths(&j.ProcessorPath, v) }},
+	{names: []string{"-processor"}, store: func(j *JavaCommand, v string) {
+		for _, processor := range strings.Split(v, ",") {
+			if processor != "" {
+				j.Processors = append(j.Processors, processor)
+			}
+		}
+	}},
+	{names: []string{"-source", "--source"}, store: func(j *JavaCommand, v string) { j.Source = v }},
+	{names: []string{"-target", "--target", "-jvm-target"}, store: func(j *JavaCommand, v string) { j.Target = v }},
+	{names: []string{"--release"}, store: func(j *JavaCommand, v string) { j.Release = v }},
+	{names: []string{"-d", "--output"}, store: func(j *JavaCommand, v string) { j.OutputDir = v }},
+	{names: []string{"-s"}, store: func(j *JavaCommand, v string) { j.GeneratedSourceDir = v }},
+	{names: []string{"-encoding", "-h", "-Xmaxerrs", "-Xmaxwarns", "--patch-module", "--add-modules", "--add-exports",
+		"--module-path", "-p", "-module-name", "-jdk-home", "-kotlin-home", "-api-version", "-language-version", "-P"}},
+
+	// Turbine takes several values per option
+	{names: []string{"--classpath"}, multi: true, store: func(j *JavaCommand, v string) { j.Classpath = append(j.Classpath, v) }},
+	{names: []string{"--bootclasspath"}, multi: true, store: func(j *JavaCommand, v string) { j.Bootclasspath = append(j.Bootclasspath, v) }},
+	{names: []string{"--processorpath"}, multi: true, store: func(j *JavaCommand, v string) { j.ProcessorPath = append(j.ProcessorPath, v) }},
+	{names: []string{"--processors"}, multi: true, store: func(j *JavaCommand, v string) { j.Processors = append(j.Processors, v) }},
+	{names: []string{"--sources"}, multi: true, store: func(j *JavaCommand, v string) { j.SourceFiles = append(j.SourceFiles, v) }},
+	{names: []string{"--source_jars"}, multi: true, store: func(j *JavaCommand, v string) { j.Srcjars = append(j.Srcjars, v) }},
+}
+
+var javaOptionsByName = func() map[string]*javaOptionSpec {
+	byName := map[string]*javaOptionSpec{}
+	for i := range javaOptionTable {
+		for _, name := range javaOptionTable[i].names {
+			byName[name] = &javaOptionTable[i]
+		}
+	}
+	return byName
+}()
+
+// javaToolArgs strips soong_javac_wrapper and java [options] -jar tool.jar prefixes
+func javaToolArgs(args []string) []string {
+	for len(args) > 0 {
+		switch programName(args) {
+		case "soong_javac_wrapper":
+			args = args[1:]
+			continue
+		case "java":
+			for i := 1; i < len(args); i++ {
+				if args[i] == "-jar" && i+1 < len(args) {
+					return args[i+1:]
+				}
+			}
+		}
+		return args
+	}
+	return args
+}
+
+// parseJavaArgs parses a javac, kotlinc or turbine invocation into info.Java
+func parseJavaArgs(info *CompilerCommandInfo, args []string) {
+	args = javaToolArgs(args)
+	if len(args) == 0 {
+		return
+	}
+
+	java := &JavaCommand{}
+	parseJavaOptions(info, java, args[1:])
+
+	for _, input := range info.InputFiles {
+		if filepath.Ext(input) == ".srcjar" && !containsString(java.Srcjars, input) {
+			java.Srcjars = append(java.Srcjars, input)
+		}
+	}
+	for _, input := range append(append([]string{}, java.SourceFiles...), java.Srcjars...) {
+		if !containsString(info.InputFiles, input) {
+			info.InputFiles = append(info.InputFiles, input)
+		}
+	}
+
+	info.Java = java
+}
+
+// parseJavaOptions parses tool arguments (without the program) into java, keeping
+// options not modelled by the table in info.Flags
+func parseJavaOptions(info *CompilerCommandInfo, java *JavaCommand, args []string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if !strings.HasPrefix(arg, "-") {
+			addJavaInput(java, arg)
+			continue
+		}
+
+		if arg == "--javacopts" {
+			// Turbine forwards javac options terminated by --
+			end := i + 1
+			for end < len(args) && args[end] != "--" {
+				end++
+			}
+			parseJavaOptions(info, java, args[i+1:end])
+			i = end
+			continue
+		}
+
+		name, value, hasValue := arg, "", false
+		if strings.HasPrefix(arg, "--") {
+			if eq := strings.IndexByte(arg, '='); eq > 0 {
+				name, value, hasValue = arg[:eq], arg[eq+1:], true
+			}
+		}
+
+		spec := javaOptionsByName[name]
+		switch {
+		case strings.HasPrefix(arg, "-A") && len(arg) > 2:
+			java.ProcessorOptions = append(java.ProcessorOptions, arg[2:])
+		case spec == nil:
+			info.Flags = append(info.Flags, arg)
+		case spec.multi:
+			for i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+				i++
+				spec.store(java, args[i])
+			}
+		case !hasValue && i+1 >= len(args):
+			// Missing value, keep the dangling option as a flag
+			info.Flags = append(info.Flags, arg)
+		case spec.store == nil && hasValue:
+			info.Flags = append(info.Flags, arg)
+		case spec.store == nil:
+			info.Flags = append(info.Flags, arg, args[i+1])
+			i++
+		case hasValue:
+			spec.store(java, value)
+		default:
+			i++
+			spec.store(java, args[i])
+		}
+	}
+}
+
+func addJavaInput(java *JavaCommand, arg string) {
+	switch filepath.Ext(arg) {
+	case ".java", ".kt":
+		java.SourceFiles = append(java.SourceFiles, arg)
+	case ".srcjar":
+		java.Srcjars = append(java.Srcjars, arg)
+	}
+}
+
+var javaPackagePattern = regexp.MustCompile(`^\s*package\s+([\w.]+)\s*;?`)
+
+// inferSourceRoot returns the directory a source file's package hierarchy starts in,
+// falling back to the file's directory when the package declaration can't be matched
+func inferSourceRoot(file, workingDir string) string {
+	dir := filepath.Dir(file)
+
+	path := file
+	if !filepath.IsAbs(path) && workingDir != "" {
+		path = filepath.Join(workingDir, path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return dir
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	scanner := bufio.NewScanner(f)
+	for lines := 0; scanner.Scan() && lines < 200; lines++ {
+		matches := javaPackagePattern.FindStringSubmatch(scanner.Text())
+		if matches == nil {
+			continue
+		}
+		packageDir := filepath.FromSlash(strings.ReplaceAll(matches[1], ".", "/"))
+		if dir == packageDir {
+			return "."
+		}
+		if strings.HasSuffix(dir, string(filepath.Separator)+packageDir) {
+			return strings.TrimSuffix(dir, string(filepath.Separator)+packageDir)
+		}
+		return dir
+	}
+
+	return dir
+}
+
+// buildJavaProjects groups Java commands by module into project descriptions
+func buildJavaProjects(commands CommandDatabase) []JavaProject {
+	projects := map[string]*JavaProject{}
+	var order []string
+
+	addUnique := func(list *[]string, values ...string) {
+		for _, value := range values {
+			if value != "" && !containsString(*list, value) {
+				*list = append(*list, value)
+			}
+		}
+	}
+
+	for _, info := range commands.Commands {
+		if info.Java == nil {
+			continue
+		}
+
+		module := info.Module
+		if module == "" {
+			module = info.OutputFile
+		}
+		project, ok := projects[module]
+		if !ok {
+			project = &JavaProject{Module: module, WorkingDir: info.WorkingDir}
+			projects[module] = project
+			order = append(order, module)
+		}
+
+		java := info.Java
+		for _, source := range java.SourceFiles {
+			addUnique(&project.SourceRoots, inferSourceRoot(source, info.WorkingDir))
+		}
+		addUnique(&project.SourceRoots, java.Sourcepath...)
+		addUnique(&project.SourceRoots, java.GeneratedSourceDir)
+		addUnique(&project.SourceFiles, java.SourceFiles...)
+		addUnique(&project.Srcjars, java.Srcjars...)
+		addUnique(&project.Classpath, java.Classpath...)
+		addUnique(&project.Bootclasspath, java.Bootclasspath...)
+		addUnique(&project.ProcessorPath, java.ProcessorPath...)
+		addUnique(&project.Processors, java.Processors...)
+		addUnique(&project.OutputDirs, java.OutputDir)
+
+		if project.System == "" {
+			project.System = java.System
+		}
+		if project.LanguageLevel == "" {
+			project.LanguageLevel = java.Release
+			if project.LanguageLevel == "" {
+				project.LanguageLevel = java.Source
+			}
+		}
+		if project.TargetLevel == "" {
+			project.TargetLevel = java.Target
+		}
+	}
+
+	sort.Strings(order)
+	result := make([]JavaProject, 0, len(order))
+	for _, module := range order {
+		result = append(result, *projects[module])
+	}
+	return result
+}
+
+// writeJavaProjects writes per-module Java project descriptions to outputDir/java_projects.json
+func writeJavaProjects(outputDir string, commands CommandDatabase) error {
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %v", err)
+	}
+
+	jsonData, err := json.MarshalIndent(buildJavaProjects(commands), "", "  ")
+	if err != nil {
+		return fmt.Errorf("JSON encoding failed: %v", err)
+	}
+
+	return writeFileAtomic(outputDir, JavaProjectsFile, jsonData)
+}
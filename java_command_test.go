@@ -0,0 +1,147 @@
+package wrapper
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseJavaArgs(t *testing.T) {
+	args := splitCommandLine("soong_javac_wrapper prebuilts/jdk/bin/javac -J-Xmx2048M -encoding UTF-8 -g " +
+		"-processorpath out/dagger.jar:out/auto.jar -processor dagger.Processor,auto.Processor -Adagger.fastInit=enabled " +
+		"-bootclasspath out/core.jar --system=out/system -classpath out/a.jar:out/b.jar -sourcepath frameworks/src " +
+		"-source 1.8 -target 1.8 -d out/classes -s out/anno src/com/example/Foo.java gen/Bar.srcjar")
+
+	info := CompilerCommandInfo{InputFiles: []string{"src/com/example/Foo.java", "out/srcjars/R.srcjar"}}
+	parseJavaArgs(&info, args)
+
+	if info.Java == nil {
+		t.Fatal("Expected a Java view")
+	}
+	java := info.Java
+
+	checks := []struct {
+		name     string
+		got      interface{}
+		expected interface{}
+	}{
+		{"Classpath", java.Classpath, []string{"out/a.jar", "out/b.jar"}},
+		{"Bootclasspath", java.Bootclasspath, []string{"out/core.jar"}},
+		{"System", java.System, "out/system"},
+		{"Sourcepath", java.Sourcepath, []string{"frameworks/src"}},
+		{"ProcessorPath", java.ProcessorPath, []string{"out/dagger.jar", "out/auto.jar"}},
+		{"Processors", java.Processors, []string{"dagger.Processor", "auto.Processor"}},
+		{"ProcessorOptions", java.ProcessorOptions, []string{"dagger.fastInit=enabled"}},
+		{"Source", java.Source, "1.8"},
+		{"Target", java.Target, "1.8"},
+		{"OutputDir", java.OutputDir, "out/classes"},
+		{"GeneratedSourceDir", java.GeneratedSourceDir, "out/anno"},
+		{"SourceFiles", java.SourceFiles, []string{"src/com/example/Foo.java"}},
+		{"Srcjars", java.Srcjars, []string{"gen/Bar.srcjar", "out/srcjars/R.srcjar"}},
+		{"InputFiles", info.InputFiles, []string{"src/com/example/Foo.java", "out/srcjars/R.srcjar", "gen/Bar.srcjar"}},
+		{"Flags", info.Flags, []string{"-J-Xmx2048M", "-encoding", "UTF-8", "-g"}},
+	}
+
+	for _, check := range checks {
+		if !reflect.DeepEqual(check.got, check.expected) {
+			t.Errorf("%s: expected %q, got %q", check.name, check.expected, check.got)
+		}
+	}
+}
+
+func TestParseJavaArgsTurbineAndKotlin(t *testing.T) {
+	var turbine CompilerCommandInfo
+	parseJavaArgs(&turbine, splitCommandLine("java -Xmx1g -jar out/turbine.jar --output out/header.jar "+
+		"--sources a/A.java b/B.java --source_jars gen/C.srcjar --classpath out/x.jar out/y.jar "+
+		"--bootclasspath out/core.jar --javacopts -source 17 -target 17 -- --processors p.Q"))
+
+	if got, expected := turbine.Java.Classpath, []string{"out/x.jar", "out/y.jar"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected classpath %q, got %q", expected, got)
+	}
+	if got, expected := turbine.Java.SourceFiles, []string{"a/A.java", "b/B.java"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected sources %q, got %q", expected, got)
+	}
+	if turbine.Java.Source != "17" || turbine.Java.Target != "17" {
+		t.Errorf("Expected --javacopts to set source/target 17, got %q/%q", turbine.Java.Source, turbine.Java.Target)
+	}
+	if got, expected := turbine.Java.Processors, []string{"p.Q"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected processors %q, got %q", expected, got)
+	}
+	if turbine.Java.OutputDir != "out/header.jar" {
+		t.Errorf("Expected output out/header.jar, got %q", turbine.Java.OutputDir)
+	}
+
+	var kotlin CompilerCommandInfo
+	parseJavaArgs(&kotlin, splitCommandLine("kotlinc -no-jdk -jvm-target 1.8 -classpath out/a.jar -module-name foo "+
+		"-d out/kotlin src/Foo.kt src/Bar.java"))
+
+	if kotlin.Java.Target != "1.8" {
+		t.Errorf("Expected -jvm-target 1.8, got %q", kotlin.Java.Target)
+	}
+	if got, expected := kotlin.Java.SourceFiles, []string{"src/Foo.kt", "src/Bar.java"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected sources %q, got %q", expected, got)
+	}
+	if got, expected := kotlin.Flags, []string{"-no-jdk", "-module-name", "foo"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected flags %q, got %q", expected, got)
+	}
+}
+
+func TestBuildJavaProjects(t *testing.T) {
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "frameworks", "base", "java", "com", "example")
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sourceDir, "Foo.java"), []byte("// header\npackage com.example;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	commands := CommandDatabase{Commands: []CompilerCommandInfo{
+		{
+			Module:     "framework",
+			WorkingDir: tmpDir,
+			Java: &JavaCommand{
+				SourceFiles: []string{"frameworks/base/java/com/example/Foo.java"},
+				Classpath:   []string{"out/a.jar"},
+				Release:     "17",
+				OutputDir:   "out/classes",
+			},
+		},
+		{
+			Module:     "framework",
+			WorkingDir: tmpDir,
+			Java:       &JavaCommand{Classpath: []string{"out/a.jar", "out/b.jar"}, Srcjars: []string{"gen/R.srcjar"}},
+		},
+		{Module: "libc", Command: "clang -c a.c"},
+	}}
+
+	projects := buildJavaProjects(commands)
+	if len(projects) != 1 {
+		t.Fatalf("Expected 1 project, got %d", len(projects))
+	}
+
+	project := projects[0]
+	if project.Module != "framework" {
+		t.Errorf("Expected module framework, got %q", project.Module)
+	}
+	if got, expected := project.SourceRoots, []string{"frameworks/base/java"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected source roots %q, got %q", expected, got)
+	}
+	if got, expected := project.Classpath, []string{"out/a.jar", "out/b.jar"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected classpath %q, got %q", expected, got)
+	}
+	if got, expected := project.Srcjars, []string{"gen/R.srcjar"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected srcjars %q, got %q", expected, got)
+	}
+	if project.LanguageLevel != "17" {
+		t.Errorf("Expected language level 17, got %q", project.LanguageLevel)
+	}
+
+	if err := writeJavaProjects(tmpDir, commands); err != nil {
+		t.Fatalf("writeJavaProjects failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, JavaProjectsFile)); err != nil {
+		t.Errorf("Expected %s to be written: %v", JavaProjectsFile, err)
+	}
+}
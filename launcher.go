@@ -0,0 +1,117 @@
+package wrapper
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var envAssignmentPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// Launcher is a program that runs the compiler on the build's behalf, such as ccache or rewrapper
+type Launcher struct {
+	Name string   `json:"name"` // Launcher family: env, ccache, sccache, rewrapper, gomacc, ...
+	Args []string `json:"args"` // Launcher program followed by its own options
+}
+
+// launcherParser returns how many leading arguments belong to the launcher (args[0] is the
+// launcher itself) and any environment assignments it applies
+type launcherParser func(args []string) (int, []string)
+
+// knownLaunchers maps launcher program names to their argument parsers
+var knownLaunchers = map[string]launcherParser{
+	"env":       parseEnvLauncher,
+	"ccache":    parseCcacheLauncher,
+	"sccache":   parseSimpleLauncher,
+	"gomacc":    parseSimpleLauncher,
+	"distcc":    parseSimpleLauncher,
+	"icecc":     parseSimpleLauncher,
+	"rewrapper": parseRewrapperLauncher,
+}
+
+// unwrapCommand separates leading environment assignments and launcher programs from the
+// compiler invocation they run. Launchers may be nested, e.g. env FOO=1 rewrapper ... clang.
+func unwrapCommand(args []string) ([]string, []Launcher, []string) {
+	var env []string
+	var launchers []Launcher
+
+	for {
+		for len(args) > 0 && envAssignmentPattern.MatchString(args[0]) {
+			env = append(env, args[0])
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			break
+		}
+
+		name := filepath.Base(args[0])
+		parse, ok := knownLaunchers[name]
+		if !ok {
+			break
+		}
+
+		count, assignments := parse(args)
+		if count >= len(args) || strings.HasPrefix(args[count], "-") {
+			// Launcher invoked for itself rather than wrapping a program, e.g. "ccache -s"
+			break
+		}
+		launchers = append(launchers, Launcher{Name: name, Args: args[:count]})
+		env = append(env, assignments...)
+		args = args[count:]
+	}
+
+	return env, launchers, args
+}
+
+func parseSimpleLauncher(_ []string) (int, []string) {
+	return 1, nil
+}
+
+// parseEnvLauncher handles env [-i] [-u NAME] [-C DIR] [--] [NAME=VALUE]... PROGRAM
+func parseEnvLauncher(args []string) (int, []string) {
+	var env []string
+	i := 1
+	for i < len(args) {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			i++
+		case arg == "-u" || arg == "--unset" || arg == "-C" || arg == "--chdir":
+			i += 2
+			continue
+		case strings.HasPrefix(arg, "-"):
+			i++
+			continue
+		}
+		break
+	}
+	for i < len(args) && envAssignmentPattern.MatchString(args[i]) {
+		env = append(env, args[i])
+		i++
+	}
+	return i, env
+}
+
+// parseCcacheLauncher handles ccache [KEY=VALUE]... PROGRAM, the assignments being ccache settings
+func parseCcacheLauncher(args []string) (int, []string) {
+	i := 1
+	for i < len(args) && envAssignmentPattern.MatchString(args[i]) {
+		i++
+	}
+	return i, nil
+}
+
+// parseRewrapperLauncher handles rewrapper -flag=value... [--] PROGRAM as used by soong's RBE support
+func parseRewrapperLauncher(args []string) (int, []string) {
+	i := 1
+	for i < len(args) {
+		if args[i] == "--" {
+			return i + 1, nil
+		}
+		if !strings.HasPrefix(args[i], "-") {
+			break
+		}
+		i++
+	}
+	return i, nil
+}
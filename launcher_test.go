@@ -0,0 +1,97 @@
+package wrapper
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnwrapCommand(t *testing.T) {
+	tests := []struct {
+		name              string
+		command           string
+		expectedEnv       []string
+		expectedLaunchers []Launcher
+		expectedCompiler  []string
+	}{
+		{
+			name:             "pwd assignment",
+			command:          "PWD=/proc/self/cwd prebuilts/clang/bin/clang -c a.c",
+			expectedEnv:      []string{"PWD=/proc/self/cwd"},
+			expectedCompiler: []string{"prebuilts/clang/bin/clang", "-c", "a.c"},
+		},
+		{
+			name: "rewrapper",
+			command: "PWD=/proc/self/cwd prebuilts/remoteexecution-client/live/rewrapper " +
+				"-labels=type=compile,lang=cpp -exec_strategy=remote_local_fallback -- prebuilts/clang/bin/clang++ -c a.cpp",
+			expectedEnv: []string{"PWD=/proc/self/cwd"},
+			expectedLaunchers: []Launcher{{
+				Name: "rewrapper",
+				Args: []string{"prebuilts/remoteexecution-client/live/rewrapper", "-labels=type=compile,lang=cpp", "-exec_strategy=remote_local_fallback", "--"},
+			}},
+			expectedCompiler: []string{"prebuilts/clang/bin/clang++", "-c", "a.cpp"},
+		},
+		{
+			name:        "nested env and ccache",
+			command:     "env -u LANG CCACHE_DIR=/tmp/cc ccache max_size=5G sccache gcc -c a.c",
+			expectedEnv: []string{"CCACHE_DIR=/tmp/cc"},
+			expectedLaunchers: []Launcher{
+				{Name: "env", Args: []string{"env", "-u", "LANG", "CCACHE_DIR=/tmp/cc"}},
+				{Name: "ccache", Args: []string{"ccache", "max_size=5G"}},
+				{Name: "sccache", Args: []string{"sccache"}},
+			},
+			expectedCompiler: []string{"gcc", "-c", "a.c"},
+		},
+		{
+			name:              "gomacc",
+			command:           "/opt/goma/gomacc clang -c a.c",
+			expectedLaunchers: []Launcher{{Name: "gomacc", Args: []string{"/opt/goma/gomacc"}}},
+			expectedCompiler:  []string{"clang", "-c", "a.c"},
+		},
+		{
+			name:             "launcher without program",
+			command:          "ccache -s",
+			expectedCompiler: []string{"ccache", "-s"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env, launchers, compiler := unwrapCommand(splitCommandLine(tt.command))
+			if !reflect.DeepEqual(env, tt.expectedEnv) {
+				t.Errorf("Expected env %q, got %q", tt.expectedEnv, env)
+			}
+			if !reflect.DeepEqual(launchers, tt.expectedLaunchers) {
+				t.Errorf("Expected launchers %+v, got %+v", tt.expectedLaunchers, launchers)
+			}
+			if !reflect.DeepEqual(compiler, tt.expectedCompiler) {
+				t.Errorf("Expected compiler %q, got %q", tt.expectedCompiler, compiler)
+			}
+		})
+	}
+}
+
+func TestParseCompdbEntryWithLauncher(t *testing.T) {
+	entry := map[string]interface{}{
+		"command":   "PWD=/proc/self/cwd prebuilts/remoteexecution-client/live/rewrapper -exec_strategy=local -- clang -Iinc -c a.c -o a.o",
+		"directory": "/src",
+		"file":      "a.c",
+		"output":    "a.o",
+	}
+
+	info := parseCompdbEntry(entry, "/default/dir")
+	if info.CompilerType != "clang" {
+		t.Errorf("Expected clang, got %q", info.CompilerType)
+	}
+	if len(info.Launchers) != 1 || info.Launchers[0].Name != "rewrapper" {
+		t.Errorf("Expected rewrapper launcher, got %+v", info.Launchers)
+	}
+	if !reflect.DeepEqual(info.Environment, []string{"PWD=/proc/self/cwd"}) {
+		t.Errorf("Unexpected environment %q", info.Environment)
+	}
+	if containsString(info.Flags, "-exec_strategy=local") {
+		t.Errorf("Launcher options leaked into compiler flags: %v", info.Flags)
+	}
+	if got := clangArguments(info); !reflect.DeepEqual(got, []string{"clang", "-Iinc", "-c", "a.c", "-o", "a.o"}) {
+		t.Errorf("Unexpected clang arguments %q", got)
+	}
+}
@@ -0,0 +1,220 @@
+package wrapper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ModuleInfoFile is the name of the module metadata file written to PRODUCT_OUT
+const ModuleInfoFile = "module-info.json"
+
+// ModuleInfo is one module of module-info.json
+type ModuleInfo struct {
+	Name      string   `json:"module_name"`
+	Class     []string `json:"class"`     // SHARED_LIBRARIES, EXECUTABLES, ...
+	Path      []string `json:"path"`      // Source directories declaring the module
+	Installed []string `json:"installed"` // Installed outputs, relative to ANDROID_BUILD_TOP
+}
+
+// ModuleInfoIndex maps module names and source directories to modules
+type ModuleInfoIndex struct {
+	File    string
+	modules map[string]*ModuleInfo
+	byDir   map[string][]*ModuleInfo
+}
+
+// findModuleInfoFile locates module-info.json: an explicit path, $ANDROID_PRODUCT_OUT,
+// or the most recently written out/target/product/*/module-info.json
+func findModuleInfoFile(config WrapperConfig) string {
+	if config.ModuleInfoFile != "" {
+		return config.ModuleInfoFile
+	}
+
+	if productOut := os.Getenv("ANDROID_PRODUCT_OUT"); productOut != "" {
+		candidate := filepath.Join(productOut, ModuleInfoFile)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(config.OutDir, "target", "product", "*", ModuleInfoFile))
+	newest := ""
+	var newestTime int64
+	for _, match := range matches {
+		stat, err := os.Stat(match)
+		if err != nil {
+			continue
+		}
+		if newest == "" || stat.ModTime().UnixNano() > newestTime {
+			newest = match
+			newestTime = stat.ModTime().UnixNano()
+		}
+	}
+
+	return newest
+}
+
+// LoadModuleInfo reads module-info.json and indexes it by name and directory
+func LoadModuleInfo(file string) (*ModuleInfoIndex, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", file, err)
+	}
+
+	var modules map[string]*ModuleInfo
+	if err := json.Unmarshal(data, &modules); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", file, err)
+	}
+
+	index := &ModuleInfoIndex{
+		File:    file,
+		modules: modules,
+		byDir:   map[string][]*ModuleInfo{},
+	}
+
+	// Iterate in name order so directory lookups are deterministic
+	names := make([]string, 0, len(modules))
+	for name := range modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		info := modules[name]
+		if info.Name == "" {
+			info.Name = name
+		}
+		for _, dir := range info.Path {
+			dir = filepath.Clean(dir)
+			index.byDir[dir] = append(index.byDir[dir], info)
+		}
+	}
+
+	fmt.Printf("Loaded %d modules from %s\n", len(modules), file)
+	return index, nil
+}
+
+// Lookup returns the module with the given name, or nil
+func (idx *ModuleInfoIndex) Lookup(name string) *ModuleInfo {
+	return idx.modules[name]
+}
+
+// ModulesInDir returns the modules declared in dir or any of its subdirectories
+func (idx *ModuleInfoIndex) ModulesInDir(dir string) []*ModuleInfo {
+	dir = filepath.Clean(strings.Trim(dir, "/"))
+
+	var dirs []string
+	for candidate := range idx.byDir {
+		if candidate == dir || strings.HasPrefix(candidate, dir+"/") {
+			dirs = append(dirs, candidate)
+		}
+	}
+	sort.Strings(dirs)
+
+	var modules []*ModuleInfo
+	for _, candidate := range dirs {
+		modules = append(modules, idx.byDir[candidate]...)
+	}
+	return modules
+}
+
+// Targets maps module names and directories to ninja targets: the installed outputs the graph
+// builds, or the module's phony name when it builds none of them. known reports whether the
+// graph builds a target, nil accepts every target. Unknown modules, and modules without any
+// target in the graph, are returned separately.
+func (idx *ModuleInfoIndex) Targets(moduleTargets []string, known func(string) bool) ([]string, []string) {
+	var targets, missing []string
+	seen := map[string]bool{}
+
+	add := func(info *ModuleInfo) bool {
+		var outputs []string
+		for _, output := range info.Installed {
+			if known == nil || known(output) {
+				outputs = append(outputs, output)
+			}
+		}
+		if len(outputs) == 0 && (known == nil || known(info.Name)) {
+			outputs = []string{info.Name}
+		}
+		for _, output := range outputs {
+			if !seen[output] {
+				seen[output] = true
+				targets = append(targets, output)
+			}
+		}
+		return len(outputs) > 0
+	}
+
+	for _, module := range moduleTargets {
+		if info := idx.Lookup(module); info != nil {
+			if !add(info) {
+				missing = append(missing, module)
+			}
+			continue
+		}
+
+		resolved := false
+		for _, info := range idx.ModulesInDir(module) {
+			resolved = add(info) || resolved
+		}
+		if !resolved {
+			missing = append(missing, module)
+		}
+	}
+
+	return targets, missing
+}
+
+// ninjaTargetSet reports whether the manifest declares a target, from the parsed manifest or
+// `-t targets all`. It returns nil when the targets can't be listed.
+func ninjaTargetSet(ctx context.Context, config WrapperConfig, ninjaFile string) func(string) bool {
+	if config.NinjaTool == NativeNinjaTool {
+		manifest, err := nativeManifest(config, ninjaFile)
+		if err != nil {
+			fmt.Printf("Failed to get ninja targets: %v\n", err)
+			return nil
+		}
+		return func(target string) bool { return manifest.EdgeForOutput(target) != nil }
+	}
+
+	cmd := commandContext(ctx, config.NinjaTool, "-f", ninjaFile, "-t", "targets", "all")
+	var outBuf bytes.Buffer
+	cmd.Stdout = &outBuf
+	cmd.Dir = os.Getenv("ANDROID_BUILD_TOP")
+	if err := cmd.Run(); err != nil {
+		fmt.Printf("Failed to get ninja targets: %v\n", err)
+		return nil
+	}
+
+	targets := map[string]bool{}
+	for _, target := range parseNinjaTargetsOutput(&outBuf) {
+		targets[target] = true
+	}
+	return func(target string) bool { return targets[target] }
+}
+
+// moduleInfoTargets resolves modules through module-info.json when it is available, keeping the
+// targets ninjaFile declares
+func moduleInfoTargets(ctx context.Context, config WrapperConfig, ninjaFile string, moduleTargets []string) ([]string, []string) {
+	file := findModuleInfoFile(config)
+	if file == "" {
+		fmt.Printf("No %s found, falling back to target matching\n", ModuleInfoFile)
+		return nil, moduleTargets
+	}
+
+	index, err := LoadModuleInfo(file)
+	if err != nil {
+		fmt.Printf("Failed to load module info: %v\n", err)
+		return nil, moduleTargets
+	}
+
+	targets, missing := index.Targets(moduleTargets, ninjaTargetSet(ctx, config, ninjaFile))
+	fmt.Printf("Resolved %d targets from %s, %d modules not found\n", len(targets), ModuleInfoFile, len(missing))
+	return targets, missing
+}
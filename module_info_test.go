@@ -0,0 +1,140 @@
+package wrapper
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testModuleInfo = `{
+  "multi_module_demo": {
+    "class": ["EXECUTABLES"],
+    "path": ["system/core/hello"],
+    "installed": ["out/host/linux-x86/bin/multi_module_demo"],
+    "module_name": "multi_module_demo"
+  },
+  "libhello_static": {
+    "class": ["STATIC_LIBRARIES"],
+    "path": ["system/core/hello/lib"],
+    "installed": [],
+    "module_name": "libhello_static"
+  },
+  "libutils": {
+    "class": ["SHARED_LIBRARIES"],
+    "path": ["system/core/libutils"],
+    "installed": ["out/target/product/generic/system/lib64/libutils.so", "out/target/product/generic/system/lib/libutils.so"],
+    "module_name": "libutils"
+  }
+}`
+
+func writeModuleInfo(t *testing.T, outDir, product string) string {
+	t.Helper()
+	dir := filepath.Join(outDir, "target", "product", product)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Failed to create product dir: %v", err)
+	}
+	file := filepath.Join(dir, ModuleInfoFile)
+	if err := os.WriteFile(file, []byte(testModuleInfo), 0644); err != nil {
+		t.Fatalf("Failed to write module info: %v", err)
+	}
+	return file
+}
+
+func TestModuleInfoTargets(t *testing.T) {
+	file := writeModuleInfo(t, t.TempDir(), "generic")
+
+	index, err := LoadModuleInfo(file)
+	if err != nil {
+		t.Fatalf("LoadModuleInfo failed: %v", err)
+	}
+
+	// The graph builds only the 64-bit libutils and libhello_static
+	graph := map[string]bool{
+		"out/target/product/generic/system/lib64/libutils.so": true,
+		"libhello_static": true,
+	}
+	tests := []struct {
+		name     string
+		modules  []string
+		known    func(string) bool
+		expected []string
+		missing  []string
+	}{
+		{
+			name:     "module name",
+			modules:  []string{"libutils"},
+			expected: []string{"out/target/product/generic/system/lib64/libutils.so", "out/target/product/generic/system/lib/libutils.so"},
+		},
+		{
+			name:     "directory includes subdirectories",
+			modules:  []string{"system/core/hello"},
+			expected: []string{"out/host/linux-x86/bin/multi_module_demo", "libhello_static"},
+		},
+		{
+			name:     "unknown module",
+			modules:  []string{"multi_module_demo", "libmissing"},
+			expected: []string{"out/host/linux-x86/bin/multi_module_demo"},
+			missing:  []string{"libmissing"},
+		},
+		{
+			name:     "installed outputs outside the graph",
+			modules:  []string{"libutils", "multi_module_demo", "system/core/hello"},
+			known:    func(target string) bool { return graph[target] },
+			expected: []string{"out/target/product/generic/system/lib64/libutils.so", "libhello_static"},
+			missing:  []string{"multi_module_demo"},
+		},
+		{
+			name:    "directory without targets in the graph",
+			modules: []string{"system/core/libutils"},
+			known:   func(string) bool { return false },
+			missing: []string{"system/core/libutils"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets, missing := index.Targets(tt.modules, tt.known)
+			if !reflect.DeepEqual(targets, tt.expected) {
+				t.Errorf("Expected targets %v, got %v", tt.expected, targets)
+			}
+			if !reflect.DeepEqual(missing, tt.missing) {
+				t.Errorf("Expected missing %v, got %v", tt.missing, missing)
+			}
+		})
+	}
+
+	if info := index.Lookup("libutils"); info == nil || info.Class[0] != "SHARED_LIBRARIES" {
+		t.Errorf("Unexpected lookup result %+v", info)
+	}
+}
+
+func TestFindModuleInfoFile(t *testing.T) {
+	outDir := t.TempDir()
+	t.Setenv("ANDROID_PRODUCT_OUT", "")
+
+	if got := findModuleInfoFile(WrapperConfig{OutDir: outDir}); got != "" {
+		t.Errorf("Expected no module info file, got %q", got)
+	}
+
+	older := writeModuleInfo(t, outDir, "older")
+	newer := writeModuleInfo(t, outDir, "newer")
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(older, past, past); err != nil {
+		t.Fatalf("Failed to set mtime: %v", err)
+	}
+
+	if got := findModuleInfoFile(WrapperConfig{OutDir: outDir}); got != newer {
+		t.Errorf("Expected newest file %q, got %q", newer, got)
+	}
+
+	t.Setenv("ANDROID_PRODUCT_OUT", filepath.Dir(older))
+	if got := findModuleInfoFile(WrapperConfig{OutDir: outDir}); got != older {
+		t.Errorf("Expected ANDROID_PRODUCT_OUT file %q, got %q", older, got)
+	}
+
+	if got := findModuleInfoFile(WrapperConfig{OutDir: outDir, ModuleInfoFile: "explicit.json"}); got != "explicit.json" {
+		t.Errorf("Expected explicit file, got %q", got)
+	}
+}
@@ -0,0 +1,111 @@
+package wrapper
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// NinjaDepsFile is the dependency log ninja keeps in its build directory
+const NinjaDepsFile = ".ninja_deps"
+
+const (
+	ninjaDepsSignature = "# ninjadeps\n"
+	// ninjaDepsMaxRecord mirrors the record size limit of ninja's deps_log.cc
+	ninjaDepsMaxRecord = 1<<19 - 1
+)
+
+// readNinjaDeps reads a ninja dependency log of version 3 (32-bit mtimes) or 4 (64-bit mtimes)
+// and returns the dependencies recorded for every output, keyed by the output path as ninja
+// spelled it. Later records of an output replace earlier ones like ninja's recompaction would.
+// A truncated or inconsistent tail, left by an interrupted build, ends the log without error as
+// ninja itself treats it.
+func readNinjaDeps(path string) (map[string][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReaderSize(file, 1<<20)
+
+	header := make([]byte, len(ninjaDepsSignature)+4)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(ninjaDepsSignature)]) != ninjaDepsSignature {
+		return nil, fmt.Errorf("%s: bad deps log signature", path)
+	}
+	version := binary.LittleEndian.Uint32(header[len(ninjaDepsSignature):])
+	if version != 3 && version != 4 {
+		return nil, fmt.Errorf("%s: unsupported deps log version %d", path, version)
+	}
+	mtimeSize := 4
+	if version == 4 {
+		mtimeSize = 8
+	}
+
+	var paths []string
+	deps := map[int][]int{}
+	var sizeBuf [4]byte
+	payload := make([]byte, 0, 4096)
+
+	for {
+		if _, err := io.ReadFull(r, sizeBuf[:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return nil, err
+		}
+		size := binary.LittleEndian.Uint32(sizeBuf[:])
+		isDeps := size&0x80000000 != 0
+		size &= 0x7fffffff
+		if size > ninjaDepsMaxRecord || size < 4 || size%4 != 0 {
+			break
+		}
+
+		payload = payload[:size]
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+
+		if isDeps {
+			if int(size) < 4+mtimeSize {
+				break
+			}
+			output := int(int32(binary.LittleEndian.Uint32(payload)))
+			ids := payload[4+mtimeSize:]
+			inputs := make([]int, 0, len(ids)/4)
+			valid := output >= 0 && output < len(paths)
+			for i := 0; valid && i+4 <= len(ids); i += 4 {
+				id := int(int32(binary.LittleEndian.Uint32(ids[i:])))
+				valid = id >= 0 && id < len(paths)
+				inputs = append(inputs, id)
+			}
+			if !valid {
+				break
+			}
+			deps[output] = inputs
+			continue
+		}
+
+		// Path records end in the one's complement of their id as a checksum
+		name := strings.TrimRight(string(payload[:size-4]), "\x00")
+		checksum := binary.LittleEndian.Uint32(payload[size-4:])
+		if checksum != ^uint32(len(paths)) {
+			break
+		}
+		paths = append(paths, name)
+	}
+
+	result := make(map[string][]string, len(deps))
+	for output, ids := range deps {
+		inputs := make([]string, len(ids))
+		for i, id := range ids {
+			inputs[i] = paths[id]
+		}
+		result[paths[output]] = inputs
+	}
+	return result, nil
+}
@@ -0,0 +1,118 @@
+package wrapper
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// ninjaDepsWriter builds dependency logs the way ninja's DepsLog does
+type ninjaDepsWriter struct {
+	version uint32
+	data    []byte
+	ids     map[string]uint32
+}
+
+func newNinjaDepsWriter(version uint32) *ninjaDepsWriter {
+	w := &ninjaDepsWriter{version: version, data: []byte(ninjaDepsSignature), ids: map[string]uint32{}}
+	w.data = binary.LittleEndian.AppendUint32(w.data, version)
+	return w
+}
+
+func (w *ninjaDepsWriter) id(path string) uint32 {
+	if id, ok := w.ids[path]; ok {
+		return id
+	}
+	id := uint32(len(w.ids))
+	w.ids[path] = id
+
+	padding := (4 - len(path)%4) % 4
+	w.data = binary.LittleEndian.AppendUint32(w.data, uint32(len(path)+padding+4))
+	w.data = append(w.data, path...)
+	w.data = append(w.data, make([]byte, padding)...)
+	w.data = binary.LittleEndian.AppendUint32(w.data, ^id)
+	return id
+}
+
+func (w *ninjaDepsWriter) deps(output string, inputs ...string) {
+	ids := []uint32{w.id(output)}
+	for _, input := range inputs {
+		ids = append(ids, w.id(input))
+	}
+
+	mtime := 4
+	if w.version == 4 {
+		mtime = 8
+	}
+	w.data = binary.LittleEndian.AppendUint32(w.data, uint32(4+mtime+4*len(inputs))|0x80000000)
+	w.data = binary.LittleEndian.AppendUint32(w.data, ids[0])
+	w.data = append(w.data, make([]byte, mtime)...)
+	for _, id := range ids[1:] {
+		w.data = binary.LittleEndian.AppendUint32(w.data, id)
+	}
+}
+
+func (w *ninjaDepsWriter) write(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), NinjaDepsFile)
+	if err := os.WriteFile(path, w.data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadNinjaDeps(t *testing.T) {
+	for _, version := range []uint32{3, 4} {
+		w := newNinjaDepsWriter(version)
+		w.deps("out/a.o", "a.c", "include/a.h")
+		w.deps("out/b.o", "b.c", "include/a.h", "include/bb.h")
+		// Rebuilt since, the latest record wins
+		w.deps("out/a.o", "a.c", "include/a2.h")
+
+		deps, err := readNinjaDeps(w.write(t))
+		if err != nil {
+			t.Fatalf("Version %d: %v", version, err)
+		}
+		want := map[string][]string{
+			"out/a.o": {"a.c", "include/a2.h"},
+			"out/b.o": {"b.c", "include/a.h", "include/bb.h"},
+		}
+		if !reflect.DeepEqual(deps, want) {
+			t.Errorf("Version %d: expected %v, got %v", version, want, deps)
+		}
+	}
+
+	// An interrupted build leaves a partial record behind
+	w := newNinjaDepsWriter(4)
+	w.deps("out/a.o", "a.c")
+	complete := len(w.data)
+	w.deps("out/b.o", "b.c")
+	w.data = w.data[:complete+6]
+	deps, err := readNinjaDeps(w.write(t))
+	if err != nil || !reflect.DeepEqual(deps, map[string][]string{"out/a.o": {"a.c"}}) {
+		t.Errorf("Expected the complete records, got %v: %v", deps, err)
+	}
+
+	// A bad checksum ends the log
+	w = newNinjaDepsWriter(4)
+	w.deps("out/a.o", "a.c")
+	w.data[len(ninjaDepsSignature)+4+4+len("out/a.o")+1] ^= 0xff
+	if deps, err := readNinjaDeps(w.write(t)); err != nil || len(deps) != 0 {
+		t.Errorf("Expected no dependencies after a bad checksum, got %v: %v", deps, err)
+	}
+
+	for name, data := range map[string][]byte{
+		"signature": []byte("# ninjalog\n\x04\x00\x00\x00"),
+		"version":   newNinjaDepsWriter(2).data,
+	} {
+		path := filepath.Join(t.TempDir(), NinjaDepsFile)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readNinjaDeps(path); err == nil {
+			t.Errorf("Expected an error for a bad %s", name)
+		}
+	}
+}
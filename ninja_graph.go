@@ -0,0 +1,181 @@
+package wrapper
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NinjaGraph answers dependency queries over a loaded manifest. Paths are nodes and
+// edges connect a build statement's inputs to its outputs.
+type NinjaGraph struct {
+	manifest  *NinjaManifest
+	consumers map[string][]*NinjaEdge // path -> edges using it as any kind of input
+}
+
+// Graph returns the dependency graph of the manifest, building the reverse index once
+func (m *NinjaManifest) Graph() *NinjaGraph {
+	m.graphOnce.Do(func() {
+		consumers := map[string][]*NinjaEdge{}
+		for _, edge := range m.Edges {
+			for _, input := range edge.AllInputs() {
+				consumers[input] = append(consumers[input], edge)
+			}
+		}
+		m.graph = &NinjaGraph{manifest: m, consumers: consumers}
+	})
+	return m.graph
+}
+
+// Has reports whether path is produced or consumed by any edge
+func (g *NinjaGraph) Has(path string) bool {
+	path = canonicalizeNinjaPath(path)
+	return g.manifest.outputs[path] != nil || len(g.consumers[path]) > 0
+}
+
+// InputsOf returns the direct inputs of the edge producing target
+func (g *NinjaGraph) InputsOf(target string) []string {
+	edge := g.manifest.EdgeForOutput(target)
+	if edge == nil {
+		return nil
+	}
+	return edge.AllInputs()
+}
+
+// OutputsOf returns the outputs of every edge that directly consumes path
+func (g *NinjaGraph) OutputsOf(path string) []string {
+	var outputs []string
+	seen := map[string]bool{}
+	for _, edge := range g.consumers[canonicalizeNinjaPath(path)] {
+		for _, output := range edge.AllOutputs() {
+			if !seen[output] {
+				seen[output] = true
+				outputs = append(outputs, output)
+			}
+		}
+	}
+	return outputs
+}
+
+// TransitiveDeps returns every path targets depend on, directly or indirectly
+func (g *NinjaGraph) TransitiveDeps(targets ...string) []string {
+	var deps []string
+	seen := map[string]bool{}
+	var visit func(path string)
+	visit = func(path string) {
+		for _, input := range g.InputsOf(path) {
+			if seen[input] {
+				continue
+			}
+			seen[input] = true
+			deps = append(deps, input)
+			visit(input)
+		}
+	}
+	for _, target := range targets {
+		visit(canonicalizeNinjaPath(target))
+	}
+
+	return deps
+}
+
+// ReverseDeps returns every output that depends on path, directly or indirectly
+func (g *NinjaGraph) ReverseDeps(path string) []string {
+	var deps []string
+	seen := map[string]bool{}
+	queue := []string{canonicalizeNinjaPath(path)}
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, output := range g.OutputsOf(current) {
+			if !seen[output] {
+				seen[output] = true
+				deps = append(deps, output)
+				queue = append(queue, output)
+			}
+		}
+	}
+
+	return deps
+}
+
+// PathBetween returns the shortest dependency chain from target down to dep, both
+// included, or nil when target does not depend on dep
+func (g *NinjaGraph) PathBetween(target, dep string) []string {
+	target = canonicalizeNinjaPath(target)
+	dep = canonicalizeNinjaPath(dep)
+	if target == dep {
+		return []string{target}
+	}
+
+	parent := map[string]string{target: ""}
+	queue := []string{target}
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, input := range g.InputsOf(current) {
+			if _, ok := parent[input]; ok {
+				continue
+			}
+			parent[input] = current
+			if input == dep {
+				var chain []string
+				for node := dep; node != ""; node = parent[node] {
+					chain = append([]string{node}, chain...)
+				}
+				return chain
+			}
+			queue = append(queue, input)
+		}
+	}
+
+	return nil
+}
+
+// CompileEdges returns the edges reachable from targets whose command runs a tool a registered
+// ToolFamily recognizes, see LookupToolFamily. Phony, link and copy edges are left out.
+func (g *NinjaGraph) CompileEdges(targets ...string) []*NinjaEdge {
+	edges, _ := g.manifest.EdgesForTargets(targets)
+	compile := edges[:0]
+	for _, edge := range edges {
+		if determineCompilerTypeFromCommand(edge.Command()) != "" {
+			compile = append(compile, edge)
+		}
+	}
+	return compile
+}
+
+// moduleGraphTargets maps module names and directories to the ninja targets soong
+// declares for them: the module's phony target or MODULES-IN-<dir>. Modules without
+// such a target are returned separately.
+func moduleGraphTargets(g *NinjaGraph, moduleTargets []string) ([]string, []string) {
+	var targets, missing []string
+	seen := map[string]bool{}
+
+	for _, module := range moduleTargets {
+		trimmed := strings.Trim(module, "/")
+		candidates := []string{
+			trimmed,
+			"MODULES-IN-" + strings.ReplaceAll(trimmed, "/", "-"),
+		}
+
+		found := false
+		for _, candidate := range candidates {
+			if candidate == "" || g.manifest.EdgeForOutput(candidate) == nil {
+				continue
+			}
+			found = true
+			if !seen[candidate] {
+				seen[candidate] = true
+				targets = append(targets, candidate)
+			}
+		}
+		if !found {
+			missing = append(missing, module)
+		}
+	}
+
+	fmt.Printf("Resolved %d module targets through the ninja graph\n", len(targets))
+	return targets, missing
+}
@@ -0,0 +1,96 @@
+package wrapper
+
+import (
+	"reflect"
+	"testing"
+)
+
+func loadTestGraph(t *testing.T) *NinjaGraph {
+	t.Helper()
+	dir := writeNinjaFiles(t, map[string]string{
+		"build.ninja": `rule cc
+  command = clang -c $in -o $out
+rule link
+  command = ld.lld $in -o $out
+build out/hello/main.o: cc hello/main.c | hello/main.h
+build out/hello/util.o: cc hello/util.c
+build out/hello/hello: link out/hello/main.o out/hello/util.o
+build out/other/other.o: cc other/other.c
+build hello: phony out/hello/hello
+build MODULES-IN-system-core-hello: phony hello
+`,
+	})
+
+	manifest, err := LoadNinjaManifest("build.ninja", dir)
+	if err != nil {
+		t.Fatalf("LoadNinjaManifest failed: %v", err)
+	}
+	return manifest.Graph()
+}
+
+func TestNinjaGraphQueries(t *testing.T) {
+	g := loadTestGraph(t)
+
+	if got, want := g.InputsOf("out/hello/hello"), []string{"out/hello/main.o", "out/hello/util.o"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("InputsOf: expected %v, got %v", want, got)
+	}
+
+	if got, want := g.OutputsOf("hello/main.h"), []string{"out/hello/main.o"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("OutputsOf: expected %v, got %v", want, got)
+	}
+
+	want := []string{"out/hello/hello", "out/hello/main.o", "hello/main.c", "hello/main.h", "out/hello/util.o", "hello/util.c"}
+	if got := g.TransitiveDeps("hello"); !reflect.DeepEqual(got, want) {
+		t.Errorf("TransitiveDeps: expected %v, got %v", want, got)
+	}
+
+	want = []string{"out/hello/main.o", "out/hello/hello", "hello", "MODULES-IN-system-core-hello"}
+	if got := g.ReverseDeps("hello/main.c"); !reflect.DeepEqual(got, want) {
+		t.Errorf("ReverseDeps: expected %v, got %v", want, got)
+	}
+
+	want = []string{"hello", "out/hello/hello", "out/hello/main.o", "hello/main.h"}
+	if got := g.PathBetween("hello", "hello/main.h"); !reflect.DeepEqual(got, want) {
+		t.Errorf("PathBetween: expected %v, got %v", want, got)
+	}
+	if got := g.PathBetween("hello", "other/other.c"); got != nil {
+		t.Errorf("PathBetween: expected no path, got %v", got)
+	}
+
+	if !g.Has("hello/util.c") || g.Has("missing.c") {
+		t.Errorf("Has returned unexpected results")
+	}
+
+	var outputs []string
+	for _, edge := range g.CompileEdges("hello") {
+		outputs = append(outputs, edge.Outputs[0])
+	}
+	if want := []string{"out/hello/main.o", "out/hello/util.o"}; !reflect.DeepEqual(outputs, want) {
+		t.Errorf("CompileEdges: expected %v, got %v", want, outputs)
+	}
+}
+
+func TestModuleGraphTargets(t *testing.T) {
+	g := loadTestGraph(t)
+
+	tests := []struct {
+		modules  []string
+		expected []string
+		missing  []string
+	}{
+		{[]string{"hello"}, []string{"hello"}, nil},
+		{[]string{"system/core/hello/"}, []string{"MODULES-IN-system-core-hello"}, nil},
+		{[]string{"hell"}, nil, []string{"hell"}},
+		{[]string{"hello", "hello"}, []string{"hello"}, nil},
+	}
+
+	for _, tt := range tests {
+		got, missing := moduleGraphTargets(g, tt.modules)
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("For %v expected %v, got %v", tt.modules, tt.expected, got)
+		}
+		if !reflect.DeepEqual(missing, tt.missing) {
+			t.Errorf("For %v expected missing %v, got %v", tt.modules, tt.missing, missing)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package wrapper
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// LayerSoong marks commands declared by Soong's build.ninja
+	LayerSoong = "soong"
+	// LayerKati marks commands of Android.mk modules declared by Kati's build-<product>.ninja
+	LayerKati = "kati"
+)
+
+// extractionNinjaFile returns the manifest commands are extracted from: combined-<product>.ninja,
+// which subninjas both the Kati and the Soong output, or the Soong manifest alone when there is
+// no combined manifest
+func extractionNinjaFile(config WrapperConfig) string {
+	if config.CombinedNinjaFile == "" {
+		return config.SoongNinjaFile
+	}
+	if _, err := os.Stat(config.CombinedNinjaFile); err != nil {
+		fmt.Printf("Warning: combined ninja file unavailable, only extracting Soong commands: %v\n", err)
+		return config.SoongNinjaFile
+	}
+	fmt.Printf("Extracting Kati and Soong commands from %s\n", config.CombinedNinjaFile)
+	return config.CombinedNinjaFile
+}
+
+// layerAttribution tells the layer of a command from the manifest that declared its edge, or from
+// its output path when the manifest wasn't parsed
+type layerAttribution struct {
+	rootDir    string
+	soongFile  string
+	soongOut   string
+	manifest   *NinjaManifest
+	singleTree bool // Only the Soong manifest was read
+}
+
+func newLayerAttribution(config WrapperConfig, ninjaFile string) *layerAttribution {
+	a := &layerAttribution{
+		rootDir:    os.Getenv("ANDROID_BUILD_TOP"),
+		manifest:   config.manifest,
+		singleTree: ninjaFile != config.CombinedNinjaFile || config.CombinedNinjaFile == "",
+	}
+	if config.manifest != nil {
+		a.rootDir = config.manifest.RootDir
+	}
+	a.soongFile = a.absolute(a.rootDir, config.SoongNinjaFile)
+	a.soongOut = config.SoongOutDir
+	if a.soongOut == "" {
+		a.soongOut = filepath.Dir(config.SoongNinjaFile)
+	}
+	a.soongOut = a.absolute(a.rootDir, a.soongOut)
+	return a
+}
+
+func (a *layerAttribution) absolute(dir, path string) string {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	return filepath.Clean(path)
+}
+
+// inSoong reports whether an absolute path belongs to the Soong output
+func (a *layerAttribution) inSoong(path string) bool {
+	return path == a.soongFile || strings.HasPrefix(path, a.soongOut+"/")
+}
+
+// layer returns the layer of a command
+func (a *layerAttribution) layer(info CompilerCommandInfo) string {
+	if a.singleTree {
+		return LayerSoong
+	}
+
+	if a.manifest != nil && info.OutputFile != "" {
+		// The native parser knows which subninja declared the edge
+		output := info.OutputFile
+		if filepath.IsAbs(output) {
+			if rel, err := filepath.Rel(a.rootDir, output); err == nil {
+				output = rel
+			}
+		}
+		if edge := a.manifest.EdgeForOutput(output); edge != nil {
+			if a.inSoong(a.absolute(a.rootDir, edge.File)) {
+				return LayerSoong
+			}
+			return LayerKati
+		}
+	}
+
+	workingDir := info.WorkingDir
+	if workingDir == "" {
+		workingDir = a.rootDir
+	}
+	if info.OutputFile != "" && a.inSoong(a.absolute(a.absolute(a.rootDir, workingDir), info.OutputFile)) {
+		return LayerSoong
+	}
+	return LayerKati
+}
+
+// attributeLayers sets the layer of every command and drops commands both layers reach, keeping
+// the Soong one
+func attributeLayers(config WrapperConfig, ninjaFile string, commands *CommandDatabase) {
+	a := newLayerAttribution(config, ninjaFile)
+
+	seen := make(map[string]int, len(commands.Commands))
+	result := commands.Commands[:0]
+	duplicates := 0
+
+	for _, info := range commands.Commands {
+		info.Layer = a.layer(info)
+		if a.singleTree {
+			result = append(result, info)
+			continue
+		}
+
+		key := mergeKey(info)
+		if i, ok := seen[key]; ok {
+			duplicates++
+			if result[i].Layer != LayerSoong && info.Layer == LayerSoong {
+				result[i] = info
+			}
+			continue
+		}
+		seen[key] = len(result)
+		result = append(result, info)
+	}
+
+	if duplicates > 0 {
+		fmt.Printf("Dropped %d commands reachable from both Kati and Soong\n", duplicates)
+	}
+	commands.Commands = result
+}
+
+// layerFilter is attributeLayers for commands that arrive one at a time. Soong commands are
+// passed on at once; Kati commands are held until flush, since a Soong command reaching the
+// same output may still follow and replace them.
+type layerFilter struct {
+	attribution *layerAttribution
+	soong       map[string]bool // Keys of the Soong commands passed on
+	kati        map[string]bool // Keys of the held Kati commands
+	held        []CompilerCommandInfo
+	duplicates  int
+}
+
+func newLayerFilter(config WrapperConfig, ninjaFile string) *layerFilter {
+	return &layerFilter{
+		attribution: newLayerAttribution(config, ninjaFile),
+		soong:       map[string]bool{},
+		kati:        map[string]bool{},
+	}
+}
+
+// add sets the layer of info and passes it to emit unless it duplicates an earlier command
+func (f *layerFilter) add(info CompilerCommandInfo, emit func(CompilerCommandInfo)) {
+	info.Layer = f.attribution.layer(info)
+	if f.attribution.singleTree {
+		emit(info)
+		return
+	}
+
+	key := mergeKey(info)
+	switch {
+	case f.soong[key]:
+		f.duplicates++
+	case info.Layer == LayerSoong:
+		if f.kati[key] {
+			f.duplicates++
+		}
+		f.soong[key] = true
+		emit(info)
+	case f.kati[key]:
+		f.duplicates++
+	default:
+		f.kati[key] = true
+		f.held = append(f.held, info)
+	}
+}
+
+// flush passes the held Kati commands no Soong command replaced to emit
+func (f *layerFilter) flush(emit func(CompilerCommandInfo)) {
+	for _, info := range f.held {
+		if !f.soong[mergeKey(info)] {
+			emit(info)
+		}
+	}
+	f.held = nil
+
+	if f.duplicates > 0 {
+		fmt.Printf("Dropped %d commands reachable from both Kati and Soong\n", f.duplicates)
+	}
+}
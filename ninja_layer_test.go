@@ -0,0 +1,157 @@
+package wrapper
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunNinjaWithCommandLoggingCombined(t *testing.T) {
+	dir := writeNinjaFiles(t, map[string]string{
+		"combined.ninja": `pool highmem_pool
+  depth = 4
+rule cc
+  command = clang -c $in -o $out
+subninja kati.ninja
+subninja soong/build.ninja
+`,
+		"kati.ninja": `build out/legacy/main.o: cc legacy/main.c
+build legacy: phony out/legacy/main.o
+build hello: phony legacy
+`,
+		"soong/build.ninja": `build out/soong/hello/main.o: cc hello/main.c
+build hello_soong: phony out/soong/hello/main.o
+`,
+	})
+	// Manifest paths are relative to the source root the build runs in, like in a real tree
+	t.Setenv("PATH", t.TempDir())
+	t.Setenv("ANDROID_BUILD_TOP", dir)
+	t.Setenv("ANDROID_PRODUCT_OUT", "")
+	origDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(origDir); err != nil {
+			t.Errorf("Failed to restore working directory: %v", err)
+		}
+	}()
+
+	config := WrapperConfig{
+		OutDir:            "out",
+		SoongNinjaFile:    "soong/build.ninja",
+		CombinedNinjaFile: "combined.ninja",
+		CompdbFormat:      CompdbFormatInternal,
+		BuildArguments:    []string{"m", "hello", "hello_soong"},
+	}
+
+	result, err := RunNinjaWithCommandLogging(context.Background(), config, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Commands != 2 {
+		t.Fatalf("Expected the Kati and the Soong command, got %d", result.Commands)
+	}
+
+	db, err := loadExistingDatabase(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers := map[string]string{}
+	for _, info := range db.Commands {
+		layers[strings.Join(info.InputFiles, ",")] = info.Layer
+	}
+	if layers["legacy/main.c"] != LayerKati || layers["hello/main.c"] != LayerSoong {
+		t.Errorf("Unexpected layers %v", layers)
+	}
+}
+
+func TestAttributeLayers(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("ANDROID_BUILD_TOP", root)
+
+	config := WrapperConfig{
+		SoongNinjaFile:    "out/soong/build.ninja",
+		CombinedNinjaFile: "out/combined.ninja",
+	}
+	commands := CommandDatabase{Commands: []CompilerCommandInfo{
+		{InputFiles: []string{"a.c"}, OutputFile: "out/target/a.o"},
+		{InputFiles: []string{"b.c"}, OutputFile: "out/soong/.intermediates/b/b.o"},
+		{InputFiles: []string{"a.c"}, OutputFile: "out/target/a.o", Command: "soong"},
+		{InputFiles: []string{"c.c"}, OutputFile: "../c.o", WorkingDir: filepath.Join(root, "out/soong/sub")},
+	}}
+
+	// Both layers reach a.o, the first command is kept with the layer its output belongs to
+	attributeLayers(config, config.CombinedNinjaFile, &commands)
+	if len(commands.Commands) != 3 {
+		t.Fatalf("Expected the duplicate to be dropped, got %d commands", len(commands.Commands))
+	}
+	want := []string{LayerKati, LayerSoong, LayerSoong}
+	for i, info := range commands.Commands {
+		if info.Layer != want[i] {
+			t.Errorf("Expected %s for %s, got %s", want[i], info.OutputFile, info.Layer)
+		}
+	}
+
+	// Everything comes from Soong without the combined manifest
+	commands = CommandDatabase{Commands: []CompilerCommandInfo{{InputFiles: []string{"a.c"}, OutputFile: "out/target/a.o"}}}
+	attributeLayers(config, config.SoongNinjaFile, &commands)
+	if commands.Commands[0].Layer != LayerSoong {
+		t.Errorf("Expected a Soong command, got %s", commands.Commands[0].Layer)
+	}
+}
+
+func TestExtractionNinjaFile(t *testing.T) {
+	dir := t.TempDir()
+	config := WrapperConfig{
+		SoongNinjaFile:    filepath.Join(dir, "build.ninja"),
+		CombinedNinjaFile: filepath.Join(dir, "combined.ninja"),
+	}
+
+	if got := extractionNinjaFile(config); got != config.SoongNinjaFile {
+		t.Errorf("Expected the Soong manifest while combined.ninja is missing, got %s", got)
+	}
+	if err := os.WriteFile(config.CombinedNinjaFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := extractionNinjaFile(config); got != config.CombinedNinjaFile {
+		t.Errorf("Expected the combined manifest, got %s", got)
+	}
+}
+
+func TestLayerFilter(t *testing.T) {
+	dir := t.TempDir()
+	config := WrapperConfig{
+		SoongNinjaFile:    filepath.Join(dir, "out/soong/build.ninja"),
+		CombinedNinjaFile: filepath.Join(dir, "out/combined.ninja"),
+	}
+	t.Setenv("ANDROID_BUILD_TOP", dir)
+
+	var emitted []CompilerCommandInfo
+	emit := func(info CompilerCommandInfo) {
+		emitted = append(emitted, info)
+	}
+	f := newLayerFilter(config, config.CombinedNinjaFile)
+	for _, info := range []CompilerCommandInfo{
+		{InputFiles: []string{"a.c"}, OutputFile: "out/target/a.o"},
+		{InputFiles: []string{"b.c"}, OutputFile: "out/soong/.intermediates/b/b.o"},
+		{InputFiles: []string{"c.c"}, OutputFile: "out/target/c.o"},
+		{InputFiles: []string{"c.c"}, OutputFile: "out/target/c.o"},
+	} {
+		f.add(info, emit)
+	}
+
+	// Soong commands pass at once, Kati ones wait for flush
+	if len(emitted) != 1 || emitted[0].Layer != LayerSoong {
+		t.Fatalf("Expected only the Soong command before flush, got %+v", emitted)
+	}
+	f.flush(emit)
+	if len(emitted) != 3 || emitted[1].Layer != LayerKati || emitted[2].InputFiles[0] != "c.c" {
+		t.Errorf("Expected the Kati commands once each after flush, got %+v", emitted)
+	}
+}
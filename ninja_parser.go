@@ -0,0 +1,899 @@
+package wrapper
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// NativeNinjaTool selects the built-in manifest parser instead of an external ninja binary
+const NativeNinjaTool = "native"
+
+// maxBindingDepth bounds recursive rule binding evaluation ($command referring to $flags ...)
+const maxBindingDepth = 64
+
+// NinjaManifest is a fully loaded ninja build manifest including all include/subninja files
+type NinjaManifest struct {
+	RootDir  string                // Directory ninja would run in, relative paths resolve against it
+	Files    []string              // Every manifest file that was loaded, in load order
+	Hashes   map[string]string     // SHA-256 of the content of every loaded file, by file system path
+	Edges    []*NinjaEdge          // Build edges in declaration order
+	Pools    map[string]*NinjaPool // Declared pools, including the built-in console pool
+	Defaults []string              // Targets listed in default statements
+
+	scope     *ninjaScope
+	outputs   map[string]*NinjaEdge
+	graph     *NinjaGraph
+	graphOnce sync.Once
+
+	onEdge  func(*NinjaEdge) // Receives the edges instead of Edges, see scanNinjaManifest
+	rebound bool             // A variable a scanned edge read changed after the edge
+}
+
+// NinjaPool is a pool declaration
+type NinjaPool struct {
+	Name  string
+	Depth int
+	File  string // Manifest that declared the pool, empty for built-in pools
+}
+
+// NinjaRule is a rule declaration, bindings are evaluated lazily per edge
+type NinjaRule struct {
+	Name     string
+	bindings map[string]evalString
+}
+
+// NinjaEdge is a build statement
+type NinjaEdge struct {
+	Rule            *NinjaRule
+	Outputs         []string // Explicit outputs
+	ImplicitOutputs []string // Outputs after |
+	Inputs          []string // Explicit inputs ($in)
+	ImplicitInputs  []string // Inputs after |
+	OrderOnlyInputs []string // Inputs after ||
+	Validations     []string // Inputs after |@
+	File            string   // Manifest that declared the edge
+
+	bindings map[string]string
+	scope    *ninjaScope
+	watch    bool // Record the scope variables the edge reads, see ninjaScope.watched
+}
+
+// ninjaScope holds variables and rules of a file; subninja creates a child scope
+type ninjaScope struct {
+	vars    map[string]string
+	rules   map[string]*NinjaRule
+	parent  *ninjaScope
+	watched map[string]bool // Variables scanned edges looked up here, defined or not
+}
+
+type evalToken struct {
+	text  string
+	isVar bool
+}
+
+// evalString is an unevaluated ninja string made of literals and variable references
+type evalString []evalToken
+
+var phonyRule = &NinjaRule{Name: "phony"}
+
+func newNinjaScope(parent *ninjaScope) *ninjaScope {
+	return &ninjaScope{
+		vars:   map[string]string{},
+		rules:  map[string]*NinjaRule{},
+		parent: parent,
+	}
+}
+
+func (s *ninjaScope) lookup(name string) string {
+	for scope := s; scope != nil; scope = scope.parent {
+		if value, ok := scope.vars[name]; ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// lookupWatched is lookup that marks name as watched in every scope it consults
+func (s *ninjaScope) lookupWatched(name string) string {
+	for scope := s; scope != nil; scope = scope.parent {
+		if scope.watched == nil {
+			scope.watched = map[string]bool{}
+		}
+		scope.watched[name] = true
+		if value, ok := scope.vars[name]; ok {
+			return value
+		}
+	}
+	return ""
+}
+
+func (s *ninjaScope) lookupRule(name string) *NinjaRule {
+	if name == phonyRule.Name {
+		return phonyRule
+	}
+	for scope := s; scope != nil; scope = scope.parent {
+		if rule, ok := scope.rules[name]; ok {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (s evalString) evaluate(lookup func(string) string) string {
+	if len(s) == 1 && !s[0].isVar {
+		return s[0].text
+	}
+	var b strings.Builder
+	for _, token := range s {
+		if token.isVar {
+			b.WriteString(lookup(token.text))
+		} else {
+			b.WriteString(token.text)
+		}
+	}
+	return b.String()
+}
+
+// LoadNinjaManifest parses a ninja file and everything it includes; rootDir is the
+// directory ninja would be started from (ANDROID_BUILD_TOP for soong manifests)
+func LoadNinjaManifest(ninjaFile, rootDir string) (*NinjaManifest, error) {
+	return LoadNinjaManifestContext(context.Background(), ninjaFile, rootDir)
+}
+
+// LoadNinjaManifestContext is LoadNinjaManifest that stops parsing once ctx is done
+func LoadNinjaManifestContext(ctx context.Context, ninjaFile, rootDir string) (*NinjaManifest, error) {
+	manifest := newNinjaManifest(rootDir)
+	if err := manifest.loadFile(ctx, ninjaFile, manifest.scope); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Loaded ninja manifest %s: %d files, %d edges\n", ninjaFile, len(manifest.Files), len(manifest.Edges))
+	return manifest, nil
+}
+
+// scanNinjaManifest parses a manifest like LoadNinjaManifestContext, but hands every edge to fn
+// as soon as it is parsed instead of keeping it, so the manifest is never held in memory. The
+// returned manifest has no edges; fn may be nil to only learn the files and pools.
+//
+// A command fn evaluates sees the variables defined so far, while ninja evaluates commands once
+// the whole manifest was read. The two only differ when a variable one of the commands read is
+// defined or changed after its edge, which sets rebound.
+func scanNinjaManifest(ctx context.Context, ninjaFile, rootDir string, fn func(*NinjaEdge)) (*NinjaManifest, error) {
+	manifest := newNinjaManifest(rootDir)
+	manifest.onEdge = func(*NinjaEdge) {}
+	if fn != nil {
+		manifest.onEdge = fn
+	}
+	if err := manifest.loadFile(ctx, ninjaFile, manifest.scope); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Scanned ninja manifest %s: %d files\n", ninjaFile, len(manifest.Files))
+	return manifest, nil
+}
+
+func newNinjaManifest(rootDir string) *NinjaManifest {
+	return &NinjaManifest{
+		RootDir: rootDir,
+		Hashes:  map[string]string{},
+		Pools: map[string]*NinjaPool{
+			"console": {Name: "console", Depth: 1},
+		},
+		scope:   newNinjaScope(nil),
+		outputs: map[string]*NinjaEdge{},
+	}
+}
+
+// resolve returns the file system location of a manifest path
+func (m *NinjaManifest) resolve(file string) string {
+	if filepath.IsAbs(file) || m.RootDir == "" {
+		return file
+	}
+	return filepath.Join(m.RootDir, file)
+}
+
+func (m *NinjaManifest) loadFile(ctx context.Context, file string, scope *ninjaScope) error {
+	data, err := os.ReadFile(m.resolve(file))
+	if err != nil {
+		return fmt.Errorf("failed to read ninja file %s: %v", file, err)
+	}
+	m.Files = append(m.Files, file)
+	sum := sha256.Sum256(data)
+	m.Hashes[m.resolve(file)] = hex.EncodeToString(sum[:])
+
+	lexer := &ninjaLexer{file: file, data: data}
+	return m.parse(ctx, lexer, scope)
+}
+
+// EdgeForOutput returns the edge producing path, or nil for source files and unknown paths
+func (m *NinjaManifest) EdgeForOutput(output string) *NinjaEdge {
+	return m.outputs[canonicalizeNinjaPath(output)]
+}
+
+// Targets returns every output declared in the manifest, in declaration order
+func (m *NinjaManifest) Targets() []string {
+	var targets []string
+	for _, edge := range m.Edges {
+		targets = append(targets, edge.Outputs...)
+		targets = append(targets, edge.ImplicitOutputs...)
+	}
+	return targets
+}
+
+// Variable returns the value of a top-level variable
+func (m *NinjaManifest) Variable(name string) string {
+	return m.scope.lookup(name)
+}
+
+// IsPhony reports whether the edge uses the built-in phony rule
+func (e *NinjaEdge) IsPhony() bool {
+	return e.Rule == phonyRule
+}
+
+// AllInputs returns explicit, implicit and order-only inputs in ninja's order
+func (e *NinjaEdge) AllInputs() []string {
+	inputs := make([]string, 0, len(e.Inputs)+len(e.ImplicitInputs)+len(e.OrderOnlyInputs))
+	inputs = append(inputs, e.Inputs...)
+	inputs = append(inputs, e.ImplicitInputs...)
+	return append(inputs, e.OrderOnlyInputs...)
+}
+
+// AllOutputs returns explicit and implicit outputs
+func (e *NinjaEdge) AllOutputs() []string {
+	outputs := make([]string, 0, len(e.Outputs)+len(e.ImplicitOutputs))
+	outputs = append(outputs, e.Outputs...)
+	return append(outputs, e.ImplicitOutputs...)
+}
+
+// Command returns the fully evaluated command of the edge
+func (e *NinjaEdge) Command() string {
+	return e.Binding("command")
+}
+
+// Pool returns the pool the edge runs in, empty for the default pool
+func (e *NinjaEdge) Pool() string {
+	return e.Binding("pool")
+}
+
+// Binding evaluates a variable as seen by the edge: $in/$out, edge bindings,
+// rule bindings and finally the enclosing file scopes
+func (e *NinjaEdge) Binding(name string) string {
+	return e.lookup(name, 0)
+}
+
+func (e *NinjaEdge) lookup(name string, depth int) string {
+	switch name {
+	case "in":
+		return joinShellEscaped(e.Inputs, " ")
+	case "in_newline":
+		return joinShellEscaped(e.Inputs, "\n")
+	case "out":
+		return joinShellEscaped(e.Outputs, " ")
+	}
+
+	if value, ok := e.bindings[name]; ok {
+		return value
+	}
+
+	if e.Rule != nil {
+		if binding, ok := e.Rule.bindings[name]; ok {
+			if depth >= maxBindingDepth {
+				return ""
+			}
+			return binding.evaluate(func(v string) string {
+				return e.lookup(v, depth+1)
+			})
+		}
+	}
+
+	if e.watch {
+		return e.scope.lookupWatched(name)
+	}
+	return e.scope.lookup(name)
+}
+
+// joinShellEscaped joins paths the way ninja expands $in and $out
+func joinShellEscaped(paths []string, sep string) string {
+	escaped := make([]string, len(paths))
+	for i, p := range paths {
+		escaped[i] = ninjaShellEscape(p)
+	}
+	return strings.Join(escaped, sep)
+}
+
+// EdgesForTargets returns the non-phony edges needed to build targets, inputs before the
+// edges consuming them, each edge once; unknown targets are returned separately
+func (m *NinjaManifest) EdgesForTargets(targets []string) ([]*NinjaEdge, []string) {
+	byTarget, unknown := m.EdgesByTarget(targets)
+	var edges []*NinjaEdge
+	for _, targetEdges := range byTarget {
+		edges = append(edges, targetEdges...)
+	}
+	return edges, unknown
+}
+
+// EdgesByTarget is EdgesForTargets with the edges split by the target that first needs them,
+// the way ninja -t compdb-targets emits them: an edge shared by several targets belongs to the
+// first one
+func (m *NinjaManifest) EdgesByTarget(targets []string) ([][]*NinjaEdge, []string) {
+	byTarget := make([][]*NinjaEdge, len(targets))
+	var unknown []string
+	seen := map[*NinjaEdge]bool{}
+
+	var visit func(i int, edge *NinjaEdge)
+	visit = func(i int, edge *NinjaEdge) {
+		if edge == nil || seen[edge] {
+			return
+		}
+		seen[edge] = true
+		for _, input := range edge.AllInputs() {
+			visit(i, m.outputs[input])
+		}
+		if !edge.IsPhony() {
+			byTarget[i] = append(byTarget[i], edge)
+		}
+	}
+
+	for i, target := range targets {
+		edge := m.EdgeForOutput(target)
+		if edge == nil {
+			unknown = append(unknown, target)
+			continue
+		}
+		visit(i, edge)
+	}
+
+	return byTarget, unknown
+}
+
+// CompileCommands renders edges like `ninja -t compdb`, skipping phony and input-less edges
+func (m *NinjaManifest) CompileCommands(edges []*NinjaEdge) []CompileCommand {
+	entries := make([]CompileCommand, 0, len(edges))
+	for _, edge := range edges {
+		if entry, ok := edgeCompileCommand(m.RootDir, edge); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// edgeCompileCommand renders one edge like `ninja -t compdb` run in rootDir. Phony and
+// input-less edges have no entry.
+func edgeCompileCommand(rootDir string, edge *NinjaEdge) (CompileCommand, bool) {
+	inputs := edge.AllInputs()
+	if edge.IsPhony() || len(inputs) == 0 {
+		return CompileCommand{}, false
+	}
+
+	entry := CompileCommand{
+		Directory: rootDir,
+		Command:   edge.Command(),
+		File:      inputs[0],
+	}
+	if outputs := edge.AllOutputs(); len(outputs) > 0 {
+		entry.Output = outputs[0]
+	}
+	return entry, true
+}
+
+// ninjaShellEscape single-quotes a path unless it only has characters ninja knows are shell safe
+func ninjaShellEscape(p string) string {
+	safe := true
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '_' || c == '+' || c == '-' || c == '.' || c == '/') {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return p
+	}
+	return "'" + strings.ReplaceAll(p, "'", `'\''`) + "'"
+}
+
+// canonicalizeNinjaPath removes redundant ./, ../ and separators like ninja's CanonicalizePath
+func canonicalizeNinjaPath(p string) string {
+	if p == "" {
+		return p
+	}
+	return path.Clean(p)
+}
+
+func (m *NinjaManifest) parse(ctx context.Context, l *ninjaLexer, scope *ninjaScope) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("parsing %s interrupted: %w", l.file, err)
+		}
+
+		indent := l.skipIndent()
+		if l.eof() {
+			return nil
+		}
+
+		switch l.peek() {
+		case '\n', '\r':
+			if err := l.expectNewline(); err != nil {
+				return err
+			}
+			continue
+		case '#':
+			l.skipLine()
+			continue
+		}
+
+		if indent > 0 {
+			return l.errorf("unexpected indent")
+		}
+
+		keyword := l.readIdent()
+		if keyword == "" {
+			return l.errorf("expected keyword or variable name, got %q", l.peek())
+		}
+
+		var err error
+		switch keyword {
+		case "rule":
+			err = m.parseRule(l, scope)
+		case "build":
+			err = m.parseEdge(l, scope)
+		case "default":
+			err = m.parseDefault(l, scope)
+		case "pool":
+			err = m.parsePool(l, scope)
+		case "include", "subninja":
+			err = m.parseInclude(ctx, l, scope, keyword == "subninja")
+		default:
+			var value evalString
+			value, err = l.readAssignment()
+			if err == nil {
+				if scope.watched[keyword] {
+					m.rebound = true
+				}
+				scope.vars[keyword] = value.evaluate(scope.lookup)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (m *NinjaManifest) parseRule(l *ninjaLexer, scope *ninjaScope) error {
+	l.skipSpaces()
+	name := l.readIdent()
+	if name == "" {
+		return l.errorf("expected rule name")
+	}
+	if err := l.expectNewline(); err != nil {
+		return err
+	}
+	if _, ok := scope.rules[name]; ok || name == phonyRule.Name {
+		return l.errorf("duplicate rule '%s'", name)
+	}
+
+	rule := &NinjaRule{Name: name, bindings: map[string]evalString{}}
+	err := l.readBindings(func(key string, value evalString) {
+		rule.bindings[key] = value
+	})
+	if err != nil {
+		return err
+	}
+
+	scope.rules[name] = rule
+	return nil
+}
+
+func (m *NinjaManifest) parsePool(l *ninjaLexer, scope *ninjaScope) error {
+	l.skipSpaces()
+	name := l.readIdent()
+	if name == "" {
+		return l.errorf("expected pool name")
+	}
+	if err := l.expectNewline(); err != nil {
+		return err
+	}
+
+	pool := &NinjaPool{Name: name, File: l.file}
+	var depthErr error
+	err := l.readBindings(func(key string, value evalString) {
+		if key != "depth" {
+			return
+		}
+		depth, err := strconv.Atoi(value.evaluate(scope.lookup))
+		if err != nil || depth < 0 {
+			depthErr = l.errorf("invalid pool depth for '%s'", name)
+			return
+		}
+		pool.Depth = depth
+	})
+	if err != nil {
+		return err
+	}
+	if depthErr != nil {
+		return depthErr
+	}
+
+	m.Pools[name] = pool
+	return nil
+}
+
+func (m *NinjaManifest) parseDefault(l *ninjaLexer, scope *ninjaScope) error {
+	paths, err := l.readPaths()
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return l.errorf("expected target name")
+	}
+	for _, p := range paths {
+		m.Defaults = append(m.Defaults, canonicalizeNinjaPath(p.evaluate(scope.lookup)))
+	}
+	return l.expectNewline()
+}
+
+func (m *NinjaManifest) parseInclude(ctx context.Context, l *ninjaLexer, scope *ninjaScope, newScope bool) error {
+	l.skipSpaces()
+	file, err := l.readEvalString(true)
+	if err != nil {
+		return err
+	}
+	if len(file) == 0 {
+		return l.errorf("expected path")
+	}
+	if err := l.expectNewline(); err != nil {
+		return err
+	}
+
+	childScope := scope
+	if newScope {
+		childScope = newNinjaScope(scope)
+	}
+	return m.loadFile(ctx, file.evaluate(scope.lookup), childScope)
+}
+
+func (m *NinjaManifest) parseEdge(l *ninjaLexer, scope *ninjaScope) error {
+	outs, err := l.readPaths()
+	if err != nil {
+		return err
+	}
+	if len(outs) == 0 {
+		return l.errorf("expected path")
+	}
+
+	var implicitOuts []evalString
+	if l.consume("|") {
+		if implicitOuts, err = l.readPaths(); err != nil {
+			return err
+		}
+	}
+
+	if !l.consume(":") {
+		return l.errorf("expected ':'")
+	}
+	l.skipSpaces()
+
+	ruleName := l.readIdent()
+	if ruleName == "" {
+		return l.errorf("expected build command name")
+	}
+	rule := scope.lookupRule(ruleName)
+	if rule == nil {
+		return l.errorf("unknown build rule '%s'", ruleName)
+	}
+
+	ins, err := l.readPaths()
+	if err != nil {
+		return err
+	}
+
+	var implicitIns, orderOnlyIns, validations []evalString
+	for {
+		switch {
+		case l.consume("||"):
+			orderOnlyIns, err = l.readPaths()
+		case l.consume("|@"):
+			validations, err = l.readPaths()
+		case l.consume("|"):
+			implicitIns, err = l.readPaths()
+		default:
+			err = l.expectNewline()
+			if err != nil {
+				return err
+			}
+			return m.finishEdge(l, scope, rule, outs, implicitOuts, ins, implicitIns, orderOnlyIns, validations)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (m *NinjaManifest) finishEdge(l *ninjaLexer, scope *ninjaScope, rule *NinjaRule,
+	outs, implicitOuts, ins, implicitIns, orderOnlyIns, validations []evalString) error {
+	edge := &NinjaEdge{Rule: rule, File: l.file, scope: scope}
+
+	err := l.readBindings(func(key string, value evalString) {
+		if edge.bindings == nil {
+			edge.bindings = map[string]string{}
+		}
+		edge.bindings[key] = value.evaluate(scope.lookup)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Paths see edge bindings before the enclosing scope, but not rule bindings
+	lookup := func(name string) string {
+		if value, ok := edge.bindings[name]; ok {
+			return value
+		}
+		return scope.lookup(name)
+	}
+	evalPaths := func(paths []evalString) []string {
+		if len(paths) == 0 {
+			return nil
+		}
+		result := make([]string, len(paths))
+		for i, p := range paths {
+			result[i] = canonicalizeNinjaPath(p.evaluate(lookup))
+		}
+		return result
+	}
+
+	edge.Outputs = evalPaths(outs)
+	edge.ImplicitOutputs = evalPaths(implicitOuts)
+	edge.Inputs = evalPaths(ins)
+	edge.ImplicitInputs = evalPaths(implicitIns)
+	edge.OrderOnlyInputs = evalPaths(orderOnlyIns)
+	edge.Validations = evalPaths(validations)
+
+	if m.onEdge != nil {
+		edge.watch = true
+		m.onEdge(edge)
+		return nil
+	}
+
+	for _, output := range edge.AllOutputs() {
+		if _, ok := m.outputs[output]; ok {
+			// ninja warns and keeps the first producer for duplicate outputs
+			continue
+		}
+		m.outputs[output] = edge
+	}
+
+	m.Edges = append(m.Edges, edge)
+	return nil
+}
+
+// ninjaLexer tokenizes a single manifest file
+type ninjaLexer struct {
+	file string
+	data []byte
+	pos  int
+}
+
+func (l *ninjaLexer) errorf(format string, args ...interface{}) error {
+	line := 1 + bytes.Count(l.data[:l.pos], []byte("\n"))
+	return fmt.Errorf("%s:%d: %s", l.file, line, fmt.Sprintf(format, args...))
+}
+
+func (l *ninjaLexer) eof() bool {
+	return l.pos >= len(l.data)
+}
+
+func (l *ninjaLexer) peek() byte {
+	if l.eof() {
+		return 0
+	}
+	return l.data[l.pos]
+}
+
+func (l *ninjaLexer) consume(s string) bool {
+	if bytes.HasPrefix(l.data[l.pos:], []byte(s)) {
+		l.pos += len(s)
+		l.skipSpaces()
+		return true
+	}
+	return false
+}
+
+// skipIndent consumes leading spaces of a line and returns how many there were
+func (l *ninjaLexer) skipIndent() int {
+	start := l.pos
+	for !l.eof() && l.data[l.pos] == ' ' {
+		l.pos++
+	}
+	return l.pos - start
+}
+
+// skipSpaces consumes spaces and $-escaped line continuations
+func (l *ninjaLexer) skipSpaces() {
+	for !l.eof() {
+		switch {
+		case l.data[l.pos] == ' ':
+			l.pos++
+		case bytes.HasPrefix(l.data[l.pos:], []byte("$\n")):
+			l.pos += 2
+		case bytes.HasPrefix(l.data[l.pos:], []byte("$\r\n")):
+			l.pos += 3
+		default:
+			return
+		}
+	}
+}
+
+func (l *ninjaLexer) skipLine() {
+	for !l.eof() && l.data[l.pos] != '\n' {
+		l.pos++
+	}
+	if !l.eof() {
+		l.pos++
+	}
+}
+
+func (l *ninjaLexer) expectNewline() error {
+	l.skipSpaces()
+	switch {
+	case l.eof():
+		return nil
+	case l.data[l.pos] == '\n':
+		l.pos++
+		return nil
+	case bytes.HasPrefix(l.data[l.pos:], []byte("\r\n")):
+		l.pos += 2
+		return nil
+	}
+	return l.errorf("expected newline, got %q", l.data[l.pos])
+}
+
+func isNinjaIdentChar(c byte, allowDot bool) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '-' || (allowDot && c == '.')
+}
+
+// readIdent reads a rule, pool, keyword or variable name
+func (l *ninjaLexer) readIdent() string {
+	start := l.pos
+	for !l.eof() && isNinjaIdentChar(l.data[l.pos], true) {
+		l.pos++
+	}
+	return string(l.data[start:l.pos])
+}
+
+// readAssignment reads "= value" following a variable name
+func (l *ninjaLexer) readAssignment() (evalString, error) {
+	l.skipSpaces()
+	if !l.consume("=") {
+		return nil, l.errorf("expected '='")
+	}
+	value, err := l.readEvalString(false)
+	if err != nil {
+		return nil, err
+	}
+	return value, l.expectNewline()
+}
+
+// readBindings reads indented "key = value" lines following a rule, build or pool statement
+func (l *ninjaLexer) readBindings(fn func(key string, value evalString)) error {
+	for {
+		start := l.pos
+		indent := l.skipIndent()
+		if l.peek() == '#' {
+			l.skipLine()
+			continue
+		}
+		if indent == 0 || l.eof() || !isNinjaIdentChar(l.peek(), true) {
+			l.pos = start
+			return nil
+		}
+
+		key := l.readIdent()
+		value, err := l.readAssignment()
+		if err != nil {
+			return err
+		}
+		fn(key, value)
+	}
+}
+
+// readPaths reads space separated paths until ':', '|' or the end of the line
+func (l *ninjaLexer) readPaths() ([]evalString, error) {
+	var paths []evalString
+	for {
+		l.skipSpaces()
+		p, err := l.readEvalString(true)
+		if err != nil {
+			return nil, err
+		}
+		if len(p) == 0 {
+			return paths, nil
+		}
+		paths = append(paths, p)
+	}
+}
+
+// readEvalString reads a value (to end of line) or a path (to a separator), resolving $ escapes
+func (l *ninjaLexer) readEvalString(isPath bool) (evalString, error) {
+	var tokens evalString
+	var literal []byte
+
+	flush := func() {
+		if len(literal) > 0 {
+			tokens = append(tokens, evalToken{text: string(literal)})
+			literal = literal[:0]
+		}
+	}
+
+	for !l.eof() {
+		c := l.data[l.pos]
+		switch {
+		case c == '\n' || (c == '\r' && bytes.HasPrefix(l.data[l.pos:], []byte("\r\n"))):
+			flush()
+			return tokens, nil
+		case isPath && (c == ' ' || c == ':' || c == '|'):
+			flush()
+			return tokens, nil
+		case c != '$':
+			literal = append(literal, c)
+			l.pos++
+			continue
+		}
+
+		// Handle $ escapes
+		l.pos++
+		if l.eof() {
+			return nil, l.errorf("unexpected end of file after '$'")
+		}
+		c = l.data[l.pos]
+		switch {
+		case c == '$' || c == ' ' || c == ':':
+			literal = append(literal, c)
+			l.pos++
+		case c == '\n' || bytes.HasPrefix(l.data[l.pos:], []byte("\r\n")):
+			if c == '\r' {
+				l.pos++
+			}
+			l.pos++
+			for !l.eof() && l.data[l.pos] == ' ' {
+				l.pos++
+			}
+		case c == '{':
+			end := bytes.IndexByte(l.data[l.pos:], '}')
+			if end < 0 {
+				return nil, l.errorf("unterminated variable reference")
+			}
+			name := string(l.data[l.pos+1 : l.pos+end])
+			for i := 0; i < len(name); i++ {
+				if !isNinjaIdentChar(name[i], true) {
+					return nil, l.errorf("bad character in variable name %q", name)
+				}
+			}
+			flush()
+			tokens = append(tokens, evalToken{text: name, isVar: true})
+			l.pos += end + 1
+		case isNinjaIdentChar(c, false):
+			start := l.pos
+			for !l.eof() && isNinjaIdentChar(l.data[l.pos], false) {
+				l.pos++
+			}
+			flush()
+			tokens = append(tokens, evalToken{text: string(l.data[start:l.pos]), isVar: true})
+		default:
+			return nil, l.errorf("bad $-escape (literal $ must be written as $$)")
+		}
+	}
+
+	flush()
+	return tokens, nil
+}
@@ -0,0 +1,285 @@
+package wrapper
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeNinjaFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	return dir
+}
+
+func TestLoadNinjaManifest(t *testing.T) {
+	dir := writeNinjaFiles(t, map[string]string{
+		"build.ninja": `# top-level manifest
+cflags = -O2
+pool highmem_pool
+  depth = 4
+
+rule cc
+  command = clang $cflags $extra -c $in -o $out
+  depfile = $out.d
+  pool = highmem_pool
+
+build out/foo.o | out/foo.o.d: cc src/foo.c | src/foo.h || gen $
+    |@ out/check
+  extra = -DFOO
+build out/bar$ baz.o: cc src/bar$$.c
+build gen: phony
+default out/foo.o
+
+include vars.ninja
+subninja sub/sub.ninja
+build after.o: cc after.c
+`,
+		"vars.ninja": "cflags = -O3\n",
+		"sub/sub.ninja": `cflags = -Os
+rule link
+  command = ld ${cflags} $in -o $out
+build out/app: link out/foo.o
+build out/sub.o: cc sub.c
+`,
+	})
+
+	manifest, err := LoadNinjaManifest("build.ninja", dir)
+	if err != nil {
+		t.Fatalf("LoadNinjaManifest failed: %v", err)
+	}
+
+	if len(manifest.Files) != 3 {
+		t.Errorf("Expected 3 loaded files, got %v", manifest.Files)
+	}
+
+	if pool := manifest.Pools["highmem_pool"]; pool == nil || pool.Depth != 4 {
+		t.Errorf("Expected highmem_pool with depth 4, got %+v", pool)
+	}
+
+	foo := manifest.EdgeForOutput("out/foo.o")
+	if foo == nil {
+		t.Fatalf("Expected edge for out/foo.o")
+	}
+	if got, want := foo.Command(), "clang -O3 -DFOO -c src/foo.c -o out/foo.o"; got != want {
+		t.Errorf("Expected command %q, got %q", want, got)
+	}
+	if got := foo.Binding("depfile"); got != "out/foo.o.d" {
+		t.Errorf("Expected depfile out/foo.o.d, got %q", got)
+	}
+	if got := foo.Pool(); got != "highmem_pool" {
+		t.Errorf("Expected pool highmem_pool, got %q", got)
+	}
+	if !reflect.DeepEqual(foo.ImplicitOutputs, []string{"out/foo.o.d"}) ||
+		!reflect.DeepEqual(foo.ImplicitInputs, []string{"src/foo.h"}) ||
+		!reflect.DeepEqual(foo.OrderOnlyInputs, []string{"gen"}) ||
+		!reflect.DeepEqual(foo.Validations, []string{"out/check"}) {
+		t.Errorf("Unexpected edge paths: %+v", foo)
+	}
+
+	bar := manifest.EdgeForOutput("out/bar baz.o")
+	if bar == nil {
+		t.Fatalf("Expected edge for escaped output path")
+	}
+	if got, want := bar.Command(), "clang -O3  -c 'src/bar$.c' -o 'out/bar baz.o'"; got != want {
+		t.Errorf("Expected command %q, got %q", want, got)
+	}
+
+	// Rule bindings read file variables at evaluation time, so the included override wins
+	if got := manifest.EdgeForOutput("after.o").Command(); !strings.Contains(got, "-O3") {
+		t.Errorf("Expected include to override cflags, got %q", got)
+	}
+
+	// subninja gets a child scope that does not leak into the parent
+	if got := manifest.EdgeForOutput("out/app").Command(); got != "ld -Os out/foo.o -o out/app" {
+		t.Errorf("Unexpected subninja command %q", got)
+	}
+	if got := manifest.EdgeForOutput("out/sub.o").Command(); !strings.Contains(got, "-Os") {
+		t.Errorf("Expected subninja to see parent rules with its own cflags, got %q", got)
+	}
+	if got := manifest.Variable("cflags"); got != "-O3" {
+		t.Errorf("Expected top-level cflags -O3, got %q", got)
+	}
+
+	if !manifest.EdgeForOutput("gen").IsPhony() {
+		t.Errorf("Expected gen to be phony")
+	}
+	if !reflect.DeepEqual(manifest.Defaults, []string{"out/foo.o"}) {
+		t.Errorf("Unexpected defaults %v", manifest.Defaults)
+	}
+}
+
+func TestLoadNinjaManifestErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		errText string
+	}{
+		{"unknown rule", "build a: missing b\n", "unknown build rule"},
+		{"duplicate rule", "rule a\n  command = x\nrule a\n  command = y\n", "duplicate rule"},
+		{"bad escape", "x = $!\n", "bad $-escape"},
+		{"missing colon", "rule cc\n  command = x\nbuild a cc b\n", "expected ':'"},
+		{"bad pool depth", "pool p\n  depth = many\n", "invalid pool depth"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeNinjaFiles(t, map[string]string{"build.ninja": tt.content})
+			_, err := LoadNinjaManifest("build.ninja", dir)
+			if err == nil || !strings.Contains(err.Error(), tt.errText) {
+				t.Errorf("Expected error containing %q, got %v", tt.errText, err)
+			}
+		})
+	}
+}
+
+func TestNinjaManifestCompileCommands(t *testing.T) {
+	dir := writeNinjaFiles(t, map[string]string{
+		"build.ninja": `rule cc
+  command = clang -c $in -o $out
+rule ar
+  command = ar rcs $out $in
+build a.o: cc a.c
+build b.o: cc b.c
+build unused.o: cc unused.c
+build liba.a: ar a.o b.o
+build liba: phony liba.a
+`,
+	})
+
+	manifest, err := LoadNinjaManifest("build.ninja", dir)
+	if err != nil {
+		t.Fatalf("LoadNinjaManifest failed: %v", err)
+	}
+
+	edges, unknown := manifest.EdgesForTargets([]string{"liba", "missing"})
+	if !reflect.DeepEqual(unknown, []string{"missing"}) {
+		t.Errorf("Expected unknown target 'missing', got %v", unknown)
+	}
+
+	entries := manifest.CompileCommands(edges)
+	var outputs []string
+	for _, entry := range entries {
+		outputs = append(outputs, entry.Output)
+		if entry.Directory != dir {
+			t.Errorf("Expected directory %q, got %q", dir, entry.Directory)
+		}
+	}
+	if want := []string{"a.o", "b.o", "liba.a"}; !reflect.DeepEqual(outputs, want) {
+		t.Errorf("Expected outputs %v, got %v", want, outputs)
+	}
+	if entries[0].File != "a.c" || entries[0].Command != "clang -c a.c -o a.o" {
+		t.Errorf("Unexpected first entry %+v", entries[0])
+	}
+
+	// a.o is built first for a.o itself, liba gets the rest
+	byTarget, _ := manifest.EdgesByTarget([]string{"a.o", "liba"})
+	if len(byTarget) != 2 || len(byTarget[0]) != 1 || len(byTarget[1]) != 2 {
+		t.Errorf("Expected edges split 1/2 between a.o and liba, got %v", byTarget)
+	}
+
+	if got := len(manifest.CompileCommands(manifest.Edges)); got != 4 {
+		t.Errorf("Expected 4 entries for the whole manifest, got %d", got)
+	}
+	if got := len(manifest.Targets()); got != 5 {
+		t.Errorf("Expected 5 targets, got %d", got)
+	}
+}
+
+func TestGetCompilationDatabaseNative(t *testing.T) {
+	dir := writeNinjaFiles(t, map[string]string{
+		"build.ninja": `rule cc
+  command = clang -Iinclude -c $in -o $out
+build out/hello/main.o: cc hello/main.c
+build hello: phony out/hello/main.o
+`,
+	})
+	t.Setenv("ANDROID_BUILD_TOP", dir)
+
+	config := WrapperConfig{NinjaTool: NativeNinjaTool}
+	commands, _, _ := getCompilationDatabase(context.Background(), config, filepath.Join(dir, "build.ninja"), []string{"hello"})
+	if len(commands.Commands) != 1 {
+		t.Fatalf("Expected 1 command, got %d", len(commands.Commands))
+	}
+
+	info := commands.Commands[0]
+	if info.CompilerType != "clang" || !reflect.DeepEqual(info.InputFiles, []string{"hello/main.c"}) {
+		t.Errorf("Unexpected command %+v", info)
+	}
+	if !reflect.DeepEqual(info.Includes, []string{"include"}) {
+		t.Errorf("Expected includes [include], got %v", info.Includes)
+	}
+	if info.BuildTarget != "hello" {
+		t.Errorf("Expected the command to be attributed to hello, got %q", info.BuildTarget)
+	}
+
+	targets := getNinjaTargets(context.Background(), config, filepath.Join(dir, "build.ninja"))
+	if len(targets) != 2 {
+		t.Errorf("Expected 2 targets, got %v", targets)
+	}
+}
+
+func TestLoadNinjaManifestContextCancelled(t *testing.T) {
+	dir := writeNinjaFiles(t, map[string]string{
+		"build.ninja": "rule cc\n  command = clang -c $in -o $out\nbuild a.o: cc a.c\n",
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := LoadNinjaManifestContext(ctx, "build.ninja", dir)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestScanNinjaManifest(t *testing.T) {
+	dir := writeNinjaFiles(t, map[string]string{
+		"build.ninja": `cflags = -O2
+rule cc
+  command = clang $cflags -c $in -o $out
+build a.o: cc a.c
+subninja sub.ninja
+`,
+		"sub.ninja": "build b.o: cc b.c\n",
+	})
+
+	var commands []string
+	manifest, err := scanNinjaManifest(context.Background(), "build.ninja", dir, func(edge *NinjaEdge) {
+		commands = append(commands, edge.Command())
+	})
+	if err != nil {
+		t.Fatalf("scanNinjaManifest failed: %v", err)
+	}
+	if want := []string{"clang -O2 -c a.c -o a.o", "clang -O2 -c b.c -o b.o"}; !reflect.DeepEqual(commands, want) {
+		t.Errorf("Expected commands %v, got %v", want, commands)
+	}
+	if len(manifest.Edges) != 0 || manifest.rebound {
+		t.Errorf("Expected no retained edges and no rebound variables, got %d edges", len(manifest.Edges))
+	}
+	if len(manifest.Hashes) != 2 || manifest.Hashes[filepath.Join(dir, "sub.ninja")] == "" {
+		t.Errorf("Expected the content hash of both files, got %v", manifest.Hashes)
+	}
+
+	// ninja evaluates commands after reading everything, so a later cflags changes a.o
+	dir = writeNinjaFiles(t, map[string]string{
+		"build.ninja": "rule cc\n  command = clang $cflags -c $in -o $out\nbuild a.o: cc a.c\ncflags = -O3\n",
+	})
+	manifest, err = scanNinjaManifest(context.Background(), "build.ninja", dir, func(edge *NinjaEdge) { edge.Command() })
+	if err != nil || !manifest.rebound {
+		t.Errorf("Expected a rebound variable to be detected: %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package wrapper
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Pools soong_ui declares in combined-<product>.ninja for the Kati and Soong manifests
+const (
+	highmemPool = "highmem_pool"
+	localPool   = "local_pool"
+)
+
+// ninjaPoolDecl is a pool statement, with its depth as written in the manifest
+type ninjaPoolDecl struct {
+	name  string
+	depth string
+}
+
+func (p ninjaPoolDecl) String() string {
+	return fmt.Sprintf("pool %s\n  depth = %s\n", p.name, p.depth)
+}
+
+// scanNinjaPools reads the top-level statements of ninjaFile, passing pool declarations to pool
+// and every other line to other. Unless wholeFile is set scanning stops at the first rule or
+// build statement: Blueprint and Kati declare their pools ahead of those, and their manifests
+// run into gigabytes.
+func scanNinjaPools(ninjaFile string, wholeFile bool, pool func(ninjaPoolDecl), other func(line string)) error {
+	file, err := os.Open(ninjaFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var current *ninjaPoolDecl
+	flush := func() {
+		if current != nil {
+			pool(*current)
+			current = nil
+		}
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if current != nil && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			if key, value, ok := strings.Cut(strings.TrimSpace(line), "="); ok && strings.TrimSpace(key) == "depth" {
+				current.depth = strings.TrimSpace(value)
+			}
+			continue
+		}
+		flush()
+
+		if name, ok := strings.CutPrefix(line, "pool "); ok {
+			current = &ninjaPoolDecl{name: strings.TrimSpace(name), depth: "1"}
+			continue
+		}
+		if !wholeFile && (strings.HasPrefix(line, "rule ") || strings.HasPrefix(line, "build ")) {
+			break
+		}
+		if other != nil {
+			other(line)
+		}
+	}
+	flush()
+
+	return scanner.Err()
+}
+
+// includedNinjaFiles returns the subninja and include paths among lines, skipping paths that
+// need variable expansion
+func includedNinjaFiles(lines []string) []string {
+	var files []string
+	for _, line := range lines {
+		for _, keyword := range []string{"subninja ", "include "} {
+			if file, ok := strings.CutPrefix(line, keyword); ok && !strings.Contains(file, "$") {
+				files = append(files, strings.TrimSpace(file))
+			}
+		}
+	}
+	return files
+}
+
+// defaultNinjaPools returns the pools soong_ui would declare, highmem_pool at HighmemParallel
+// depth, one job at a time when unset
+func defaultNinjaPools(config WrapperConfig) []ninjaPoolDecl {
+	highmem := 1
+	if config.HighmemParallel > 0 {
+		highmem = config.HighmemParallel
+	}
+	return []ninjaPoolDecl{
+		{name: highmemPool, depth: fmt.Sprint(highmem)},
+		{name: localPool, depth: fmt.Sprint(runtime.NumCPU())},
+	}
+}
+
+// synthesizeNinjaManifest returns the top-level manifest commands are extracted with. The
+// combined manifest is copied with its pool statements regenerated, the Soong manifest alone is
+// subninja'd. Either way the default pools the included manifests don't declare themselves are
+// added, so edges referencing them load.
+func synthesizeNinjaManifest(config WrapperConfig, ninjaFile string) (string, error) {
+	declared := map[string]bool{}
+	var pools []ninjaPoolDecl
+	var lines []string
+
+	if config.CombinedNinjaFile != "" && ninjaFile == config.CombinedNinjaFile {
+		err := scanNinjaPools(ninjaFile, true, func(pool ninjaPoolDecl) {
+			if pool.name == highmemPool && config.HighmemParallel > 0 {
+				pool.depth = fmt.Sprint(config.HighmemParallel)
+			}
+			declared[pool.name] = true
+			pools = append(pools, pool)
+		}, func(line string) {
+			lines = append(lines, line)
+		})
+		if err != nil {
+			return "", err
+		}
+	} else {
+		lines = []string{"subninja " + ninjaFile}
+	}
+
+	// Pools of the included Kati and Soong manifests must not be declared twice. Ninja resolves
+	// relative includes against the directory it runs in, the source root.
+	root := os.Getenv("ANDROID_BUILD_TOP")
+	for _, file := range includedNinjaFiles(lines) {
+		if !filepath.IsAbs(file) && root != "" {
+			file = filepath.Join(root, file)
+		}
+		err := scanNinjaPools(file, false, func(pool ninjaPoolDecl) {
+			declared[pool.name] = true
+		}, nil)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+
+	var defaults []ninjaPoolDecl
+	for _, pool := range defaultNinjaPools(config) {
+		if !declared[pool.name] {
+			defaults = append(defaults, pool)
+		}
+	}
+
+	var b strings.Builder
+	for _, pool := range append(defaults, pools...) {
+		b.WriteString(pool.String())
+	}
+	for _, line := range lines {
+		b.WriteString(line + "\n")
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,117 @@
+package wrapper
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestScanNinjaPools(t *testing.T) {
+	dir := writeNinjaFiles(t, map[string]string{
+		"build.ninja": `builddir = out
+pool local_pool
+  depth = 72
+
+pool highmem_pool
+  depth = $highmem
+rule cc
+  command = clang -c $in -o $out
+pool late_pool
+  depth = 2
+`,
+	})
+	ninjaFile := filepath.Join(dir, "build.ninja")
+
+	var pools []ninjaPoolDecl
+	collect := func(pool ninjaPoolDecl) { pools = append(pools, pool) }
+
+	// Declarations after the first rule are left unread
+	if err := scanNinjaPools(ninjaFile, false, collect, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []ninjaPoolDecl{{name: "local_pool", depth: "72"}, {name: "highmem_pool", depth: "$highmem"}}
+	if !reflect.DeepEqual(pools, want) {
+		t.Errorf("Expected %v, got %v", want, pools)
+	}
+
+	pools = nil
+	var lines []string
+	if err := scanNinjaPools(ninjaFile, true, collect, func(line string) { lines = append(lines, line) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(pools) != 3 || pools[2].name != "late_pool" {
+		t.Errorf("Expected late_pool to be read from the whole file, got %v", pools)
+	}
+	if strings.Contains(strings.Join(lines, "\n"), "pool") || lines[0] != "builddir = out" {
+		t.Errorf("Expected only the statements other than pools, got %q", lines)
+	}
+}
+
+func TestSynthesizeNinjaManifest(t *testing.T) {
+	dir := writeNinjaFiles(t, map[string]string{
+		"combined.ninja": `builddir = out
+pool highmem_pool
+  depth = 8
+pool remote_pool
+  depth = 500
+subninja kati.ninja
+subninja soong/build.ninja
+`,
+		"kati.ninja":        "pool local_pool\n  depth = 16\nrule kati_cc\n  command = clang -c $in -o $out\nbuild out/legacy/main.o: kati_cc legacy/main.c\n",
+		"soong/build.ninja": "rule cc\n  command = clang -c $in -o $out\n  pool = remote_pool\n",
+	})
+	// Included manifests are found through the source root, not the working directory
+	t.Setenv("ANDROID_BUILD_TOP", dir)
+
+	config := WrapperConfig{
+		SoongNinjaFile:    filepath.Join(dir, "soong/build.ninja"),
+		CombinedNinjaFile: filepath.Join(dir, "combined.ninja"),
+		HighmemParallel:   3,
+	}
+
+	// The combined manifest keeps its pools, highmem_pool follows HighmemParallel and the Kati
+	// local_pool isn't redeclared
+	content, err := synthesizeNinjaManifest(config, config.CombinedNinjaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `pool highmem_pool
+  depth = 3
+pool remote_pool
+  depth = 500
+builddir = out
+subninja kati.ninja
+subninja soong/build.ninja
+`
+	if content != want {
+		t.Errorf("Unexpected combined manifest:\n%s\nwant:\n%s", content, want)
+	}
+
+	// The Soong manifest alone gets the default pools
+	config.HighmemParallel = 0
+	content, err = synthesizeNinjaManifest(config, config.SoongNinjaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(content, "pool highmem_pool\n  depth = 1\npool local_pool\n") ||
+		!strings.HasSuffix(content, "subninja "+config.SoongNinjaFile+"\n") {
+		t.Errorf("Unexpected Soong manifest:\n%s", content)
+	}
+
+	// Every manifest loads with the synthesized pools
+	for _, ninjaFile := range []string{config.CombinedNinjaFile, config.SoongNinjaFile} {
+		tempFile, cleanup, err := createTempNinjaFile(config, ninjaFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest, err := LoadNinjaManifestContext(context.Background(), tempFile, dir)
+		cleanup()
+		if err != nil {
+			t.Errorf("Failed to load the manifest synthesized from %s: %v", ninjaFile, err)
+		} else if manifest.Pools[highmemPool] == nil {
+			t.Errorf("Expected %s to declare highmem_pool", ninjaFile)
+		}
+	}
+}
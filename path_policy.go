@@ -0,0 +1,248 @@
+package wrapper
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PathMode selects how paths in written commands are expressed
+type PathMode int
+
+const (
+	// PathsAsIs keeps paths the way the build spelled them
+	PathsAsIs PathMode = iota
+	// PathsAbsolute resolves every path against the working directory of its command
+	PathsAbsolute
+	// PathsRelativeToRoot expresses paths inside the source tree relative to PathPolicy.Root
+	// and makes the root the working directory of every command
+	PathsRelativeToRoot
+)
+
+// PathRemap replaces the absolute path prefix From with To, e.g. to map a container mount back
+// to the host checkout
+type PathRemap struct {
+	From string
+	To   string
+}
+
+// PathPolicy rewrites the paths of database entries uniformly: the working directory, input,
+// output and include paths, and the matching arguments of the command string. /proc/self/cwd
+// prefixes used by remote execution are resolved to the working directory of the command.
+// Java and Rust descriptions are not rewritten.
+type PathPolicy struct {
+	Mode  PathMode
+	Root  string      // Source tree root, $ANDROID_BUILD_TOP when empty
+	Remap []PathRemap // Prefix rewrites applied to absolute paths after Mode, first match wins
+}
+
+// procSelfCwd is the prefix hermetic builds use for paths inside the execution root
+const procSelfCwd = "/proc/self/cwd"
+
+// pathFlagPrefixes are the joined option spellings whose values are paths, longest first so
+// -isystem isn't taken for -i
+var pathFlagPrefixes = []string{
+	"--sysroot=", "-idirafter", "-isysroot", "-isystem", "-imacros", "-include", "-iquote", "-MF", "-I", "-o", "@",
+}
+
+// pathRewriter rewrites the paths of one command
+type pathRewriter struct {
+	policy     PathPolicy
+	root       string
+	workingDir string          // Absolute working directory of the command
+	known      map[string]bool // Relative paths the parsed command identified
+}
+
+// absolute resolves path against the working directory of the command
+func (r *pathRewriter) absolute(path string) string {
+	if rest, ok := strings.CutPrefix(path, procSelfCwd); ok && (rest == "" || rest[0] == '/') {
+		return filepath.Join(r.workingDir, rest)
+	}
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(r.workingDir, path)
+}
+
+// remap applies the first matching prefix rewrite of policy to an absolute path
+func (p PathPolicy) remap(path string) string {
+	for _, remap := range p.Remap {
+		from := filepath.Clean(remap.From)
+		if path == from {
+			return filepath.Clean(remap.To)
+		}
+		if rest, ok := strings.CutPrefix(path, from+"/"); ok {
+			return filepath.Join(remap.To, rest)
+		}
+	}
+	return path
+}
+
+// unmap reverses the prefix rewrites of policy on an absolute path, recovering the path the
+// build used
+func (p PathPolicy) unmap(path string) string {
+	for _, remap := range p.Remap {
+		to := filepath.Clean(remap.To)
+		if path == to {
+			return filepath.Clean(remap.From)
+		}
+		if rest, ok := strings.CutPrefix(path, to+"/"); ok {
+			return filepath.Join(remap.From, rest)
+		}
+	}
+	return path
+}
+
+// path rewrites a single path
+func (r *pathRewriter) path(path string) string {
+	if path == "" {
+		return path
+	}
+
+	switch r.policy.Mode {
+	case PathsAbsolute:
+		return r.policy.remap(r.absolute(path))
+	case PathsRelativeToRoot:
+		abs := r.absolute(path)
+		if rel, err := filepath.Rel(r.root, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return rel
+		}
+		// Outside the tree, e.g. a prebuilt toolchain on the host
+		return r.policy.remap(abs)
+	}
+
+	if strings.HasPrefix(path, procSelfCwd) || filepath.IsAbs(path) {
+		return r.policy.remap(r.absolute(path))
+	}
+	return path
+}
+
+// paths rewrites a path list into a new slice
+func (r *pathRewriter) paths(paths []string) []string {
+	if paths == nil {
+		return nil
+	}
+	result := make([]string, len(paths))
+	for i, path := range paths {
+		result[i] = r.path(path)
+	}
+	return result
+}
+
+// arg rewrites a command argument that is, or ends in, a path. Absolute paths are rewritten
+// wherever they appear; relative ones only when the parsed command identified them as paths.
+func (r *pathRewriter) arg(arg string) string {
+	if r.known[arg] || filepath.IsAbs(arg) {
+		return r.path(arg)
+	}
+	if !strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "@") {
+		return arg
+	}
+
+	for _, flag := range pathFlagPrefixes {
+		if value, ok := strings.CutPrefix(arg, flag); ok && (r.known[value] || filepath.IsAbs(value) || flag == "@") {
+			return flag + r.path(value)
+		}
+	}
+	// Any other --option=/absolute/path
+	if i := strings.Index(arg, "=/"); i > 0 {
+		return arg[:i+1] + r.path(arg[i+1:])
+	}
+	return arg
+}
+
+// commandLine rewrites the path arguments of a shell command line in place, keeping the rest of
+// the original spelling. Words with expansions are left to the shell, quoting them would
+// disable the expansion.
+func (r *pathRewriter) commandLine(cmdLine string) string {
+	return spliceShellWords(cmdLine, func(word string) (string, bool) {
+		if strings.ContainsAny(word, "$`") {
+			return "", false
+		}
+		rewritten := r.arg(word)
+		return shellQuote(rewritten), rewritten != word
+	})
+}
+
+// applyPathPolicy rewrites the paths of every command according to policy
+func applyPathPolicy(policy PathPolicy, commands *CommandDatabase) {
+	if !policy.rewrites() {
+		return
+	}
+	root := policy.resolvedRoot()
+	for i := range commands.Commands {
+		policy.rewriteCommand(root, &commands.Commands[i])
+	}
+}
+
+// rewrites reports whether the policy changes any path
+func (p PathPolicy) rewrites() bool {
+	return p.Mode != PathsAsIs || len(p.Remap) > 0
+}
+
+// resolvedRoot is Root, $ANDROID_BUILD_TOP when unset
+func (p PathPolicy) resolvedRoot() string {
+	root := p.Root
+	if root == "" {
+		root = os.Getenv("ANDROID_BUILD_TOP")
+	}
+	return filepath.Clean(root)
+}
+
+// rewriteCommand rewrites the paths of one command, root being resolvedRoot
+func (policy PathPolicy) rewriteCommand(root string, info *CompilerCommandInfo) {
+	workingDir := info.WorkingDir
+	if !filepath.IsAbs(workingDir) {
+		workingDir = filepath.Join(root, workingDir)
+	}
+	r := &pathRewriter{policy: policy, root: root, workingDir: filepath.Clean(workingDir), known: map[string]bool{}}
+
+	for _, paths := range [][]string{info.InputFiles, info.Includes, info.SystemIncludes, info.QuoteIncludes,
+		info.AfterIncludes, info.ForcedIncludes, info.MacroIncludes, info.Headers, {info.OutputFile, info.DepFile, info.Sysroot}} {
+		for _, path := range paths {
+			if path != "" && !filepath.IsAbs(path) {
+				r.known[path] = true
+			}
+		}
+	}
+
+	info.Command = r.commandLine(info.Command)
+	if info.Arguments != nil {
+		arguments := make([]string, len(info.Arguments))
+		for j, arg := range info.Arguments {
+			arguments[j] = r.arg(arg)
+		}
+		info.Arguments = arguments
+	}
+	if info.Options != nil {
+		options := make([]CompilerOption, len(info.Options))
+		for j, option := range info.Options {
+			if r.known[option.Value] || filepath.IsAbs(option.Value) {
+				option.Value = r.path(option.Value)
+			}
+			options[j] = option
+		}
+		info.Options = options
+	}
+
+	info.InputFiles = r.paths(info.InputFiles)
+	info.OutputFile = r.path(info.OutputFile)
+	info.Includes = r.paths(info.Includes)
+	info.SystemIncludes = r.paths(info.SystemIncludes)
+	info.QuoteIncludes = r.paths(info.QuoteIncludes)
+	info.AfterIncludes = r.paths(info.AfterIncludes)
+	info.ForcedIncludes = r.paths(info.ForcedIncludes)
+	info.MacroIncludes = r.paths(info.MacroIncludes)
+	info.DepFile = r.path(info.DepFile)
+	info.Headers = r.paths(info.Headers)
+	info.Sysroot = r.path(info.Sysroot)
+
+	switch policy.Mode {
+	case PathsAbsolute:
+		info.WorkingDir = r.policy.remap(r.workingDir)
+	case PathsRelativeToRoot:
+		info.WorkingDir = r.policy.remap(root)
+	default:
+		info.WorkingDir = r.path(info.WorkingDir)
+	}
+}
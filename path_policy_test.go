@@ -0,0 +1,115 @@
+package wrapper
+
+import (
+	"reflect"
+	"testing"
+)
+
+func pathPolicyTestDatabase() CommandDatabase {
+	info := parseCompdbEntry(map[string]interface{}{
+		"directory": "/home/aosp",
+		"command":   "clang -Iinclude -isystem /home/aosp/bionic/libc/include -I/proc/self/cwd/gen -MF out/main.o.d -c hello/main.c -o out/main.o @out/main.rsp",
+		"file":      "hello/main.c",
+		"output":    "out/main.o",
+	}, "/home/aosp")
+	return CommandDatabase{Commands: []CompilerCommandInfo{info}}
+}
+
+func TestApplyPathPolicyAbsolute(t *testing.T) {
+	commands := pathPolicyTestDatabase()
+	applyPathPolicy(PathPolicy{Mode: PathsAbsolute, Root: "/home/aosp", Remap: []PathRemap{{From: "/home/aosp", To: "/src"}}}, &commands)
+
+	info := commands.Commands[0]
+	if info.WorkingDir != "/src" || !reflect.DeepEqual(info.InputFiles, []string{"/src/hello/main.c"}) || info.OutputFile != "/src/out/main.o" {
+		t.Errorf("Unexpected paths %q %q %q", info.WorkingDir, info.InputFiles, info.OutputFile)
+	}
+	if want := []string{"/src/include", "/src/gen"}; !reflect.DeepEqual(info.Includes, want) {
+		t.Errorf("Expected includes %q, got %q", want, info.Includes)
+	}
+	if want := []string{"/src/bionic/libc/include"}; !reflect.DeepEqual(info.SystemIncludes, want) {
+		t.Errorf("Expected system includes %q, got %q", want, info.SystemIncludes)
+	}
+
+	want := "clang -I/src/include -isystem /src/bionic/libc/include -I/src/gen -MF /src/out/main.o.d -c /src/hello/main.c -o /src/out/main.o @/src/out/main.rsp"
+	if info.Command != want {
+		t.Errorf("Expected command\n%s\ngot\n%s", want, info.Command)
+	}
+	if joinCommandLine(info.Arguments) != want {
+		t.Errorf("Expected arguments to match the command, got %q", info.Arguments)
+	}
+	for _, option := range info.Options {
+		if option.Value == "hello/main.c" || option.Value == "include" {
+			t.Errorf("Expected option values to be rewritten, got %+v", option)
+		}
+	}
+}
+
+func TestApplyPathPolicyRelativeToRoot(t *testing.T) {
+	commands := pathPolicyTestDatabase()
+	// A command run from a subdirectory, with a path outside the tree
+	commands.Commands = append(commands.Commands, parseCompdbEntry(map[string]interface{}{
+		"directory": "/home/aosp/out/soong",
+		"command":   "clang -I../../external/include -I/opt/toolchain/include -c ../../lib/a.c -o lib/a.o",
+		"file":      "../../lib/a.c",
+	}, "/home/aosp"))
+
+	applyPathPolicy(PathPolicy{Mode: PathsRelativeToRoot, Root: "/home/aosp"}, &commands)
+
+	info := commands.Commands[0]
+	if info.WorkingDir != "/home/aosp" || info.Command != "clang -Iinclude -isystem bionic/libc/include -Igen -MF out/main.o.d -c hello/main.c -o out/main.o @out/main.rsp" {
+		t.Errorf("Unexpected command %q in %q", info.Command, info.WorkingDir)
+	}
+
+	info = commands.Commands[1]
+	if info.WorkingDir != "/home/aosp" || !reflect.DeepEqual(info.InputFiles, []string{"lib/a.c"}) || info.OutputFile != "out/soong/lib/a.o" {
+		t.Errorf("Unexpected paths %q %q %q", info.WorkingDir, info.InputFiles, info.OutputFile)
+	}
+	if want := []string{"external/include", "/opt/toolchain/include"}; !reflect.DeepEqual(info.Includes, want) {
+		t.Errorf("Expected includes %q, got %q", want, info.Includes)
+	}
+	if want := "clang -Iexternal/include -I/opt/toolchain/include -c lib/a.c -o out/soong/lib/a.o"; info.Command != want {
+		t.Errorf("Expected command %q, got %q", want, info.Command)
+	}
+}
+
+func TestApplyPathPolicyRemapOnly(t *testing.T) {
+	commands := pathPolicyTestDatabase()
+	original := commands.Commands[0]
+	applyPathPolicy(PathPolicy{Remap: []PathRemap{{From: "/home/aosp", To: "/src"}}}, &commands)
+
+	info := commands.Commands[0]
+	if info.WorkingDir != "/src" || !reflect.DeepEqual(info.InputFiles, original.InputFiles) {
+		t.Errorf("Expected only absolute paths to be remapped, got %q %q", info.WorkingDir, info.InputFiles)
+	}
+	if want := "clang -Iinclude -isystem /src/bionic/libc/include -I/src/gen -MF out/main.o.d -c hello/main.c -o out/main.o @out/main.rsp"; info.Command != want {
+		t.Errorf("Expected command %q, got %q", want, info.Command)
+	}
+
+	// The zero policy leaves commands untouched
+	commands = pathPolicyTestDatabase()
+	applyPathPolicy(PathPolicy{}, &commands)
+	if !reflect.DeepEqual(commands, pathPolicyTestDatabase()) {
+		t.Error("Expected the zero policy to keep commands")
+	}
+
+	policy := PathPolicy{Remap: []PathRemap{{From: "/home/aosp", To: "/src"}}}
+	if got := policy.unmap("/src/out/a.o"); got != "/home/aosp/out/a.o" {
+		t.Errorf("Expected the remap to be reversed, got %s", got)
+	}
+}
+
+func TestApplyPathPolicyShellSyntax(t *testing.T) {
+	command := `clang -c /home/aosp/a.c -o "/home/aosp/out/a.o" -DV="$(cat /home/aosp/VERSION)" -DH="$HOME" 2> /home/aosp/out/a.err && echo done # note`
+	commands := CommandDatabase{Commands: []CompilerCommandInfo{parseCompdbEntry(map[string]interface{}{
+		"directory": "/home/aosp",
+		"command":   command,
+		"file":      "a.c",
+	}, "/home/aosp")}}
+	applyPathPolicy(PathPolicy{Remap: []PathRemap{{From: "/home/aosp", To: "/src"}}}, &commands)
+
+	// Only the path words are respelled, the fd, expansions, operators and comment stay
+	want := `clang -c /src/a.c -o /src/out/a.o -DV="$(cat /home/aosp/VERSION)" -DH="$HOME" 2> /src/out/a.err && echo done # note`
+	if got := commands.Commands[0].Command; got != want {
+		t.Errorf("Expected command\n%s\ngot\n%s", want, got)
+	}
+}
@@ -0,0 +1,40 @@
+package wrapper
+
+import (
+	"context"
+	"os/exec"
+	"time"
+)
+
+// processWaitDelay bounds how long a cancelled command may keep its output pipes open
+const processWaitDelay = 5 * time.Second
+
+// commandContext is exec.CommandContext for child tools such as distninja and proxy. The command
+// runs in its own process group and cancelling ctx kills the whole group, so nothing the tool
+// started outlives the wrapper.
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		return killProcessGroup(cmd)
+	}
+	cmd.WaitDelay = processWaitDelay
+	return cmd
+}
+
+// PhaseTimeouts bounds the phases of RunNinjaWithCommandLogging. A zero duration leaves the
+// phase bounded only by the caller's context.
+type PhaseTimeouts struct {
+	Manifest time.Duration // Preparing and parsing the ninja manifest
+	Targets  time.Duration // Resolving modules to ninja targets
+	Compdb   time.Duration // Extracting compile commands
+	Write    time.Duration // Writing databases and running proxy
+}
+
+// withPhaseTimeout derives the context of a phase limited to timeout, if any
+func withPhaseTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
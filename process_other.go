@@ -0,0 +1,19 @@
+//go:build !unix
+
+package wrapper
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup is a no-op where process groups are not available
+func setProcessGroup(_ *exec.Cmd) {
+}
+
+// killProcessGroup kills cmd; processes it started are not tracked on this platform
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
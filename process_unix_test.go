@@ -0,0 +1,82 @@
+//go:build unix
+
+package wrapper
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCommandContextKillsProcessGroup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The shell reports the pid of a grandchild that would outlive a plain kill of the shell
+	cmd := commandContext(ctx, "sh", "-c", "sleep 60 & echo $!; wait")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read grandchild pid: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		t.Fatalf("Unexpected pid %q", line)
+	}
+
+	cancel()
+	if err := cmd.Wait(); err == nil {
+		t.Error("Expected the cancelled command to fail")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for syscall.Kill(pid, 0) == nil {
+		if time.Now().After(deadline) {
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("Grandchild %d survived cancellation", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGetCompilationDatabaseCancelled(t *testing.T) {
+	dir := t.TempDir()
+	tool := filepath.Join(dir, "fake-ninja")
+	if err := os.WriteFile(tool, []byte("#!/bin/sh\nsleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	config := WrapperConfig{NinjaTool: tool, Parallelism: 2, CompdbBatchSize: 1}
+	commands, targetErrors, _ := getCompilationDatabase(ctx, config, filepath.Join(dir, "build.ninja"), []string{"a", "b", "c", "d"})
+
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Expected cancellation to stop extraction promptly, took %v", elapsed)
+	}
+	if len(targetErrors) != 0 {
+		t.Errorf("Expected cancellation not to be reported per target, got %v", targetErrors)
+	}
+	if len(commands.Commands) != 0 {
+		t.Errorf("Expected no commands, got %d", len(commands.Commands))
+	}
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to have expired, got %v", ctx.Err())
+	}
+}
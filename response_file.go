@@ -0,0 +1,182 @@
+package wrapper
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxResponseFileDepth bounds nested @file expansion and breaks include cycles
+const maxResponseFileDepth = 16
+
+// inputFileExtensions are arguments treated as inputs when they come from a response file.
+// Objects, archives and jars are link or classpath inputs, not compiled sources.
+var inputFileExtensions = map[string]bool{
+	".c": true, ".cc": true, ".cpp": true, ".cxx": true, ".c++": true, ".m": true, ".mm": true,
+	".s": true, ".S": true, ".java": true, ".kt": true, ".rs": true, ".aidl": true, ".proto": true,
+	".srcjar": true,
+}
+
+// responseFileExpansion is the result of expanding @file arguments
+type responseFileExpansion struct {
+	Args     []string // Command arguments with every readable @file replaced by its contents
+	Inlined  []string // Arguments that came from response files
+	Files    []string // Response files that were read, as written in the command
+	Contents []string // Expanded contents of each entry of Files
+}
+
+// expandResponseFiles replaces @file arguments with the arguments stored in the file.
+// Relative paths resolve against workingDir, nested response files are expanded too and
+// unreadable files are kept as literal arguments like clang does.
+func expandResponseFiles(args []string, workingDir string) responseFileExpansion {
+	var result responseFileExpansion
+	result.Args = expandResponseFileArgs(args, workingDir, 0, &result)
+	return result
+}
+
+func expandResponseFileArgs(args []string, workingDir string, depth int, result *responseFileExpansion) []string {
+	expanded := make([]string, 0, len(args))
+
+	for _, arg := range args {
+		if len(arg) < 2 || arg[0] != '@' || depth >= maxResponseFileDepth {
+			expanded = append(expanded, arg)
+			continue
+		}
+
+		rspPath := arg[1:]
+		if !filepath.IsAbs(rspPath) && workingDir != "" {
+			rspPath = filepath.Join(workingDir, rspPath)
+		}
+		content, err := os.ReadFile(rspPath)
+		if err != nil {
+			expanded = append(expanded, arg)
+			continue
+		}
+
+		nested := expandResponseFileArgs(splitResponseFile(string(content)), workingDir, depth+1, result)
+		if depth == 0 {
+			result.Files = append(result.Files, arg[1:])
+			result.Contents = append(result.Contents, joinCommandLine(nested))
+			result.Inlined = append(result.Inlined, nested...)
+		}
+		expanded = append(expanded, nested...)
+	}
+
+	return expanded
+}
+
+// splitResponseFile tokenizes response file contents the way clang and javac do:
+// arguments are separated by any whitespace, quotes group and backslash escapes
+func splitResponseFile(content string) []string {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+
+	runes := []rune(content)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else if r == '\\' && quote == '"' && i+1 < len(runes) {
+				i++
+				current.WriteRune(runes[i])
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == '\\' && i+1 < len(runes):
+			i++
+			current.WriteRune(runes[i])
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if inArg {
+		args = append(args, current.String())
+	}
+
+	return args
+}
+
+// takesSeparateValue reports whether option arg of the tool family takes the next argument as
+// its value
+func takesSeparateValue(family, arg string) bool {
+	switch family {
+	case "soong_javac_wrapper", "javac", "kotlinc", "turbine":
+		// Turbine's multi-value options list sources too, their values are looked at
+		spec, ok := javaOptionsByName[arg]
+		return ok && !spec.multi
+	case "rustc":
+		_, ok := rustOptionsByName[arg]
+		return ok
+	}
+	spec, ok := clangOptionsByName[arg]
+	return ok && spec.kind != clangJoined
+}
+
+// responseFileInputs returns the inlined arguments that look like input files, skipping the
+// values of options of the tool family
+func responseFileInputs(expansion responseFileExpansion, family string) []string {
+	var inputs []string
+	for i, arg := range expansion.Inlined {
+		if strings.HasPrefix(arg, "-") || (i > 0 && takesSeparateValue(family, expansion.Inlined[i-1])) {
+			continue
+		}
+		if inputFileExtensions[filepath.Ext(arg)] {
+			inputs = append(inputs, arg)
+		}
+	}
+	return inputs
+}
+
+// inlineResponseFiles rewrites each command, and its argument vector, so @file arguments are
+// replaced by their contents
+func inlineResponseFiles(commands *CommandDatabase) {
+	for i := range commands.Commands {
+		inlineResponseFile(&commands.Commands[i])
+	}
+}
+
+// inlineResponseFile is inlineResponseFiles for one command. Every @file word of the command
+// line, quoted or not, is replaced by the file contents where it is written, the rest of the
+// line is kept as is.
+func inlineResponseFile(info *CompilerCommandInfo) {
+	if len(info.Arguments) > 0 {
+		info.Arguments = expandResponseFiles(info.Arguments, info.WorkingDir).Args
+	}
+
+	// A response file may be named more than once, it is read once
+	type inlined struct {
+		content string
+		ok      bool
+	}
+	files := map[string]inlined{}
+	info.Command = spliceShellWords(info.Command, func(word string) (string, bool) {
+		if !strings.HasPrefix(word, "@") {
+			return "", false
+		}
+		file, seen := files[word]
+		if !seen {
+			expansion := expandResponseFiles([]string{word}, info.WorkingDir)
+			if len(expansion.Files) > 0 {
+				file = inlined{content: expansion.Contents[0], ok: true}
+			}
+			files[word] = file
+		}
+		return file.content, file.ok
+	})
+}
@@ -0,0 +1,143 @@
+package wrapper
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitResponseFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected []string
+	}{
+		{"whitespace", "-Ia\t-Ib\n\n-c  foo.c\r\n", []string{"-Ia", "-Ib", "-c", "foo.c"}},
+		{"double quotes", `-DNAME="a b" "-Ipath with space"`, []string{"-DNAME=a b", "-Ipath with space"}},
+		{"single quotes", `'-DX=\n' ''`, []string{`-DX=\n`, ""}},
+		{"escapes", `a\ b "c\"d" e\\f`, []string{"a b", `c"d`, `e\f`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitResponseFile(tt.content); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestExpandResponseFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"out/foo.rsp":    "-Iinclude @out/nested.rsp src/foo.c",
+		"out/nested.rsp": "-DNESTED=1\n'src/with space.c'",
+		"out/cycle.rsp":  "-DCYCLE @out/cycle.rsp",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	expansion := expandResponseFiles([]string{"clang", "@out/foo.rsp", "@out/missing.rsp", "-o", "foo.o"}, dir)
+	expected := []string{"clang", "-Iinclude", "-DNESTED=1", "src/with space.c", "src/foo.c", "@out/missing.rsp", "-o", "foo.o"}
+	if !reflect.DeepEqual(expansion.Args, expected) {
+		t.Errorf("Expected %q, got %q", expected, expansion.Args)
+	}
+	if !reflect.DeepEqual(expansion.Files, []string{"out/foo.rsp"}) {
+		t.Errorf("Expected only the top-level response file, got %v", expansion.Files)
+	}
+	if got, want := responseFileInputs(expansion, "clang"), []string{"src/with space.c", "src/foo.c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected inputs %q, got %q", want, got)
+	}
+
+	// Option values and classpath jars are no compile inputs
+	javaRsp := "-classpath out/lib.jar -processorpath out/proc.jar -d out/classes.java src/A.java out/gen.srcjar out/dep.jar"
+	if err := os.WriteFile(filepath.Join(dir, "out/java.rsp"), []byte(javaRsp), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expansion = expandResponseFiles([]string{"javac", "@out/java.rsp"}, dir)
+	if got, want := responseFileInputs(expansion, "javac"), []string{"src/A.java", "out/gen.srcjar"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected inputs %q, got %q", want, got)
+	}
+
+	// Cycles stop at the depth limit instead of recursing forever
+	expansion = expandResponseFiles([]string{"@out/cycle.rsp"}, dir)
+	if len(expansion.Args) != maxResponseFileDepth+1 {
+		t.Errorf("Expected %d arguments for a cyclic response file, got %d", maxResponseFileDepth+1, len(expansion.Args))
+	}
+}
+
+func TestParseCompdbEntryWithResponseFile(t *testing.T) {
+	dir := t.TempDir()
+	rsp := "-Iframeworks/include -DFOO=1 -Wall\nsrc/a.c src/b.c"
+	if err := os.WriteFile(filepath.Join(dir, "cc.rsp"), []byte(rsp), 0644); err != nil {
+		t.Fatalf("Failed to write response file: %v", err)
+	}
+
+	entry := map[string]interface{}{
+		"command":   "clang -c @cc.rsp -o out.o",
+		"directory": dir,
+		"file":      "src/a.c",
+		"output":    "out.o",
+	}
+
+	info := parseCompdbEntry(entry, "/default/dir")
+	if !reflect.DeepEqual(info.Includes, []string{"frameworks/include"}) {
+		t.Errorf("Expected includes from response file, got %v", info.Includes)
+	}
+	if !reflect.DeepEqual(info.Defines, []string{"FOO=1"}) {
+		t.Errorf("Expected defines from response file, got %v", info.Defines)
+	}
+	if !reflect.DeepEqual(info.InputFiles, []string{"src/a.c", "src/b.c"}) {
+		t.Errorf("Expected inputs from response file, got %v", info.InputFiles)
+	}
+	if !containsString(info.Flags, "-Wall") {
+		t.Errorf("Expected -Wall in flags, got %v", info.Flags)
+	}
+
+	commands := CommandDatabase{Commands: []CompilerCommandInfo{info}}
+	inlineResponseFiles(&commands)
+	expected := "clang -c -Iframeworks/include -DFOO=1 -Wall src/a.c src/b.c -o out.o"
+	if commands.Commands[0].Command != expected {
+		t.Errorf("Expected inlined command %q, got %q", expected, commands.Commands[0].Command)
+	}
+	// The clang layout is written from the argument vector
+	entries := toClangCompileCommands(commands, true)
+	if len(entries) == 0 || containsString(entries[0].Arguments, "@cc.rsp") || !containsString(entries[0].Arguments, "-DFOO=1") {
+		t.Errorf("Expected inlined arguments, got %+v", entries)
+	}
+}
+
+func TestInlineResponseFileWords(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"a.rsp": "-DA\n", "b.rsp": "-DB 'x y.c'\n", "empty.rsp": ""} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		command  string
+		expected string
+	}{
+		{"clang @a.rsp @b.rsp -c a.c", "clang -DA -DB 'x y.c' -c a.c"},
+		{"clang @a.rsp @a.rsp -c a.c", "clang -DA -DA -c a.c"},
+		{`clang '@a.rsp' "@b.rsp" -c a.c`, "clang -DA -DB 'x y.c' -c a.c"},
+		{"clang @empty.rsp -c a.c", "clang  -c a.c"},
+		{"clang @missing.rsp user@host -c a.c", "clang @missing.rsp user@host -c a.c"},
+	}
+	for _, test := range tests {
+		info := CompilerCommandInfo{Command: test.command, WorkingDir: dir}
+		inlineResponseFile(&info)
+		if info.Command != test.expected {
+			t.Errorf("inlineResponseFile(%q) = %q, expected %q", test.command, info.Command, test.expected)
+		}
+	}
+}
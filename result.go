@@ -0,0 +1,32 @@
+package wrapper
+
+import (
+	"time"
+)
+
+// Result summarizes a RunNinjaWithCommandLogging run
+type Result struct {
+	CompileType  string         // "full" or "module"
+	NinjaTool    string         // distninja or NativeNinjaTool
+	Targets      []string       // Ninja targets commands were extracted for, empty for full builds
+	Commands     int            // Compile commands collected
+	OutOfScope   int            // Collected commands dropped because their sources are outside SourceRootDirs
+	Outputs      []string       // Files that were written
+	Evicted      int            // Commands of previous runs dropped in merge mode, their outputs left the graph
+	Partial      bool           // Extraction was interrupted, the written commands are incomplete
+	Warnings     []error        // Problems that did not stop the run, e.g. falling back to the built-in parser
+	TargetErrors []*TargetError // Targets whose commands could not be extracted
+	Durations    PhaseDurations
+
+	// Generated include directories and headers referenced by the commands in scope, relative to
+	// the source root, for indexing next to SourceRootDirs
+	GeneratedIncludes []string
+}
+
+// PhaseDurations records the time spent in each phase, see PhaseTimeouts
+type PhaseDurations struct {
+	Manifest time.Duration
+	Targets  time.Duration
+	Compdb   time.Duration
+	Write    time.Duration
+}
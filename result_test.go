@@ -0,0 +1,181 @@
+package wrapper
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func setupNativeRun(t *testing.T) WrapperConfig {
+	dir := writeNinjaFiles(t, map[string]string{
+		"build.ninja": `rule cc
+  command = clang -c $in -o $out
+build out/hello/main.o: cc hello/main.c
+build hello: phony out/hello/main.o
+`,
+	})
+
+	// No distninja or proxy on PATH, paths are absolute so ANDROID_BUILD_TOP stays empty
+	t.Setenv("PATH", t.TempDir())
+	t.Setenv("ANDROID_BUILD_TOP", "")
+	t.Setenv("ANDROID_PRODUCT_OUT", "")
+
+	return WrapperConfig{
+		OutDir:         filepath.Join(dir, "out"),
+		SoongNinjaFile: filepath.Join(dir, "build.ninja"),
+		CompdbFormat:   CompdbFormatClang,
+	}
+}
+
+func TestRunNinjaWithCommandLoggingResult(t *testing.T) {
+	config := setupNativeRun(t)
+	config.BuildArguments = []string{"m", "hello"}
+
+	result, err := RunNinjaWithCommandLogging(context.Background(), config, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if result.CompileType != "module" || result.NinjaTool != NativeNinjaTool {
+		t.Errorf("Unexpected compile type %q or tool %q", result.CompileType, result.NinjaTool)
+	}
+	if len(result.Warnings) != 1 || !errors.Is(result.Warnings[0], ErrNinjaNotFound) {
+		t.Errorf("Expected a distninja fallback warning, got %v", result.Warnings)
+	}
+	if !reflect.DeepEqual(result.Targets, []string{"hello"}) || result.Commands != 1 {
+		t.Errorf("Expected 1 command for target hello, got %d for %v", result.Commands, result.Targets)
+	}
+
+	clangDB := filepath.Join(config.OutDir, ClangCompileCommandsDir, CompileCommandsFile)
+	if !reflect.DeepEqual(result.Outputs, []string{clangDB}) {
+		t.Errorf("Expected outputs [%s], got %v", clangDB, result.Outputs)
+	}
+	if _, err := os.Stat(clangDB); err != nil {
+		t.Errorf("Expected %s to be written: %v", clangDB, err)
+	}
+	if result.Partial || result.Durations.Manifest <= 0 {
+		t.Errorf("Unexpected partial flag or durations: %+v", result)
+	}
+}
+
+func TestRunNinjaWithCommandLoggingErrors(t *testing.T) {
+	t.Run("no targets matched", func(t *testing.T) {
+		config := setupNativeRun(t)
+		config.BuildArguments = []string{"m", "nonexistent"}
+
+		result, err := RunNinjaWithCommandLogging(context.Background(), config, false)
+		if !errors.Is(err, ErrNoTargetsMatched) {
+			t.Errorf("Expected ErrNoTargetsMatched, got %v", err)
+		}
+		if len(result.Outputs) != 0 {
+			t.Errorf("Expected nothing to be written, got %v", result.Outputs)
+		}
+	})
+
+	t.Run("manifest", func(t *testing.T) {
+		config := setupNativeRun(t)
+		config.SoongNinjaFile = filepath.Join(t.TempDir(), "missing", "build.ninja")
+
+		if _, err := RunNinjaWithCommandLogging(context.Background(), config, false); !errors.Is(err, ErrManifestFailed) {
+			t.Errorf("Expected ErrManifestFailed, got %v", err)
+		}
+	})
+
+	t.Run("proxy", func(t *testing.T) {
+		config := setupNativeRun(t)
+		config.CompdbFormat = CompdbFormatInternal | CompdbFormatClang
+
+		// A missing proxy is skipped
+		if _, err := RunNinjaWithCommandLogging(context.Background(), config, false); err != nil {
+			t.Errorf("Expected proxy to be skipped, got %v", err)
+		}
+
+		bin := t.TempDir()
+		if err := os.WriteFile(filepath.Join(bin, "proxy"), []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("PATH", bin)
+
+		result, err := RunNinjaWithCommandLogging(context.Background(), config, false)
+		if !errors.Is(err, ErrProxyFailed) || errors.Is(err, ErrWriteFailed) {
+			t.Errorf("Expected only ErrProxyFailed, got %v", err)
+		}
+		// The database proxy failed on was still written, as was the clang layout
+		if len(result.Outputs) != 2 {
+			t.Errorf("Expected 2 outputs, got %v", result.Outputs)
+		}
+	})
+
+	t.Run("all targets failed", func(t *testing.T) {
+		config := setupNativeRun(t)
+		config.CompdbFormat = CompdbFormatInternal
+		config.BuildArguments = []string{"m", "hello"}
+
+		// distninja lists the target but can't extract its commands
+		bin := t.TempDir()
+		script := "#!/bin/sh\ncase \"$4\" in\ntargets) echo 'hello: phony' ;;\n*) echo failed >&2; exit 1 ;;\nesac\n"
+		if err := os.WriteFile(filepath.Join(bin, "distninja"), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("PATH", bin)
+
+		previous := filepath.Join(config.OutDir, CompileCommandsFile)
+		if err := os.MkdirAll(config.OutDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(previous, []byte("previous"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := RunNinjaWithCommandLogging(context.Background(), config, false)
+		if !errors.Is(err, ErrCompdbFailed) || len(result.TargetErrors) == 0 {
+			t.Errorf("Expected ErrCompdbFailed with target errors, got %v, %v", err, result.TargetErrors)
+		}
+		if data, _ := os.ReadFile(previous); string(data) != "previous" || len(result.Outputs) != 0 {
+			t.Errorf("Expected the previous database to be kept, got %q and outputs %v", data, result.Outputs)
+		}
+	})
+
+	t.Run("interrupted", func(t *testing.T) {
+		config := setupNativeRun(t)
+		config.Timeouts.Compdb = time.Nanosecond
+		config.WritePartialResults = true
+
+		result, err := RunNinjaWithCommandLogging(context.Background(), config, false)
+		if !errors.Is(err, ErrInterrupted) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected ErrInterrupted wrapping the deadline, got %v", err)
+		}
+		if !result.Partial || len(result.Outputs) != 1 {
+			t.Errorf("Expected a written partial result, got %+v", result)
+		}
+	})
+
+	t.Run("interrupted discarded", func(t *testing.T) {
+		config := setupNativeRun(t)
+		config.Timeouts.Compdb = time.Nanosecond
+
+		previous := filepath.Join(config.OutDir, ClangCompileCommandsDir, CompileCommandsFile)
+		if err := os.MkdirAll(filepath.Dir(previous), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(previous, []byte("previous"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// The streamed database is discarded, the previous one stays
+		result, err := RunNinjaWithCommandLogging(context.Background(), config, false)
+		if !errors.Is(err, ErrInterrupted) || !result.Partial {
+			t.Errorf("Expected ErrInterrupted, got %v", err)
+		}
+		if data, _ := os.ReadFile(previous); string(data) != "previous" || len(result.Outputs) != 0 {
+			t.Errorf("Expected the previous database to be kept, got %q and outputs %v", data, result.Outputs)
+		}
+		if entries, _ := os.ReadDir(filepath.Dir(previous)); len(entries) != 1 {
+			t.Errorf("Expected no temporary files, got %v", entries)
+		}
+	})
+}
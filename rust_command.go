@@ -0,0 +1,331 @@
+package wrapper
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RustProjectFile is the OutDir file written for CompdbFormatRustProject
+const RustProjectFile = "rust-project.json"
+
+// RustCrate is the structured view of a rustc invocation
+type RustCrate struct {
+	CrateName  string       `json:"crateName,omitempty"`
+	CrateTypes []string     `json:"crateTypes,omitempty"` // --crate-type: lib, rlib, dylib, proc-macro, bin, ...
+	Edition    string       `json:"edition,omitempty"`
+	Cfg        []string     `json:"cfg,omitempty"` // --cfg values as written, e.g. feature="std"
+	Externs    []RustExtern `json:"externs,omitempty"`
+	LinkSearch []string     `json:"linkSearch,omitempty"` // -L values including any kind= prefix
+	RootModule string       `json:"rootModule,omitempty"` // Crate root source file
+}
+
+// RustExtern is a --extern name[=path] dependency
+type RustExtern struct {
+	Name string `json:"name"`
+	Path string `json:"path,omitempty"`
+}
+
+// rustOptionSpec is an entry of the rustc option table
+type rustOptionSpec struct {
+	names []string
+	store func(info *CompilerCommandInfo, value string) // nil keeps the option and its value in Flags
+}
+
+var rustOptionTable = []rustOptionSpec{
+	{[]string{"--crate-name"}, func(i *CompilerCommandInfo, v string) { i.Rust.CrateName = v }},
+	{[]string{"--crate-type"}, func(i *CompilerCommandInfo, v string) {
+		for _, crateType := range strings.Split(v, ",") {
+			if crateType != "" && !containsString(i.Rust.CrateTypes, crateType) {
+				i.Rust.CrateTypes = append(i.Rust.CrateTypes, crateType)
+			}
+		}
+	}},
+	{[]string{"--edition"}, func(i *CompilerCommandInfo, v string) { i.Rust.Edition = v }},
+	{[]string{"--cfg"}, func(i *CompilerCommandInfo, v string) { i.Rust.Cfg = append(i.Rust.Cfg, v) }},
+	{[]string{"--extern"}, func(i *CompilerCommandInfo, v string) { i.Rust.Externs = append(i.Rust.Externs, parseRustExtern(v)) }},
+	{[]string{"-L"}, func(i *CompilerCommandInfo, v string) { i.Rust.LinkSearch = append(i.Rust.LinkSearch, v) }},
+	{[]string{"--target"}, func(i *CompilerCommandInfo, v string) { i.Target = v }},
+	{[]string{"--sysroot"}, func(i *CompilerCommandInfo, v string) { i.Sysroot = v }},
+	{[]string{"-o"}, func(i *CompilerCommandInfo, v string) {
+		if i.OutputFile == "" {
+			i.OutputFile = v
+		}
+	}},
+	{[]string{"-C", "--codegen", "-A", "--allow", "-W", "--warn", "-D", "--deny", "-F", "--forbid", "-l",
+		"--emit", "--out-dir", "--cap-lints", "--error-format", "--json", "--print", "--remap-path-prefix",
+		"--explain", "-Z"}, nil},
+}
+
+var rustOptionsByName = func() map[string]*rustOptionSpec {
+	byName := map[string]*rustOptionSpec{}
+	for i := range rustOptionTable {
+		for _, name := range rustOptionTable[i].names {
+			byName[name] = &rustOptionTable[i]
+		}
+	}
+	return byName
+}()
+
+// lookupRustOption finds the table entry for arg: long options take --name=value, single
+// letter options take a joined value such as -Copt-level=3 or -Ldependency=dir
+func lookupRustOption(arg string) (*rustOptionSpec, string, bool) {
+	if spec, ok := rustOptionsByName[arg]; ok {
+		return spec, "", false
+	}
+	if strings.HasPrefix(arg, "--") {
+		if eq := strings.IndexByte(arg, '='); eq > 0 {
+			if spec, ok := rustOptionsByName[arg[:eq]]; ok {
+				return spec, arg[eq+1:], true
+			}
+		}
+		return nil, "", false
+	}
+	if len(arg) > 2 {
+		if spec, ok := rustOptionsByName[arg[:2]]; ok {
+			return spec, arg[2:], true
+		}
+	}
+	return nil, "", false
+}
+
+// parseRustExtern splits [modifiers:]name[=path]
+func parseRustExtern(value string) RustExtern {
+	name, path := value, ""
+	if eq := strings.IndexByte(value, '='); eq >= 0 {
+		name, path = value[:eq], value[eq+1:]
+	}
+	if colon := strings.LastIndexByte(name, ':'); colon >= 0 {
+		name = name[colon+1:]
+	}
+	return RustExtern{Name: name, Path: path}
+}
+
+// parseRustArgs parses a rustc invocation (args[0] is rustc) into info.Rust
+func parseRustArgs(info *CompilerCommandInfo, args []string) {
+	if len(args) == 0 {
+		return
+	}
+
+	info.Rust = &RustCrate{}
+
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			if info.Rust.RootModule == "" && filepath.Ext(arg) == ".rs" {
+				info.Rust.RootModule = arg
+				if !containsString(info.InputFiles, arg) {
+					info.InputFiles = append(info.InputFiles, arg)
+				}
+			}
+			continue
+		}
+
+		if arg == "--test" {
+			// --test compiles the crate with cfg(test)
+			info.Rust.Cfg = append(info.Rust.Cfg, "test")
+			info.Flags = append(info.Flags, arg)
+			continue
+		}
+
+		spec, value, joined := lookupRustOption(arg)
+		switch {
+		case spec == nil:
+			info.Flags = append(info.Flags, arg)
+			continue
+		case !joined && i+1 >= len(args):
+			// Missing value, keep the dangling option as a flag
+			info.Flags = append(info.Flags, arg)
+			continue
+		case !joined:
+			i++
+			value = args[i]
+		}
+
+		if spec.store != nil {
+			spec.store(info, value)
+		} else if joined {
+			info.Flags = append(info.Flags, arg)
+		} else {
+			info.Flags = append(info.Flags, arg, value)
+		}
+	}
+
+	if info.Rust.Edition == "" {
+		// rustc's default edition
+		info.Rust.Edition = "2015"
+	}
+}
+
+// rustProject is the rust-analyzer project description
+// (https://rust-analyzer.github.io/book/non_cargo_based_projects.html)
+type rustProject struct {
+	Crates []rustProjectCrate `json:"crates"`
+}
+
+type rustProjectCrate struct {
+	DisplayName        string             `json:"display_name,omitempty"`
+	RootModule         string             `json:"root_module"`
+	Edition            string             `json:"edition"`
+	Deps               []rustProjectDep   `json:"deps"`
+	Cfg                []string           `json:"cfg"`
+	Target             string             `json:"target,omitempty"`
+	Env                map[string]string  `json:"env,omitempty"`
+	IsWorkspaceMember  bool               `json:"is_workspace_member"`
+	IsProcMacro        bool               `json:"is_proc_macro"`
+	ProcMacroDylibPath string             `json:"proc_macro_dylib_path,omitempty"`
+	Source             *rustProjectSource `json:"source,omitempty"`
+}
+
+type rustProjectDep struct {
+	Crate int    `json:"crate"`
+	Name  string `json:"name"`
+}
+
+type rustProjectSource struct {
+	IncludeDirs []string `json:"include_dirs"`
+	ExcludeDirs []string `json:"exclude_dirs"`
+}
+
+// absoluteIn resolves a command relative path against the command's working directory
+func absoluteIn(workingDir, path string) string {
+	if path == "" || filepath.IsAbs(path) || workingDir == "" {
+		return path
+	}
+	return filepath.Join(workingDir, path)
+}
+
+// buildRustProject converts the rustc commands of the database into a rust-project.json
+// description. Crates compiled several times (e.g. per architecture) are listed once, with the
+// dependencies of all their commands. --extern dependencies are resolved through the outputs of
+// the other rustc commands, directly or, without a path, through the -L search directories.
+func buildRustProject(commands CommandDatabase) rustProject {
+	project := rustProject{Crates: []rustProjectCrate{}}
+
+	type crateKey struct{ name, root string }
+	indices := map[crateKey]int{}
+	byOutput := map[string]int{}
+	var builds [][]*CompilerCommandInfo
+
+	for i := range commands.Commands {
+		info := &commands.Commands[i]
+		if info.Rust == nil || info.Rust.RootModule == "" {
+			continue
+		}
+
+		root := absoluteIn(info.WorkingDir, info.Rust.RootModule)
+		key := crateKey{info.Rust.CrateName, root}
+		index, ok := indices[key]
+		if !ok {
+			index = len(project.Crates)
+			indices[key] = index
+			project.Crates = append(project.Crates, newRustProjectCrate(info, root))
+			builds = append(builds, nil)
+		}
+		builds[index] = append(builds[index], info)
+		if info.OutputFile != "" {
+			byOutput[absoluteIn(info.WorkingDir, info.OutputFile)] = index
+		}
+	}
+
+	for index, infos := range builds {
+		crate := &project.Crates[index]
+		for _, info := range infos {
+			for _, extern := range info.Rust.Externs {
+				dep, ok := resolveRustExtern(info, extern, byOutput)
+				if !ok || dep == index || hasRustDep(crate.Deps, extern.Name) {
+					continue
+				}
+				crate.Deps = append(crate.Deps, rustProjectDep{Crate: dep, Name: extern.Name})
+			}
+		}
+	}
+
+	return project
+}
+
+// rustLibraryExtensions are the crate outputs rustc looks for in -L directories
+var rustLibraryExtensions = []string{".rlib", ".rmeta", ".so", ".dylib"}
+
+// resolveRustExtern returns the crate whose output extern names. An extern without a path is
+// looked up as lib<name> in the -L directories that hold crates.
+func resolveRustExtern(info *CompilerCommandInfo, extern RustExtern, byOutput map[string]int) (int, bool) {
+	if extern.Path != "" {
+		dep, ok := byOutput[absoluteIn(info.WorkingDir, extern.Path)]
+		return dep, ok
+	}
+
+	for _, search := range info.Rust.LinkSearch {
+		kind, dir, found := strings.Cut(search, "=")
+		if !found {
+			kind, dir = "all", search
+		}
+		if kind != "all" && kind != "crate" && kind != "dependency" {
+			continue
+		}
+		for _, ext := range rustLibraryExtensions {
+			if dep, ok := byOutput[absoluteIn(info.WorkingDir, filepath.Join(dir, "lib"+extern.Name+ext))]; ok {
+				return dep, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func newRustProjectCrate(info *CompilerCommandInfo, root string) rustProjectCrate {
+	crate := rustProjectCrate{
+		DisplayName:       info.Rust.CrateName,
+		RootModule:        root,
+		Edition:           info.Rust.Edition,
+		Deps:              []rustProjectDep{},
+		Cfg:               append([]string{}, info.Rust.Cfg...),
+		Target:            info.Target,
+		IsWorkspaceMember: true,
+		IsProcMacro:       containsString(info.Rust.CrateTypes, "proc-macro"),
+		Source:            &rustProjectSource{IncludeDirs: []string{filepath.Dir(root)}, ExcludeDirs: []string{}},
+	}
+
+	if crate.IsProcMacro {
+		crate.ProcMacroDylibPath = absoluteIn(info.WorkingDir, info.OutputFile)
+	}
+
+	for _, assignment := range info.Environment {
+		name, value, _ := strings.Cut(assignment, "=")
+		if crate.Env == nil {
+			crate.Env = map[string]string{}
+		}
+		crate.Env[name] = value
+		if name == "OUT_DIR" {
+			// Generated code is pulled in with include!(concat!(env!("OUT_DIR"), ...))
+			crate.Source.IncludeDirs = append(crate.Source.IncludeDirs, absoluteIn(info.WorkingDir, value))
+		}
+	}
+
+	return crate
+}
+
+func hasRustDep(deps []rustProjectDep, name string) bool {
+	for _, dep := range deps {
+		if dep.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// writeRustProject writes the rust-analyzer project description to outputDir/rust-project.json
+func writeRustProject(outputDir string, commands CommandDatabase) error {
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %v", err)
+	}
+
+	jsonData, err := json.MarshalIndent(buildRustProject(commands), "", "  ")
+	if err != nil {
+		return fmt.Errorf("JSON encoding failed: %v", err)
+	}
+
+	return writeFileAtomic(outputDir, RustProjectFile, jsonData)
+}
@@ -0,0 +1,176 @@
+package wrapper
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseRustArgs(t *testing.T) {
+	entry := map[string]interface{}{
+		"directory": "/aosp",
+		"command": "rm -f out/libfoo.rlib && OUT_DIR=out/gen/foo prebuilts/rust/bin/rustc --crate-name foo " +
+			"--crate-type=rlib --edition=2021 -C opt-level=3 -Cdebuginfo=2 --cfg 'feature=\"std\"' --cfg android " +
+			"--extern bar=out/libbar.rlib --extern noprelude:baz=out/libbaz.rlib --extern alloc " +
+			"-L dependency=out/deps -Lnative=out/native --target aarch64-linux-android -D warnings --test " +
+			"external/rust/foo/src/lib.rs -o out/libfoo.rlib",
+		"file":   "external/rust/foo/src/lib.rs",
+		"output": "out/libfoo.rlib",
+	}
+
+	info := parseCompdbEntry(entry, "/default/dir")
+	if info.CompilerType != "rustc" {
+		t.Fatalf("Expected compiler type rustc, got %q", info.CompilerType)
+	}
+	if info.Rust == nil {
+		t.Fatal("Expected a Rust crate view")
+	}
+	crate := info.Rust
+
+	checks := []struct {
+		name     string
+		got      interface{}
+		expected interface{}
+	}{
+		{"CrateName", crate.CrateName, "foo"},
+		{"CrateTypes", crate.CrateTypes, []string{"rlib"}},
+		{"Edition", crate.Edition, "2021"},
+		{"Cfg", crate.Cfg, []string{`feature="std"`, "android", "test"}},
+		{"Externs", crate.Externs, []RustExtern{{"bar", "out/libbar.rlib"}, {"baz", "out/libbaz.rlib"}, {"alloc", ""}}},
+		{"LinkSearch", crate.LinkSearch, []string{"dependency=out/deps", "native=out/native"}},
+		{"RootModule", crate.RootModule, "external/rust/foo/src/lib.rs"},
+		{"Target", info.Target, "aarch64-linux-android"},
+		{"OutputFile", info.OutputFile, "out/libfoo.rlib"},
+		{"Environment", info.Environment, []string{"OUT_DIR=out/gen/foo"}},
+		{"Flags", info.Flags, []string{"-C", "opt-level=3", "-Cdebuginfo=2", "-D", "warnings", "--test"}},
+	}
+
+	for _, check := range checks {
+		if !reflect.DeepEqual(check.got, check.expected) {
+			t.Errorf("%s: expected %q, got %q", check.name, check.expected, check.got)
+		}
+	}
+
+	var defaults CompilerCommandInfo
+	parseRustArgs(&defaults, []string{"rustc", "main.rs", "--crate-name"})
+	if defaults.Rust.Edition != "2015" {
+		t.Errorf("Expected default edition 2015, got %q", defaults.Rust.Edition)
+	}
+	if !reflect.DeepEqual(defaults.Flags, []string{"--crate-name"}) {
+		t.Errorf("Expected dangling --crate-name to be kept as a flag, got %q", defaults.Flags)
+	}
+}
+
+func TestWriteRustProject(t *testing.T) {
+	commands := CommandDatabase{Commands: []CompilerCommandInfo{
+		{
+			WorkingDir:  "/aosp",
+			OutputFile:  "out/arm64/libfoo.rlib",
+			Environment: []string{"OUT_DIR=out/gen/foo"},
+			Rust: &RustCrate{
+				CrateName:  "foo",
+				Edition:    "2021",
+				RootModule: "external/foo/src/lib.rs",
+				Externs:    []RustExtern{{Name: "macros", Path: "out/libmacros.so"}, {Name: "missing", Path: "out/none.rlib"}},
+			},
+		},
+		{
+			WorkingDir: "/aosp",
+			OutputFile: "out/x86/libfoo.rlib",
+			Rust:       &RustCrate{CrateName: "foo", Edition: "2021", RootModule: "external/foo/src/lib.rs"},
+		},
+		{
+			WorkingDir: "/aosp",
+			OutputFile: "out/libmacros.so",
+			Rust:       &RustCrate{CrateName: "macros", Edition: "2018", CrateTypes: []string{"proc-macro"}, RootModule: "external/macros/lib.rs"},
+		},
+		{
+			WorkingDir: "/aosp",
+			OutputFile: "out/app",
+			Rust: &RustCrate{
+				CrateName:  "app",
+				Edition:    "2021",
+				RootModule: "packages/app/main.rs",
+				Externs:    []RustExtern{{Name: "foo", Path: "out/x86/libfoo.rlib"}},
+			},
+		},
+		{Command: "clang -c a.c"},
+	}}
+
+	tmpDir := t.TempDir()
+	if err := writeRustProject(tmpDir, commands); err != nil {
+		t.Fatalf("writeRustProject failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(tmpDir, RustProjectFile))
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", RustProjectFile, err)
+	}
+
+	var project rustProject
+	if err := json.Unmarshal(data, &project); err != nil {
+		t.Fatalf("Failed to parse %s: %v", RustProjectFile, err)
+	}
+
+	if len(project.Crates) != 3 {
+		t.Fatalf("Expected 3 crates, got %d", len(project.Crates))
+	}
+
+	foo, macros, app := project.Crates[0], project.Crates[1], project.Crates[2]
+	if foo.RootModule != "/aosp/external/foo/src/lib.rs" {
+		t.Errorf("Expected absolute root module, got %q", foo.RootModule)
+	}
+	if !reflect.DeepEqual(foo.Deps, []rustProjectDep{{Crate: 1, Name: "macros"}}) {
+		t.Errorf("Expected foo to depend on macros only, got %+v", foo.Deps)
+	}
+	if foo.Env["OUT_DIR"] != "out/gen/foo" {
+		t.Errorf("Expected OUT_DIR env, got %v", foo.Env)
+	}
+	if got, expected := foo.Source.IncludeDirs, []string{"/aosp/external/foo/src", "/aosp/out/gen/foo"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected include dirs %q, got %q", expected, got)
+	}
+	if !macros.IsProcMacro || macros.ProcMacroDylibPath != "/aosp/out/libmacros.so" {
+		t.Errorf("Expected proc macro with dylib path, got %+v", macros)
+	}
+	if !reflect.DeepEqual(app.Deps, []rustProjectDep{{Crate: 0, Name: "foo"}}) {
+		t.Errorf("Expected app to depend on foo through its x86 output, got %+v", app.Deps)
+	}
+}
+
+func TestBuildRustProjectMergesDeps(t *testing.T) {
+	commands := CommandDatabase{Commands: []CompilerCommandInfo{
+		{
+			WorkingDir: "/aosp",
+			OutputFile: "out/arm64/libfoo.rlib",
+			Rust: &RustCrate{
+				CrateName:  "foo",
+				RootModule: "external/foo/src/lib.rs",
+				Externs:    []RustExtern{{Name: "log", Path: "out/arm64/liblog.rlib"}},
+			},
+		},
+		{
+			// The second architecture depends on bar too, found through -L
+			WorkingDir: "/aosp",
+			OutputFile: "out/x86/libfoo.rlib",
+			Rust: &RustCrate{
+				CrateName:  "foo",
+				RootModule: "external/foo/src/lib.rs",
+				Externs:    []RustExtern{{Name: "log", Path: "out/x86/liblog.rlib"}, {Name: "bar"}},
+				LinkSearch: []string{"native=out/x86", "dependency=out/x86/deps"},
+			},
+		},
+		{WorkingDir: "/aosp", OutputFile: "out/arm64/liblog.rlib", Rust: &RustCrate{CrateName: "log", RootModule: "external/log/src/lib.rs"}},
+		{WorkingDir: "/aosp", OutputFile: "out/x86/liblog.rlib", Rust: &RustCrate{CrateName: "log", RootModule: "external/log/src/lib.rs"}},
+		{WorkingDir: "/aosp", OutputFile: "out/x86/deps/libbar.rlib", Rust: &RustCrate{CrateName: "bar", RootModule: "external/bar/src/lib.rs"}},
+	}}
+
+	project := buildRustProject(commands)
+	if len(project.Crates) != 3 {
+		t.Fatalf("Expected 3 crates, got %+v", project.Crates)
+	}
+	if deps := project.Crates[0].Deps; !reflect.DeepEqual(deps, []rustProjectDep{{Crate: 1, Name: "log"}, {Crate: 2, Name: "bar"}}) {
+		t.Errorf("Expected foo to depend on log once and on bar, got %+v", deps)
+	}
+}
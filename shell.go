@@ -0,0 +1,353 @@
+package wrapper
+
+import (
+	"strconv"
+	"strings"
+)
+
+// shellTokenKind distinguishes words from control and redirection operators
+type shellTokenKind int
+
+const (
+	shellWord shellTokenKind = iota
+	shellOperator
+	shellRedirect
+)
+
+// shellToken is a lexed shell word or operator with quoting already removed
+type shellToken struct {
+	kind       shellTokenKind
+	text       string
+	start, end int // Byte range of the token as spelled in the command line
+}
+
+// shellCommand is one simple command of a compound command line
+type shellCommand struct {
+	Args     []string // Words with redirections removed
+	Operator string   // Operator following the command: &&, ||, ;, |, & or empty for the last one
+}
+
+// controlOperators are tried longest first
+var controlOperators = []string{"&&", "||", ";;", "|&", ";", "|", "&", "(", ")", "\n"}
+
+// redirectOperators are tried longest first
+var redirectOperators = []string{"<<<", "<<-", "&>>", "<<", ">>", "<&", ">&", "<>", ">|", "&>", "<", ">"}
+
+// lexShell tokenizes a command line following POSIX shell quoting rules plus bash's $'...'.
+// Expansions such as $VAR, ${VAR}, $(command) and `command` are kept literally as part of
+// their word.
+func lexShell(cmdLine string) []shellToken {
+	var tokens []shellToken
+	var word strings.Builder
+	inWord := false
+	wordStart := 0
+
+	flush := func(end int) {
+		if inWord {
+			tokens = append(tokens, shellToken{kind: shellWord, text: word.String(), start: wordStart, end: end})
+			word.Reset()
+			inWord = false
+		}
+	}
+
+	s := cmdLine
+	for i := 0; i < len(s); {
+		c := s[i]
+		if !inWord {
+			wordStart = i
+		}
+
+		switch {
+		case c == '\\':
+			if i+1 < len(s) {
+				if s[i+1] != '\n' {
+					word.WriteByte(s[i+1])
+					inWord = true
+				}
+				i += 2
+			} else {
+				i++
+			}
+			continue
+
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				end = len(s) - i - 1
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			inWord = true
+			i += end + 2
+			continue
+
+		case c == '"':
+			i = lexDoubleQuoted(s, i+1, &word)
+			inWord = true
+			continue
+
+		case c == '$' && i+1 < len(s) && s[i+1] == '\'':
+			i = lexANSIQuoted(s, i+2, &word)
+			inWord = true
+			continue
+
+		case c == '$' && i+1 < len(s) && s[i+1] == '"':
+			i = lexDoubleQuoted(s, i+2, &word)
+			inWord = true
+			continue
+
+		case c == '`' || c == '$' && i+1 < len(s) && (s[i+1] == '(' || s[i+1] == '{'):
+			end := skipSubstitution(s, i)
+			word.WriteString(s[i:end])
+			inWord = true
+			i = end
+			continue
+
+		case c == ' ' || c == '\t' || c == '\r':
+			flush(i)
+			i++
+			continue
+
+		case c == '#' && !inWord:
+			// Comment until end of line
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+			continue
+		}
+
+		if op := matchPrefix(s[i:], redirectOperators); op != "" {
+			// A word made only of digits right before a redirection is its fd number
+			if inWord {
+				if _, err := strconv.Atoi(word.String()); err != nil {
+					flush(i)
+				} else {
+					word.Reset()
+					inWord = false
+				}
+			}
+			tokens = append(tokens, shellToken{kind: shellRedirect, text: op, start: i, end: i + len(op)})
+			i += len(op)
+			continue
+		}
+
+		if op := matchPrefix(s[i:], controlOperators); op != "" {
+			flush(i)
+			tokens = append(tokens, shellToken{kind: shellOperator, text: op, start: i, end: i + len(op)})
+			i += len(op)
+			continue
+		}
+
+		word.WriteByte(c)
+		inWord = true
+		i++
+	}
+
+	flush(len(s))
+	return tokens
+}
+
+// spliceShellWords returns cmdLine with the words respell replaces spelled anew. respell gets
+// the unquoted word and returns its new spelling, already quoted, and whether to use it.
+// Everything else, operators, redirections with their fd, quoting and comments, is kept as
+// written.
+func spliceShellWords(cmdLine string, respell func(word string) (string, bool)) string {
+	var b strings.Builder
+	last := 0
+	for _, token := range lexShell(cmdLine) {
+		if token.kind != shellWord {
+			continue
+		}
+		spelling, ok := respell(token.text)
+		if !ok {
+			continue
+		}
+		b.WriteString(cmdLine[last:token.start])
+		b.WriteString(spelling)
+		last = token.end
+	}
+	if last == 0 {
+		return cmdLine
+	}
+	b.WriteString(cmdLine[last:])
+	return b.String()
+}
+
+func matchPrefix(s string, candidates []string) string {
+	for _, candidate := range candidates {
+		if strings.HasPrefix(s, candidate) {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// lexDoubleQuoted reads a "..." body starting at i and returns the index after the closing quote
+func lexDoubleQuoted(s string, i int, word *strings.Builder) int {
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == '"':
+			return i + 1
+		case c == '`' || c == '$' && i+1 < len(s) && (s[i+1] == '(' || s[i+1] == '{'):
+			end := skipSubstitution(s, i)
+			word.WriteString(s[i:end])
+			i = end
+		case c == '\\' && i+1 < len(s):
+			switch s[i+1] {
+			case '$', '`', '"', '\\':
+				word.WriteByte(s[i+1])
+			case '\n':
+			default:
+				word.WriteByte('\\')
+				word.WriteByte(s[i+1])
+			}
+			i += 2
+		default:
+			word.WriteByte(c)
+			i++
+		}
+	}
+	return i
+}
+
+// skipSubstitution returns the index after the `...`, $(...) or ${...} starting at i. Nested
+// substitutions and quotes inside are skipped as a whole, so their parentheses and blanks don't
+// end the enclosing one.
+func skipSubstitution(s string, i int) int {
+	if s[i] == '`' {
+		for j := i + 1; j < len(s); j++ {
+			switch s[j] {
+			case '\\':
+				j++
+			case '`':
+				return j + 1
+			}
+		}
+		return len(s)
+	}
+
+	open, closing := s[i+1], byte(')')
+	if open == '{' {
+		closing = '}'
+	}
+	depth := 0
+	for j := i + 1; j < len(s); j++ {
+		switch c := s[j]; {
+		case c == '\\':
+			j++
+		case c == '\'':
+			end := strings.IndexByte(s[j+1:], '\'')
+			if end < 0 {
+				return len(s)
+			}
+			j += end + 1
+		case c == '"':
+			var discard strings.Builder
+			j = lexDoubleQuoted(s, j+1, &discard) - 1
+		case c == '`' || c == '$' && j+1 < len(s) && (s[j+1] == '(' || s[j+1] == '{'):
+			j = skipSubstitution(s, j) - 1
+		case c == open:
+			depth++
+		case c == closing:
+			depth--
+			if depth == 0 {
+				return j + 1
+			}
+		}
+	}
+	return len(s)
+}
+
+// lexANSIQuoted reads a $'...' body starting at i and returns the index after the closing quote
+func lexANSIQuoted(s string, i int, word *strings.Builder) int {
+	simple := map[byte]byte{
+		'n': '\n', 't': '\t', 'r': '\r', 'a': '\a', 'b': '\b', 'f': '\f', 'v': '\v',
+		'e': 0x1b, 'E': 0x1b, '\\': '\\', '\'': '\'', '"': '"', '?': '?',
+	}
+
+	for i < len(s) {
+		c := s[i]
+		if c == '\'' {
+			return i + 1
+		}
+		if c != '\\' || i+1 >= len(s) {
+			word.WriteByte(c)
+			i++
+			continue
+		}
+
+		next := s[i+1]
+		if r, ok := simple[next]; ok {
+			word.WriteByte(r)
+			i += 2
+			continue
+		}
+
+		// \xHH and \NNN numeric escapes
+		base, start, maxDigits := 8, i+1, 3
+		if next == 'x' {
+			base, start, maxDigits = 16, i+2, 2
+		}
+		end := start
+		for end < len(s) && end-start < maxDigits && isDigitInBase(s[end], base) {
+			end++
+		}
+		if end == start {
+			word.WriteByte('\\')
+			word.WriteByte(next)
+			i += 2
+			continue
+		}
+		value, _ := strconv.ParseUint(s[start:end], base, 8)
+		word.WriteByte(byte(value))
+		i = end
+	}
+	return i
+}
+
+func isDigitInBase(c byte, base int) bool {
+	if base == 16 {
+		return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+	}
+	return c >= '0' && c <= '7'
+}
+
+// splitCommandChain splits a compound command line into its simple commands, dropping
+// redirections together with their targets
+func splitCommandChain(cmdLine string) []shellCommand {
+	var commands []shellCommand
+	var current shellCommand
+
+	tokens := lexShell(cmdLine)
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		switch token.kind {
+		case shellWord:
+			current.Args = append(current.Args, token.text)
+		case shellRedirect:
+			// Skip the redirection target
+			if i+1 < len(tokens) && tokens[i+1].kind == shellWord {
+				i++
+			}
+		case shellOperator:
+			operator := token.text
+			if operator == "(" || operator == ")" {
+				// Subshells are transparent, the operator after ")" belongs to the last command
+				operator = ""
+			}
+			if len(current.Args) > 0 {
+				current.Operator = operator
+				commands = append(commands, current)
+			} else if last := len(commands) - 1; last >= 0 && commands[last].Operator == "" {
+				commands[last].Operator = operator
+			}
+			current = shellCommand{}
+		}
+	}
+
+	if len(current.Args) > 0 {
+		commands = append(commands, current)
+	}
+
+	return commands
+}
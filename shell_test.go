@@ -0,0 +1,113 @@
+package wrapper
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		cmdLine  string
+		expected []string
+	}{
+		{"plain", "clang -c foo.c", []string{"clang", "-c", "foo.c"}},
+		{"tabs and newlines", "clang\t-c \\\n foo.c", []string{"clang", "-c", "foo.c"}},
+		{"backslash escapes", `clang -DNAME=a\ b -I\"x\"`, []string{"clang", "-DNAME=a b", `-I"x"`}},
+		{"double quotes", `clang "-DSTR=\"a b\"" "-D\x"`, []string{"clang", `-DSTR="a b"`, `-D\x`}},
+		{"single quotes", `clang '-DA="$HOME"' ''`, []string{"clang", `-DA="$HOME"`, ""}},
+		{"ansi-c quotes", `clang $'-DNL=\n' $'\x41\101'`, []string{"clang", "-DNL=\n", "AA"}},
+		{"operators", "a && b||c;d | e", []string{"a", "&&", "b", "||", "c", ";", "d", "|", "e"}},
+		{"quoted operators", `echo '&&' "|"`, []string{"echo", "&&", "|"}},
+		{"command substitution", `clang -c $(cat out/flags.txt) a.c -o a.o`,
+			[]string{"clang", "-c", "$(cat out/flags.txt)", "a.c", "-o", "a.o"}},
+		{"nested substitution", `clang -DV=$(echo "$(date) (x)" | tr ' ' _) a.c`,
+			[]string{"clang", `-DV=$(echo "$(date) (x)" | tr ' ' _)`, "a.c"}},
+		{"quoted substitution", `clang "-DV=$(echo ")")" ${OUT:-a b}`, []string{"clang", `-DV=$(echo ")")`, "${OUT:-a b}"}},
+		{"backticks", "clang -DX=`echo 1` a.c", []string{"clang", "-DX=`echo 1`", "a.c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitCommandLine(tt.cmdLine); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestSplitCommandChain(t *testing.T) {
+	cmdLine := "versioner -o gen/include bionic/libc/include && touch versioner.timestamp; " +
+		"(cd out && clang -c a.c -o a.o 2>&1 > log.txt) | tee out.log &"
+
+	expected := []shellCommand{
+		{Args: []string{"versioner", "-o", "gen/include", "bionic/libc/include"}, Operator: "&&"},
+		{Args: []string{"touch", "versioner.timestamp"}, Operator: ";"},
+		{Args: []string{"cd", "out"}, Operator: "&&"},
+		{Args: []string{"clang", "-c", "a.c", "-o", "a.o"}, Operator: "|"},
+		{Args: []string{"tee", "out.log"}, Operator: "&"},
+	}
+
+	if got := splitCommandChain(cmdLine); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestCompilerInvocation(t *testing.T) {
+	tests := []struct {
+		name         string
+		command      string
+		expectedArgs []string
+		expectedType string
+	}{
+		{
+			name:         "compiler after setup stage",
+			command:      "mkdir -p out && PWD=/proc/self/cwd prebuilts/clang/bin/clang -c a.c -o out/a.o > out/a.log",
+			expectedArgs: []string{"PWD=/proc/self/cwd", "prebuilts/clang/bin/clang", "-c", "a.c", "-o", "out/a.o"},
+			expectedType: "clang",
+		},
+		{
+			name:         "versioner is not clang",
+			command:      "prebuilts/clang-tools/linux-x86/bin/versioner -o out/gen bionic/libc/include && touch out/versioner.timestamp",
+			expectedArgs: []string{"prebuilts/clang-tools/linux-x86/bin/versioner", "-o", "out/gen", "bionic/libc/include"},
+			expectedType: "",
+		},
+		{
+			name:         "empty",
+			command:      "",
+			expectedArgs: nil,
+			expectedType: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := compilerInvocation(tt.command)
+			if !reflect.DeepEqual(args, tt.expectedArgs) {
+				t.Errorf("Expected args %q, got %q", tt.expectedArgs, args)
+			}
+			if got := determineCompilerTypeFromCommand(tt.command); got != tt.expectedType {
+				t.Errorf("Expected compiler type %q, got %q", tt.expectedType, got)
+			}
+		})
+	}
+}
+
+func TestSpliceShellWords(t *testing.T) {
+	upper := func(word string) (string, bool) {
+		if word != "a.o" && word != "x y" {
+			return "", false
+		}
+		return shellQuote(strings.ToUpper(word)), true
+	}
+	for cmdLine, want := range map[string]string{
+		"cc -o a.o 2>a.o":              "cc -o A.O 2>A.O",
+		`cc 'x y' "$HOME"  ; echo a.o`: `cc 'X Y' "$HOME"  ; echo A.O`,
+		"cc -c b.c # a.o":              "cc -c b.c # a.o",
+	} {
+		if got := spliceShellWords(cmdLine, upper); got != want {
+			t.Errorf("For %q expected %q, got %q", cmdLine, want, got)
+		}
+	}
+}
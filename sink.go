@@ -0,0 +1,604 @@
+package wrapper
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+// Sink receives the extracted compilation database. Sinks run in the order they are configured
+// in WrapperConfig.Sinks; each sees the files written by the sinks before it, so a sink can
+// post-process the output of an earlier one.
+type Sink interface {
+	// Name identifies the sink in logs and errors
+	Name() string
+	// Write delivers commands and returns the files it wrote. A sink reporting an error may
+	// still return the files it managed to write.
+	Write(ctx context.Context, commands CommandDatabase, written []string) ([]string, error)
+}
+
+// StreamingSink is a Sink that can also take the database one command at a time, so the
+// commands of a full build are delivered as they are extracted instead of once all are
+// collected. Sinks run in the same order either way.
+type StreamingSink interface {
+	Sink
+	// Stream starts delivering a database, or returns nil when the sink needs the whole
+	// database at once. Problems starting it are reported by CommandStream.Close.
+	Stream(ctx context.Context) CommandStream
+}
+
+// CommandStream receives the commands of one database from a StreamingSink
+type CommandStream interface {
+	// Add delivers the next command. After an error the stream receives no further commands,
+	// Close still ends it and reports the failure.
+	Add(info CompilerCommandInfo) error
+	// Close ends the database and returns the files written, like Sink.Write
+	Close(ctx context.Context, written []string) ([]string, error)
+	// Abort discards the database, leaving the output of earlier runs in place
+	Abort()
+}
+
+// configuredSinks returns the sinks of config, the default ones when none are configured
+func configuredSinks(config WrapperConfig) []Sink {
+	if config.Sinks != nil {
+		return config.Sinks
+	}
+	return defaultSinks(config)
+}
+
+// defaultSinks writes the configured formats to OutDir and runs proxy on the internal database
+func defaultSinks(config WrapperConfig) []Sink {
+	format := effectiveCompdbFormat(config)
+	sinks := []Sink{&FileSink{
+		Dir:            config.OutDir,
+		Format:         format,
+		ClangArguments: config.ClangArguments,
+		ShardBy:        config.ShardBy,
+	}}
+	if format.Has(CompdbFormatInternal) {
+		sinks = append(sinks, &ProxySink{
+			Database: filepath.Join(config.OutDir, CompileCommandsFile),
+			BuildTop: os.Getenv("ANDROID_BUILD_TOP"),
+		})
+	}
+	return sinks
+}
+
+// FileSink writes the database to Dir in every selected format. A failing format doesn't keep
+// the others from being written.
+type FileSink struct {
+	Dir            string
+	Format         CompdbFormat // Layouts to write, internal only when zero
+	ClangArguments bool         // Emit "arguments" instead of "command" in the clang layout
+	ShardBy        ShardMode    // How CompdbFormatShards splits the database
+}
+
+func (s *FileSink) Name() string {
+	return "file"
+}
+
+func (s *FileSink) Write(ctx context.Context, commands CommandDatabase, _ []string) ([]string, error) {
+	var files []string
+	var errs []error
+	written := func(file string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w: %s: %w", ErrWriteFailed, file, err))
+			return
+		}
+		files = append(files, file)
+	}
+
+	format := s.Format
+	if format == 0 {
+		format = CompdbFormatInternal
+	}
+	// Once ctx is done the remaining layouts are not started
+	skipped := 0
+	selected := func(layout CompdbFormat) bool {
+		if !format.Has(layout) {
+			return false
+		}
+		if ctx.Err() != nil {
+			skipped++
+			return false
+		}
+		return true
+	}
+
+	if selected(CompdbFormatInternal) {
+		err := writeCompileCommands(ctx, s.Dir, commands)
+		if err != nil {
+			fmt.Printf("Error: Failed to write compilation command database: %v\n", err)
+		} else {
+			fmt.Printf("Compilation command database has been written to: %s/%s\n", s.Dir, CompileCommandsFile)
+		}
+		written(filepath.Join(s.Dir, CompileCommandsFile), err)
+	}
+
+	if selected(CompdbFormatClang) {
+		clangDir := filepath.Join(s.Dir, ClangCompileCommandsDir)
+		err := writeClangCompileCommands(ctx, clangDir, commands, s.ClangArguments)
+		if err != nil {
+			fmt.Printf("Error: Failed to write clang compilation database: %v\n", err)
+		} else {
+			fmt.Printf("Clang compilation database has been written to: %s/%s\n", clangDir, CompileCommandsFile)
+		}
+		written(filepath.Join(clangDir, CompileCommandsFile), err)
+	}
+
+	if selected(CompdbFormatJavaProjects) {
+		err := writeJavaProjects(s.Dir, commands)
+		if err != nil {
+			fmt.Printf("Error: Failed to write Java project descriptions: %v\n", err)
+		} else {
+			fmt.Printf("Java project descriptions have been written to: %s/%s\n", s.Dir, JavaProjectsFile)
+		}
+		written(filepath.Join(s.Dir, JavaProjectsFile), err)
+	}
+
+	if selected(CompdbFormatRustProject) {
+		err := writeRustProject(s.Dir, commands)
+		if err != nil {
+			fmt.Printf("Error: Failed to write rust-project.json: %v\n", err)
+		} else {
+			fmt.Printf("Rust project description has been written to: %s/%s\n", s.Dir, RustProjectFile)
+		}
+		written(filepath.Join(s.Dir, RustProjectFile), err)
+	}
+
+	if selected(CompdbFormatShards) {
+		shardDir := filepath.Join(s.Dir, CompdbShardDir)
+		err := writeShardedCompileCommands(shardDir, commands, s.ShardBy, s.ClangArguments)
+		if err != nil {
+			fmt.Printf("Error: Failed to write sharded compilation database: %v\n", err)
+		} else {
+			fmt.Printf("Sharded compilation database has been written to: %s/%s\n", shardDir, CompdbShardIndexFile)
+		}
+		written(filepath.Join(shardDir, CompdbShardIndexFile), err)
+	}
+
+	if skipped > 0 {
+		fmt.Printf("Error: Skipped %d layouts: %v\n", skipped, ctx.Err())
+		errs = append(errs, fmt.Errorf("%w: %d layouts not written: %w", ErrWriteFailed, skipped, ctx.Err()))
+	}
+	return files, errors.Join(errs...)
+}
+
+// Stream writes the internal and clang layouts as commands arrive; the other layouts need
+// the whole database
+func (s *FileSink) Stream(_ context.Context) CommandStream {
+	format := s.Format
+	if format == 0 {
+		format = CompdbFormatInternal
+	}
+	if format&^(CompdbFormatInternal|CompdbFormatClang) != 0 {
+		return nil
+	}
+
+	stream := &fileStream{}
+	if format.Has(CompdbFormatInternal) {
+		stream.open(s.Dir, CompdbFormatInternal, false, "compilation command database", "Compilation command database")
+	}
+	if format.Has(CompdbFormatClang) {
+		stream.open(filepath.Join(s.Dir, ClangCompileCommandsDir), CompdbFormatClang, s.ClangArguments,
+			"clang compilation database", "Clang compilation database")
+	}
+	return stream
+}
+
+// fileStream is the CommandStream of a FileSink. A failing layout doesn't keep the others
+// from being written.
+type fileStream struct {
+	files []*streamedFile
+}
+
+// streamedFile is one layout a fileStream writes
+type streamedFile struct {
+	dir     string
+	what    string // Names the layout in messages
+	title   string // what, capitalized
+	file    *atomicFile
+	encoder *commandEncoder
+	err     error
+}
+
+func (s *fileStream) open(dir string, format CompdbFormat, useArguments bool, what, title string) {
+	f := &streamedFile{dir: dir, what: what, title: title}
+	s.files = append(s.files, f)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		f.err = fmt.Errorf("failed to create output directory: %v", err)
+		return
+	}
+	if f.file, f.err = createAtomicFile(dir, CompileCommandsFile); f.err != nil {
+		return
+	}
+	if f.encoder, f.err = newCommandEncoder(f.file, format, useArguments); f.err != nil {
+		f.file.abort()
+	}
+}
+
+func (s *fileStream) Add(info CompilerCommandInfo) error {
+	for _, f := range s.files {
+		if f.err != nil {
+			continue
+		}
+		if err := f.encoder.add(info); err != nil {
+			f.err = fmt.Errorf("failed to write temporary file: %v", err)
+			f.file.abort()
+		}
+	}
+	return nil
+}
+
+func (s *fileStream) Close(ctx context.Context, _ []string) ([]string, error) {
+	var files []string
+	var errs []error
+	for _, f := range s.files {
+		err := f.err
+		if err == nil && ctx.Err() != nil {
+			f.file.abort()
+			err = ctx.Err()
+		}
+		if err == nil {
+			if err = f.encoder.close(); err != nil {
+				f.file.abort()
+				err = fmt.Errorf("failed to write temporary file: %v", err)
+			} else {
+				err = f.file.commit()
+			}
+		}
+
+		file := filepath.Join(f.dir, CompileCommandsFile)
+		if err != nil {
+			fmt.Printf("Error: Failed to write %s: %v\n", f.what, err)
+			errs = append(errs, fmt.Errorf("%w: %s: %w", ErrWriteFailed, file, err))
+			continue
+		}
+		fmt.Printf("%s has been written to: %s/%s\n", f.title, f.dir, CompileCommandsFile)
+		files = append(files, file)
+	}
+	return files, errors.Join(errs...)
+}
+
+func (s *fileStream) Abort() {
+	for _, f := range s.files {
+		if f.err == nil {
+			f.file.abort()
+		}
+	}
+}
+
+// ProxySink runs the proxy indexer on the internal database an earlier sink wrote. It is
+// skipped when the database was not written, and reports ErrSinkSkipped when the executable
+// is not installed.
+type ProxySink struct {
+	Database   string // Internal database the proxy reads
+	BuildTop   string // Source tree root passed as -w
+	Executable string // proxy when empty
+}
+
+func (s *ProxySink) Name() string {
+	return "proxy"
+}
+
+func (s *ProxySink) Write(ctx context.Context, _ CommandDatabase, written []string) ([]string, error) {
+	found := false
+	for _, file := range written {
+		if file == s.Database {
+			found = true
+			break
+		}
+	}
+	if !found {
+		fmt.Printf("Skipping proxy, %s was not written\n", s.Database)
+		return nil, nil
+	}
+
+	executable := s.Executable
+	if executable == "" {
+		executable = "proxy"
+	}
+	if _, err := exec.LookPath(executable); err != nil {
+		fmt.Printf("Warning: Skipping proxy, %s is not installed\n", executable)
+		return nil, fmt.Errorf("%w: proxy: %s is not installed", ErrSinkSkipped, executable)
+	}
+
+	fmt.Printf("Running proxy: %s -w %s -c %s\n", executable, s.BuildTop, s.Database)
+	cmd := commandContext(ctx, executable, "-w", s.BuildTop, "-c", s.Database)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%w: failed to run proxy command: %v", ErrProxyFailed, err)
+	}
+
+	return nil, nil
+}
+
+// Stream runs the proxy once the database is closed, it needs no commands itself
+func (s *ProxySink) Stream(_ context.Context) CommandStream {
+	return &proxyStream{sink: s}
+}
+
+// proxyStream is the CommandStream of a ProxySink
+type proxyStream struct {
+	sink *ProxySink
+}
+
+func (s *proxyStream) Add(CompilerCommandInfo) error {
+	return nil
+}
+
+func (s *proxyStream) Close(ctx context.Context, written []string) ([]string, error) {
+	return s.sink.Write(ctx, CommandDatabase{}, written)
+}
+
+func (s *proxyStream) Abort() {}
+
+// HTTPSink uploads the database to URL with a streamed POST request
+type HTTPSink struct {
+	URL    string
+	Format CompdbFormat // CompdbFormatInternal or CompdbFormatClang, internal when zero
+	Header http.Header  // Additional request headers, e.g. authorization
+	Client *http.Client // http.DefaultClient when nil
+}
+
+func (s *HTTPSink) Name() string {
+	return "http"
+}
+
+func (s *HTTPSink) Write(ctx context.Context, commands CommandDatabase, written []string) ([]string, error) {
+	stream := s.Stream(ctx)
+	for _, info := range commands.Commands {
+		if err := stream.Add(info); err != nil {
+			break
+		}
+	}
+	return stream.Close(ctx, written)
+}
+
+// Stream uploads the commands as they arrive. The request starts with the first command, so a
+// stream that is aborted right away sends nothing.
+func (s *HTTPSink) Stream(ctx context.Context) CommandStream {
+	return &httpStream{sink: s, ctx: ctx}
+}
+
+// upload posts body to URL
+func (s *HTTPSink) upload(ctx context.Context, body *io.PipeReader) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, body)
+	if err != nil {
+		_ = body.CloseWithError(err)
+		return err
+	}
+	for name, values := range s.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("upload to %s failed: %v", s.URL, err)
+	}
+	// The body is drained so the connection can be reused
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("upload to %s failed: %s", s.URL, resp.Status)
+	}
+	return nil
+}
+
+// errStreamAborted ends the request body of an aborted upload
+var errStreamAborted = errors.New("database discarded")
+
+// httpStream is the CommandStream of an HTTPSink, encoding into the body of the running request
+type httpStream struct {
+	sink    *HTTPSink
+	ctx     context.Context
+	pipe    *io.PipeWriter
+	w       *bufio.Writer
+	encoder *commandEncoder
+	done    chan error // Result of the request
+	err     error
+}
+
+// start sends the request
+func (s *httpStream) start() {
+	body, pipe := io.Pipe()
+	s.pipe, s.w, s.done = pipe, bufio.NewWriter(pipe), make(chan error, 1)
+	go func() {
+		s.done <- s.sink.upload(s.ctx, body)
+	}()
+
+	format := CompdbFormatInternal
+	if s.sink.Format == CompdbFormatClang {
+		format = CompdbFormatClang
+	}
+	s.encoder, s.err = newCommandEncoder(s.w, format, false)
+}
+
+func (s *httpStream) Add(info CompilerCommandInfo) error {
+	if s.pipe == nil {
+		s.start()
+	}
+	if s.err == nil {
+		s.err = s.encoder.add(info)
+	}
+	return s.err
+}
+
+func (s *httpStream) Close(_ context.Context, _ []string) ([]string, error) {
+	if s.pipe == nil {
+		s.start()
+	}
+	err := s.err
+	if err == nil {
+		err = s.encoder.close()
+	}
+	if err == nil {
+		err = s.w.Flush()
+	}
+	_ = s.pipe.CloseWithError(err)
+	// A failed request explains a failed write best
+	if uploadErr := <-s.done; uploadErr != nil {
+		err = uploadErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Compilation command database has been uploaded to: %s\n", s.sink.URL)
+	return nil, nil
+}
+
+func (s *httpStream) Abort() {
+	if s.pipe != nil {
+		_ = s.pipe.CloseWithError(errStreamAborted)
+		<-s.done
+	}
+}
+
+// MemorySink keeps every database written to it, for embedding callers and tests
+type MemorySink struct {
+	mu        sync.Mutex
+	databases []CommandDatabase
+}
+
+func (s *MemorySink) Name() string {
+	return "memory"
+}
+
+func (s *MemorySink) Write(_ context.Context, commands CommandDatabase, _ []string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.databases = append(s.databases, commands)
+	return nil, nil
+}
+
+// Stream collects the commands and keeps them as one database once closed
+func (s *MemorySink) Stream(_ context.Context) CommandStream {
+	return &memoryStream{sink: s, commands: CommandDatabase{Commands: []CompilerCommandInfo{}}}
+}
+
+// memoryStream is the CommandStream of a MemorySink
+type memoryStream struct {
+	sink     *MemorySink
+	commands CommandDatabase
+}
+
+func (s *memoryStream) Add(info CompilerCommandInfo) error {
+	s.commands.Commands = append(s.commands.Commands, info)
+	return nil
+}
+
+func (s *memoryStream) Close(ctx context.Context, written []string) ([]string, error) {
+	return s.sink.Write(ctx, s.commands, written)
+}
+
+func (s *memoryStream) Abort() {}
+
+// Databases returns the databases written so far, oldest first
+func (s *MemorySink) Databases() []CommandDatabase {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]CommandDatabase(nil), s.databases...)
+}
+
+// runSinks delivers commands to sinks in order, recording written files in result
+func runSinks(ctx context.Context, sinks []Sink, commands CommandDatabase, result *Result) error {
+	var errs []error
+	for _, sink := range sinks {
+		files, err := sink.Write(ctx, commands, result.Outputs)
+		result.Outputs = append(result.Outputs, files...)
+		if err := sinkError(sink, err, result); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sinkError wraps the error of sink with ErrWriteFailed unless it wraps another sentinel. A
+// skipped sink is recorded as a warning in result and fails nothing.
+func sinkError(sink Sink, err error, result *Result) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, ErrSinkSkipped) {
+		result.Warnings = append(result.Warnings, err)
+		return nil
+	}
+	if !errors.Is(err, ErrWriteFailed) && !errors.Is(err, ErrProxyFailed) {
+		return fmt.Errorf("%w: %s sink: %w", ErrWriteFailed, sink.Name(), err)
+	}
+	return err
+}
+
+// sinkStreams delivers the commands of one database to the streams of the configured sinks
+type sinkStreams struct {
+	sinks   []Sink
+	streams []CommandStream
+	errs    []error // Add error of each stream
+}
+
+// openSinkStreams starts a stream on every sink, or returns nil when one of them needs the
+// whole database
+func openSinkStreams(ctx context.Context, sinks []Sink) *sinkStreams {
+	s := &sinkStreams{sinks: sinks, errs: make([]error, len(sinks))}
+	for _, sink := range sinks {
+		var stream CommandStream
+		if streaming, ok := sink.(StreamingSink); ok {
+			stream = streaming.Stream(ctx)
+		}
+		if stream == nil {
+			s.abort()
+			return nil
+		}
+		s.streams = append(s.streams, stream)
+	}
+	return s
+}
+
+// add delivers info to every stream that didn't fail yet
+func (s *sinkStreams) add(info CompilerCommandInfo) {
+	for i, stream := range s.streams {
+		if s.errs[i] == nil {
+			s.errs[i] = stream.Add(info)
+		}
+	}
+}
+
+// close ends the database on every stream in order, recording written files in result like
+// runSinks
+func (s *sinkStreams) close(ctx context.Context, result *Result) error {
+	var errs []error
+	for i, stream := range s.streams {
+		files, err := stream.Close(ctx, result.Outputs)
+		if err == nil {
+			err = s.errs[i]
+		}
+		result.Outputs = append(result.Outputs, files...)
+		if err := sinkError(s.sinks[i], err, result); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// abort discards the database on every stream
+func (s *sinkStreams) abort() {
+	for _, stream := range s.streams {
+		stream.Abort()
+	}
+}
@@ -0,0 +1,224 @@
+package wrapper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type failingSink struct{}
+
+func (failingSink) Name() string { return "failing" }
+
+func (failingSink) Write(context.Context, CommandDatabase, []string) ([]string, error) {
+	return nil, errors.New("unavailable")
+}
+
+func sinkTestDatabase() CommandDatabase {
+	return CommandDatabase{Commands: []CompilerCommandInfo{{
+		Command:      "clang -c a.c -o a.o",
+		CompilerType: "clang",
+		InputFiles:   []string{"a.c"},
+		OutputFile:   "a.o",
+		WorkingDir:   "/src",
+	}}}
+}
+
+func TestRunSinks(t *testing.T) {
+	dir := t.TempDir()
+	memory := &MemorySink{}
+	sinks := []Sink{
+		&FileSink{Dir: dir, Format: CompdbFormatInternal | CompdbFormatClang},
+		failingSink{},
+		memory,
+	}
+
+	result := &Result{}
+	err := runSinks(context.Background(), sinks, sinkTestDatabase(), result)
+	if !errors.Is(err, ErrWriteFailed) || !strings.Contains(err.Error(), "failing sink") {
+		t.Errorf("Expected the failing sink to be reported, got %v", err)
+	}
+
+	// A failing sink doesn't stop the chain
+	want := []string{
+		filepath.Join(dir, CompileCommandsFile),
+		filepath.Join(dir, ClangCompileCommandsDir, CompileCommandsFile),
+	}
+	if !reflect.DeepEqual(result.Outputs, want) {
+		t.Errorf("Expected outputs %v, got %v", want, result.Outputs)
+	}
+	if databases := memory.Databases(); len(databases) != 1 || !reflect.DeepEqual(databases[0], sinkTestDatabase()) {
+		t.Errorf("Expected the memory sink to receive the database, got %+v", databases)
+	}
+}
+
+func TestFileSinkCancelled(t *testing.T) {
+	dir := t.TempDir()
+	sink := &FileSink{Dir: dir, Format: CompdbFormatInternal | CompdbFormatClang}
+	if _, err := sink.Write(context.Background(), sinkTestDatabase(), nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// A cancelled write leaves the previous databases in place
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	files, err := sink.Write(ctx, CommandDatabase{Commands: []CompilerCommandInfo{}}, nil)
+	if len(files) != 0 || !errors.Is(err, ErrWriteFailed) || !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the cancelled write to fail, got %v: %v", files, err)
+	}
+	for _, file := range []string{filepath.Join(dir, CompileCommandsFile), filepath.Join(dir, ClangCompileCommandsDir, CompileCommandsFile)} {
+		if data, _ := os.ReadFile(file); !strings.Contains(string(data), "a.c") {
+			t.Errorf("Expected %s to be kept, got %s", file, data)
+		}
+	}
+
+	stream := sink.Stream(context.Background())
+	if err := stream.Add(CompilerCommandInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Close(ctx, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the cancelled stream to fail, got %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, CompileCommandsFile)); !strings.Contains(string(data), "a.c") {
+		t.Errorf("Expected the database to be kept, got %s", data)
+	}
+}
+
+func TestProxySink(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "proxy.log")
+	proxy := filepath.Join(dir, "fake-proxy")
+	if err := os.WriteFile(proxy, []byte("#!/bin/sh\necho \"$@\" > "+logFile+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	database := filepath.Join(dir, CompileCommandsFile)
+	sink := &ProxySink{Database: database, BuildTop: "/top", Executable: proxy}
+
+	if _, err := sink.Write(context.Background(), CommandDatabase{}, nil); err != nil {
+		t.Errorf("Expected proxy to be skipped without the database, got %v", err)
+	}
+	if _, err := os.Stat(logFile); !os.IsNotExist(err) {
+		t.Errorf("Expected proxy not to run, got %v", err)
+	}
+
+	if _, err := sink.Write(context.Background(), CommandDatabase{}, []string{database}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if data, _ := os.ReadFile(logFile); strings.TrimSpace(string(data)) != "-w /top -c "+database {
+		t.Errorf("Unexpected proxy arguments %q", data)
+	}
+
+	// A missing proxy is a warning of the run
+	sink.Executable = filepath.Join(dir, "missing-proxy")
+	if _, err := sink.Write(context.Background(), CommandDatabase{}, []string{database}); !errors.Is(err, ErrSinkSkipped) {
+		t.Errorf("Expected ErrSinkSkipped, got %v", err)
+	}
+	result := &Result{Outputs: []string{database}}
+	if err := runSinks(context.Background(), []Sink{sink}, CommandDatabase{}, result); err != nil || len(result.Warnings) != 1 {
+		t.Errorf("Expected a missing proxy to be a warning, got %v and warnings %v", err, result.Warnings)
+	}
+
+	sink.Executable = "false"
+	if _, err := sink.Write(context.Background(), CommandDatabase{}, []string{database}); !errors.Is(err, ErrProxyFailed) {
+		t.Errorf("Expected ErrProxyFailed, got %v", err)
+	}
+}
+
+func TestHTTPSink(t *testing.T) {
+	var received []CompileCommand
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	sink := &HTTPSink{URL: server.URL, Format: CompdbFormatClang, Header: http.Header{"Authorization": {"Bearer token"}}}
+	if _, err := sink.Write(context.Background(), sinkTestDatabase(), nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(received) != 1 || received[0].File != "a.c" || auth != "Bearer token" {
+		t.Errorf("Unexpected upload %+v with authorization %q", received, auth)
+	}
+
+	// The internal layout isn't an array, the server rejects it
+	sink.Format = CompdbFormatInternal
+	if _, err := sink.Write(context.Background(), sinkTestDatabase(), nil); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("Expected the rejected upload to fail, got %v", err)
+	}
+}
+
+func TestSinkStreams(t *testing.T) {
+	buffered, streamed := t.TempDir(), t.TempDir()
+	commands := sinkTestDatabase()
+	commands.Commands = append(commands.Commands, CompilerCommandInfo{
+		Command:      "clang -c b.c -o b.o",
+		CompilerType: "clang",
+		InputFiles:   []string{"b.c"},
+		OutputFile:   "b.o",
+		WorkingDir:   "/src",
+	})
+	format := CompdbFormatInternal | CompdbFormatClang
+	if err := runSinks(context.Background(), []Sink{&FileSink{Dir: buffered, Format: format}}, commands, &Result{}); err != nil {
+		t.Fatal(err)
+	}
+
+	memory := &MemorySink{}
+	streams := openSinkStreams(context.Background(), []Sink{&FileSink{Dir: streamed, Format: format}, memory})
+	if streams == nil {
+		t.Fatal("Expected the file and memory sinks to stream")
+	}
+	for _, info := range commands.Commands {
+		streams.add(info)
+	}
+	result := &Result{}
+	if err := streams.close(context.Background(), result); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// A streamed database is the one written at once
+	for _, file := range []string{CompileCommandsFile, filepath.Join(ClangCompileCommandsDir, CompileCommandsFile)} {
+		want, _ := os.ReadFile(filepath.Join(buffered, file))
+		got, err := os.ReadFile(filepath.Join(streamed, file))
+		if err != nil || string(got) != string(want) {
+			t.Errorf("Expected streamed %s to match:\n%s\ngot:\n%s (%v)", file, want, got, err)
+		}
+	}
+	if len(result.Outputs) != 2 {
+		t.Errorf("Expected 2 outputs, got %v", result.Outputs)
+	}
+	if databases := memory.Databases(); len(databases) != 1 || !reflect.DeepEqual(databases[0], commands) {
+		t.Errorf("Expected the memory sink to receive the database, got %+v", databases)
+	}
+
+	// An aborted stream leaves the previous database and no temporary file
+	streams = openSinkStreams(context.Background(), []Sink{&FileSink{Dir: streamed}})
+	streams.add(sinkTestDatabase().Commands[0])
+	streams.abort()
+	if got, _ := os.ReadFile(filepath.Join(streamed, CompileCommandsFile)); !strings.Contains(string(got), "b.c") {
+		t.Errorf("Expected the previous database to be kept, got %s", got)
+	}
+	if entries, _ := os.ReadDir(streamed); len(entries) != 2 {
+		t.Errorf("Expected no temporary files, got %v", entries)
+	}
+
+	// Layouts that group commands, and sinks that don't stream, need the whole database
+	if openSinkStreams(context.Background(), []Sink{&FileSink{Dir: streamed, Format: CompdbFormatShards}}) != nil {
+		t.Error("Expected the sharded layout not to stream")
+	}
+	if openSinkStreams(context.Background(), []Sink{&FileSink{Dir: streamed}, failingSink{}}) != nil {
+		t.Error("Expected a sink without Stream to disable streaming")
+	}
+	if entries, _ := os.ReadDir(streamed); len(entries) != 2 {
+		t.Errorf("Expected no temporary files, got %v", entries)
+	}
+}
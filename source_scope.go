@@ -0,0 +1,190 @@
+package wrapper
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// sourceScope decides which commands are kept when SourceRootDirs limits the database to some
+// source trees. Patterns are paths relative to the source root whose segments may be globs,
+// and match everything below them; a leading ! (or - as in PRODUCT_SOURCE_ROOT_DIRS) excludes.
+type sourceScope struct {
+	root      string
+	include   [][]string
+	exclude   [][]string
+	outDirs   []string // Root-relative directories holding generated sources
+	prebuilts bool
+	generated bool
+}
+
+// newSourceScope returns the scope of config, or nil when every command is in scope
+func newSourceScope(config WrapperConfig) *sourceScope {
+	if len(config.SourceRootDirs) == 0 {
+		return nil
+	}
+
+	scope := &sourceScope{
+		root:      os.Getenv("ANDROID_BUILD_TOP"),
+		prebuilts: config.IncludePrebuilts,
+		generated: config.IncludeGenerated,
+	}
+
+	for _, dir := range config.SourceRootDirs {
+		dir = strings.TrimSpace(dir)
+		excluded := strings.HasPrefix(dir, "!") || strings.HasPrefix(dir, "-")
+		if excluded {
+			dir = dir[1:]
+		}
+		dir = path.Clean(filepath.ToSlash(dir))
+		if dir == "." || dir == "" {
+			continue
+		}
+		segments := strings.Split(strings.Trim(dir, "/"), "/")
+		if excluded {
+			scope.exclude = append(scope.exclude, segments)
+		} else {
+			scope.include = append(scope.include, segments)
+		}
+	}
+
+	scope.outDirs = []string{"out"}
+	for _, dir := range []string{config.OutDir, config.SoongOutDir} {
+		if dir == "" {
+			continue
+		}
+		if rel := scope.relative("", dir); rel != "" && !strings.HasPrefix(rel, "/") && !strings.HasPrefix(rel, "../") {
+			scope.outDirs = append(scope.outDirs, rel)
+		}
+	}
+
+	return scope
+}
+
+// relative returns file, relative to workingDir, as a slash separated path relative to the source
+// root; files outside the root stay absolute
+func (s *sourceScope) relative(workingDir, file string) string {
+	if !filepath.IsAbs(file) {
+		if workingDir == "" {
+			workingDir = s.root
+		} else if !filepath.IsAbs(workingDir) {
+			workingDir = filepath.Join(s.root, workingDir)
+		}
+		file = filepath.Join(workingDir, file)
+	}
+	if s.root != "" {
+		if rel, err := filepath.Rel(s.root, file); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return filepath.ToSlash(rel)
+		}
+	} else if !filepath.IsAbs(file) {
+		return filepath.ToSlash(filepath.Clean(file))
+	}
+	return filepath.ToSlash(file)
+}
+
+// matchSegments reports whether pattern matches file or one of its parent directories
+func matchSegments(pattern []string, file string) bool {
+	segments := strings.Split(file, "/")
+	if len(pattern) > len(segments) {
+		return false
+	}
+	for i, p := range pattern {
+		if ok, err := path.Match(p, segments[i]); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// isGenerated reports whether a root-relative file is produced by the build
+func (s *sourceScope) isGenerated(file string) bool {
+	for _, dir := range s.outDirs {
+		if file == dir || strings.HasPrefix(file, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether a root-relative source file is in scope
+func (s *sourceScope) contains(file string) bool {
+	if s.isGenerated(file) {
+		return s.generated
+	}
+
+	for _, pattern := range s.exclude {
+		if matchSegments(pattern, file) {
+			return false
+		}
+	}
+
+	prebuilt := file == "prebuilts" || strings.HasPrefix(file, "prebuilts/")
+	if prebuilt && s.prebuilts {
+		return true
+	}
+	if len(s.include) == 0 {
+		return !prebuilt
+	}
+	for _, pattern := range s.include {
+		// Wildcards don't pull prebuilts/ into scope, only naming it does
+		if prebuilt && pattern[0] != "prebuilts" {
+			continue
+		}
+		if matchSegments(pattern, file) {
+			return true
+		}
+	}
+	return false
+}
+
+// keep reports whether info has at least one input in scope
+func (s *sourceScope) keep(info CompilerCommandInfo) bool {
+	for _, file := range info.InputFiles {
+		if s.contains(s.relative(info.WorkingDir, file)) {
+			return true
+		}
+	}
+	return false
+}
+
+// collectGenerated adds the generated include directories and headers info references to generated
+func (s *sourceScope) collectGenerated(info CompilerCommandInfo, generated map[string]bool) {
+	for _, paths := range [][]string{info.Includes, info.SystemIncludes, info.QuoteIncludes, info.AfterIncludes,
+		info.ForcedIncludes, info.MacroIncludes, info.Headers} {
+		for _, include := range paths {
+			if rel := s.relative(info.WorkingDir, include); s.isGenerated(rel) {
+				generated[rel] = true
+			}
+		}
+	}
+}
+
+// sortedPaths returns the keys of set in order
+func sortedPaths(set map[string]bool) []string {
+	paths := make([]string, 0, len(set))
+	for path := range set {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// filter returns the commands with at least one input in scope, and the generated include
+// directories and headers those commands reference, so they can be indexed as well. Headers are
+// only known once attachHeaders ran.
+func (s *sourceScope) filter(commands CommandDatabase) (CommandDatabase, []string) {
+	scoped := CommandDatabase{Commands: make([]CompilerCommandInfo, 0, len(commands.Commands))}
+	generated := map[string]bool{}
+
+	for _, info := range commands.Commands {
+		if !s.keep(info) {
+			continue
+		}
+		scoped.Commands = append(scoped.Commands, info)
+		s.collectGenerated(info, generated)
+	}
+
+	return scoped, sortedPaths(generated)
+}
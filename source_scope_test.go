@@ -0,0 +1,89 @@
+package wrapper
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestSourceScopeContains(t *testing.T) {
+	t.Setenv("ANDROID_BUILD_TOP", "/aosp")
+	scope := newSourceScope(WrapperConfig{
+		OutDir:         "/aosp/out",
+		SourceRootDirs: []string{"frameworks/base", "vendor/*/audio", "!frameworks/base/tests", "-vendor/acme/audio/legacy"},
+	})
+
+	for file, want := range map[string]bool{
+		"frameworks/base/core/jni/a.cpp":  true,
+		"frameworks/base/tests/t.cpp":     false,
+		"frameworks/native/b.cpp":         false,
+		"vendor/acme/audio/hal.c":         true,
+		"vendor/acme/audio/legacy/old.c":  false,
+		"vendor/acme/camera/cam.c":        false,
+		"out/soong/.intermediates/gen.c":  false,
+		"prebuilts/clang/host/lib/x.c":    false,
+		"/opt/elsewhere/frameworks/base/": false,
+	} {
+		if got := scope.contains(file); got != want {
+			t.Errorf("contains(%q) = %v, want %v", file, got, want)
+		}
+	}
+
+	if newSourceScope(WrapperConfig{}) != nil {
+		t.Error("Expected no scope without SourceRootDirs")
+	}
+
+	// Toggles bring generated sources and prebuilts back into scope
+	scope = newSourceScope(WrapperConfig{SourceRootDirs: []string{"!external"}, IncludeGenerated: true})
+	if !scope.contains("out/soong/.intermediates/gen.c") || scope.contains("prebuilts/x.c") || !scope.contains("system/core/a.c") {
+		t.Error("Expected generated sources and everything but external and prebuilts to be in scope")
+	}
+	scope = newSourceScope(WrapperConfig{SourceRootDirs: []string{"system"}, IncludePrebuilts: true})
+	if !scope.contains("prebuilts/x.c") || scope.contains("out/gen.c") {
+		t.Error("Expected prebuilts but not generated sources to be in scope")
+	}
+	if scope := newSourceScope(WrapperConfig{SourceRootDirs: []string{"*"}}); scope.contains("prebuilts/x.c") {
+		t.Error("Expected a wildcard not to include prebuilts")
+	}
+}
+
+func TestSourceScopeFilter(t *testing.T) {
+	t.Setenv("ANDROID_BUILD_TOP", "/aosp")
+	command := func(workingDir, file string, includes ...string) CompilerCommandInfo {
+		return CompilerCommandInfo{WorkingDir: workingDir, InputFiles: []string{file}, Includes: includes}
+	}
+	commands := CommandDatabase{Commands: []CompilerCommandInfo{
+		command("/aosp", "system/core/a.c", "system/core/include", "out/soong/.intermediates/gen/include"),
+		command("/aosp/out/soong", "../../system/core/b.c", "/aosp/out/soong/.intermediates/aidl"),
+		command("/aosp", "external/zlib/c.c", "out/soong/.intermediates/zlib/include"),
+	}}
+	commands.Commands[0].Headers = []string{"system/core/include/a.h", "out/soong/.intermediates/gen/proto/a.pb.h"}
+
+	scope := newSourceScope(WrapperConfig{SourceRootDirs: []string{"system/core"}})
+	scoped, generated := scope.filter(commands)
+	if len(scoped.Commands) != 2 {
+		t.Errorf("Expected the 2 system/core commands, got %+v", scoped.Commands)
+	}
+	if want := []string{"out/soong/.intermediates/aidl", "out/soong/.intermediates/gen/include", "out/soong/.intermediates/gen/proto/a.pb.h"}; !reflect.DeepEqual(generated, want) {
+		t.Errorf("Expected generated includes %q, got %q", want, generated)
+	}
+}
+
+func TestRunNinjaWithCommandLoggingSourceRoots(t *testing.T) {
+	config := setupNativeRun(t)
+	config.BuildArguments = []string{"m", "hello"}
+	config.SourceRootDirs = []string{"!hello"}
+	memory := &MemorySink{}
+	config.Sinks = []Sink{memory}
+
+	result, err := RunNinjaWithCommandLogging(context.Background(), config, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Commands != 1 || result.OutOfScope != 1 {
+		t.Errorf("Expected the hello command to be dropped, got %+v", result)
+	}
+	if databases := memory.Databases(); len(databases) != 1 || len(databases[0].Commands) != 0 {
+		t.Errorf("Expected an empty database, got %+v", databases)
+	}
+}
@@ -0,0 +1,169 @@
+package wrapper
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ToolFamily describes a compiler or code generator whose commands are recorded in the database
+type ToolFamily struct {
+	// Name is reported as CompilerType for matching commands
+	Name string
+	// Match reports whether the argument vector (launchers already removed) runs this tool
+	Match func(args []string) bool
+	// Parse fills structured fields of info from the expanded arguments; nil uses the
+	// generic -I/-D/flag parsing
+	Parse func(info *CompilerCommandInfo, args []string)
+}
+
+var toolRegistry = struct {
+	sync.RWMutex
+	custom []ToolFamily
+}{}
+
+// builtinToolFamilies are tried in order, more specific matchers first
+var builtinToolFamilies = []ToolFamily{
+	{Name: "bpf-clang", Match: matchAll(programPattern(`^(.*-)?clang(-\d+(\.\d+)*)?$`), hasBPFTarget), Parse: parseClangArgs},
+	{Name: "clang++", Match: programPattern(`^(.*-)?clang\+\+(-\d+(\.\d+)*)?$`), Parse: parseClangArgs},
+	{Name: "clang", Match: programPattern(`^(.*-)?clang(-\d+(\.\d+)*)?$`), Parse: parseClangArgs},
+	{Name: "g++", Match: programPattern(`^(.*-)?g\+\+(-\d+(\.\d+)*)?$`), Parse: parseClangArgs},
+	{Name: "gcc", Match: programPattern(`^(.*-)?gcc(-\d+(\.\d+)*)?$`), Parse: parseClangArgs},
+	{Name: "soong_javac_wrapper", Match: programNamed("soong_javac_wrapper"), Parse: parseJavaArgs},
+	{Name: "javac", Match: programNamed("javac"), Parse: parseJavaArgs},
+	{Name: "kotlinc", Match: matchAny(programNamed("kotlinc"), jarNamed("kotlin-compiler")), Parse: parseJavaArgs},
+	{Name: "turbine", Match: matchAny(programNamed("turbine"), jarNamed("turbine")), Parse: parseJavaArgs},
+	{Name: "metalava", Match: matchAny(programNamed("metalava"), jarNamed("metalava"))},
+	{Name: "android-dex", Match: matchAny(programPattern(`^[rd]8(-.*)?$`), jarNamed("r8", "d8"))},
+	{Name: "rustc", Match: programNamed("rustc"), Parse: parseRustArgs},
+	{Name: "aidl", Match: programNamed("aidl", "aidl-cpp")},
+	{Name: "hidl-gen", Match: programNamed("hidl-gen")},
+	{Name: "protoc", Match: programNamed("protoc", "aprotoc")},
+	{Name: "llvm-as", Match: programNamed("llvm-as")},
+	{Name: "yasm", Match: programNamed("yasm")},
+	{Name: "nasm", Match: programNamed("nasm")},
+}
+
+// RegisterToolFamily adds a tool family. Registered families are tried before the built-in
+// ones, most recently registered first, so they can also override built-in classification.
+func RegisterToolFamily(family ToolFamily) {
+	toolRegistry.Lock()
+	defer toolRegistry.Unlock()
+	toolRegistry.custom = append(toolRegistry.custom, family)
+}
+
+// LookupToolFamily returns the family running the given compiler argument vector
+func LookupToolFamily(args []string) (ToolFamily, bool) {
+	if len(args) == 0 {
+		return ToolFamily{}, false
+	}
+
+	toolRegistry.RLock()
+	defer toolRegistry.RUnlock()
+
+	for i := len(toolRegistry.custom) - 1; i >= 0; i-- {
+		if family := toolRegistry.custom[i]; family.Match(args) {
+			return family, true
+		}
+	}
+	for _, family := range builtinToolFamilies {
+		if family.Match(args) {
+			return family, true
+		}
+	}
+
+	return ToolFamily{}, false
+}
+
+// programName returns the file name of the program without a Windows .exe suffix
+func programName(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(filepath.Base(args[0]), ".exe")
+}
+
+// programNamed matches programs by exact file name
+func programNamed(names ...string) func([]string) bool {
+	return func(args []string) bool {
+		name := programName(args)
+		for _, candidate := range names {
+			if name == candidate {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// programPattern matches programs whose file name matches a regular expression
+func programPattern(pattern string) func([]string) bool {
+	re := regexp.MustCompile(pattern)
+	return func(args []string) bool {
+		return re.MatchString(programName(args))
+	}
+}
+
+// jarNamed matches java -jar <name>.jar invocations, ignoring version suffixes
+func jarNamed(names ...string) func([]string) bool {
+	return func(args []string) bool {
+		if programName(args) != "java" {
+			return false
+		}
+		for i := 1; i+1 < len(args); i++ {
+			if args[i] != "-jar" {
+				continue
+			}
+			jar := strings.TrimSuffix(filepath.Base(args[i+1]), ".jar")
+			for _, name := range names {
+				if jar == name || strings.HasPrefix(jar, name+"-") {
+					return true
+				}
+			}
+			return false
+		}
+		return false
+	}
+}
+
+func matchAny(matchers ...func([]string) bool) func([]string) bool {
+	return func(args []string) bool {
+		for _, match := range matchers {
+			if match(args) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func matchAll(matchers ...func([]string) bool) func([]string) bool {
+	return func(args []string) bool {
+		for _, match := range matchers {
+			if !match(args) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// hasBPFTarget reports whether a clang invocation targets BPF
+func hasBPFTarget(args []string) bool {
+	for i, arg := range args {
+		target := ""
+		switch {
+		case arg == "-target" && i+1 < len(args):
+			target = args[i+1]
+		case strings.HasPrefix(arg, "--target="):
+			target = strings.TrimPrefix(arg, "--target=")
+		case strings.HasPrefix(arg, "-target="):
+			target = strings.TrimPrefix(arg, "-target=")
+		}
+		if strings.HasPrefix(target, "bpf") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package wrapper
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLookupToolFamily(t *testing.T) {
+	tests := []struct {
+		command  string
+		expected string
+	}{
+		{"prebuilts/clang/host/linux-x86/clang-r522817/bin/clang -c a.c", "clang"},
+		{"prebuilts/clang/host/linux-x86/clang-r522817/bin/clang++ -c a.cpp", "clang++"},
+		{"aarch64-linux-android-clang-17 -c a.c", "clang"},
+		{"clang -target bpf -c prog.c", "bpf-clang"},
+		{"clang --target=bpfel -c prog.c", "bpf-clang"},
+		{"x86_64-linux-gnu-gcc-4.8 -c a.c", "gcc"},
+		{"g++ -c a.cc", "g++"},
+		{"prebuilts/jdk/jdk17/linux-x86/bin/javac -d out A.java", "javac"},
+		{"out/host/linux-x86/bin/soong_javac_wrapper javac -d out A.java", "soong_javac_wrapper"},
+		{"external/kotlinc/bin/kotlinc -d out A.kt", "kotlinc"},
+		{"java -Xmx2g -jar out/host/linux-x86/framework/turbine.jar --output out.jar", "turbine"},
+		{"out/host/linux-x86/bin/metalava --source-files A.java", "metalava"},
+		{"out/host/linux-x86/bin/r8-compat-proguard -injars in.jar", "android-dex"},
+		{"out/host/linux-x86/bin/d8 --output out in.jar", "android-dex"},
+		{"prebuilts/rust/linux-x86/1.78.0/bin/rustc --crate-name foo src/lib.rs", "rustc"},
+		{"out/host/linux-x86/bin/aidl --lang=cpp IFoo.aidl", "aidl"},
+		{"out/host/linux-x86/bin/hidl-gen -Lc++-headers android.hardware.foo@1.0", "hidl-gen"},
+		{"out/host/linux-x86/bin/aprotoc --cpp_out=out foo.proto", "protoc"},
+		{"llvm-as foo.ll", "llvm-as"},
+		{"prebuilts/misc/linux-x86/yasm/yasm -f elf64 a.asm", "yasm"},
+		{"nasm -f elf64 a.asm", "nasm"},
+		{"prebuilts/clang-tools/linux-x86/bin/versioner -o out include", ""},
+		{"clang-tidy a.c", ""},
+		{"touch out/stamp", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			if got := determineCompilerTypeFromCommand(tt.command); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestRegisterToolFamily(t *testing.T) {
+	defer func(custom []ToolFamily) {
+		toolRegistry.custom = custom
+	}(toolRegistry.custom)
+
+	RegisterToolFamily(ToolFamily{
+		Name:  "versioner",
+		Match: programNamed("versioner"),
+		Parse: func(info *CompilerCommandInfo, args []string) {
+			for i := 0; i+1 < len(args); i++ {
+				if args[i] == "-o" {
+					info.OutputFile = args[i+1]
+				}
+			}
+		},
+	})
+	// Later registrations win, including over built-in families
+	RegisterToolFamily(ToolFamily{Name: "my-clang", Match: programNamed("clang")})
+
+	entry := map[string]interface{}{
+		"command":   "prebuilts/clang-tools/linux-x86/bin/versioner -o out/gen/include bionic/libc/include && touch out/stamp",
+		"directory": "/src",
+		"file":      "bionic/libc/include/alloca.h",
+	}
+	info := parseCompdbEntry(entry, "/default/dir")
+	if info.CompilerType != "versioner" {
+		t.Errorf("Expected custom family versioner, got %q", info.CompilerType)
+	}
+	if info.OutputFile != "out/gen/include" {
+		t.Errorf("Expected custom parser to set output, got %q", info.OutputFile)
+	}
+
+	if got := determineCompilerTypeFromCommand("clang -c a.c"); got != "my-clang" {
+		t.Errorf("Expected override my-clang, got %q", got)
+	}
+
+	// The override has no parser, so generic parsing still applies
+	info = parseCompdbEntry(map[string]interface{}{"command": "clang -Ia -c a.c", "file": "a.c"}, "/src")
+	if !reflect.DeepEqual(info.Includes, []string{"a"}) {
+		t.Errorf("Expected generic parsing for families without Parse, got %v", info.Includes)
+	}
+}
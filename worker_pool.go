@@ -0,0 +1,67 @@
+package wrapper
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// compdbWorkers returns how many compdb queries may run at once: WrapperConfig.Parallelism,
+// else HighmemParallel, else the number of CPUs
+func compdbWorkers(config WrapperConfig) int {
+	switch {
+	case config.Parallelism > 0:
+		return config.Parallelism
+	case config.HighmemParallel > 0:
+		return config.HighmemParallel
+	default:
+		return runtime.NumCPU()
+	}
+}
+
+// runParallel calls fn for every index in [0, n) from at most workers goroutines and returns
+// once all calls have finished. Callers store results by index to keep a deterministic order.
+func runParallel(n, workers int, fn func(i int)) {
+	if workers > n {
+		workers = n
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				fn(i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+}
+
+// commandSet de-duplicates commands by command line, output and inputs
+type commandSet map[string]bool
+
+func commandKey(info CompilerCommandInfo) string {
+	return info.Command + "\x00" + info.OutputFile + "\x00" + strings.Join(info.InputFiles, ",")
+}
+
+// add appends info to commands unless an identical command was already added
+func (s commandSet) add(commands *CommandDatabase, info CompilerCommandInfo) bool {
+	key := commandKey(info)
+	if s[key] {
+		return false
+	}
+	s[key] = true
+	commands.Commands = append(commands.Commands, info)
+	return true
+}
@@ -0,0 +1,88 @@
+package wrapper
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRunParallel(t *testing.T) {
+	var running, peak int32
+	results := make([]int, 50)
+
+	runParallel(len(results), 4, func(i int) {
+		current := atomic.AddInt32(&running, 1)
+		for {
+			old := atomic.LoadInt32(&peak)
+			if current <= old || atomic.CompareAndSwapInt32(&peak, old, current) {
+				break
+			}
+		}
+		results[i] = i * i
+		atomic.AddInt32(&running, -1)
+	})
+
+	if peak > 4 {
+		t.Errorf("Expected at most 4 concurrent calls, got %d", peak)
+	}
+	for i, result := range results {
+		if result != i*i {
+			t.Fatalf("Expected results[%d] = %d, got %d", i, i*i, result)
+		}
+	}
+
+	// Zero work must not block
+	runParallel(0, 0, func(int) { t.Error("Unexpected call") })
+}
+
+func TestCompdbWorkers(t *testing.T) {
+	if got := compdbWorkers(WrapperConfig{Parallelism: 3, HighmemParallel: 8}); got != 3 {
+		t.Errorf("Expected explicit parallelism 3, got %d", got)
+	}
+	if got := compdbWorkers(WrapperConfig{HighmemParallel: 8}); got != 8 {
+		t.Errorf("Expected HighmemParallel 8, got %d", got)
+	}
+	if got := compdbWorkers(WrapperConfig{}); got < 1 {
+		t.Errorf("Expected CPU count default, got %d", got)
+	}
+}
+
+func TestGetCompilationDatabaseConcurrent(t *testing.T) {
+	dir := t.TempDir()
+
+	// Later targets answer first; a and c share a command that must be reported once
+	script := `#!/bin/sh
+target="$5"
+case "$target" in
+a) sleep 0.3; echo '[{"directory":"/src","command":"clang -c shared.c -o shared.o","file":"shared.c","output":"shared.o"},{"directory":"/src","command":"clang -c a.c -o a.o","file":"a.c","output":"a.o"}]' ;;
+b) sleep 0.1; echo '[{"directory":"/src","command":"clang -c b.c -o b.o","file":"b.c","output":"b.o"}]' ;;
+c) echo '[{"directory":"/src","command":"clang -c shared.c -o shared.o","file":"shared.c","output":"shared.o"},{"directory":"/src","command":"clang -c c.c -o c.o","file":"c.c","output":"c.o"}]' ;;
+*) exit 1 ;;
+esac
+`
+	tool := filepath.Join(dir, "fake-ninja")
+	if err := os.WriteFile(tool, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	config := WrapperConfig{NinjaTool: tool, Parallelism: 4}
+	commands, _, _ := getCompilationDatabase(context.Background(), config, filepath.Join(dir, "build.ninja"),
+		[]string{"a", "b", "c", "missing"})
+
+	var outputs []string
+	for _, command := range commands.Commands {
+		outputs = append(outputs, command.OutputFile)
+	}
+
+	expected := []string{"shared.o", "a.o", "b.o", "c.o"}
+	if len(outputs) != len(expected) {
+		t.Fatalf("Expected outputs %q, got %q", expected, outputs)
+	}
+	for i := range expected {
+		if outputs[i] != expected[i] {
+			t.Fatalf("Expected outputs %q in target order, got %q", expected, outputs)
+		}
+	}
+}
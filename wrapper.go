@@ -4,37 +4,86 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 )
 
 type WrapperConfig struct {
-	OutDir            string
-	SoongOutDir       string
-	SourceRootDirs    []string
-	BuildArguments    []string
-	HighmemParallel   int
-	SoongNinjaFile    string
-	CombinedNinjaFile string
-	NinjaTool         string
+	OutDir              string
+	SoongOutDir         string
+	SourceRootDirs      []string // Source trees to keep commands for, globs allowed and ! excludes; everything when empty
+	IncludePrebuilts    bool     // Keep prebuilts/ sources although SourceRootDirs doesn't name them
+	IncludeGenerated    bool     // Keep sources generated under the out directory when SourceRootDirs is set
+	BuildArguments      []string
+	HighmemParallel     int
+	SoongNinjaFile      string
+	CombinedNinjaFile   string
+	NinjaTool           string
+	CompdbFormat        CompdbFormat // Database layouts to write, internal only when zero
+	ClangArguments      bool         // Emit "arguments" instead of "command" in the clang layout
+	ShardBy             ShardMode    // How CompdbFormatShards splits the database
+	Sinks               []Sink       // Destinations of the database in order, the formats above and proxy when nil
+	ModuleInfoFile      string       // module-info.json to resolve modules with, located automatically when empty
+	InlineResponseFiles bool         // Replace @file.rsp arguments with their contents in written commands
+	AttachHeaders       bool         // Attach the headers each command read, from OutDir/.ninja_deps or its depfile
+	Paths               PathPolicy   // How paths are expressed in written commands
+	Parallelism         int          // Concurrent compdb queries, HighmemParallel or the CPU count when zero
+	CompdbBatchSize     int          // Targets per compdb-targets invocation, spread over the workers when zero
+	Timeouts            PhaseTimeouts
+	WritePartialResults bool // Write the commands collected so far when cancelled or a phase times out
+	ForceFullRebuild    bool // Ignore the incremental cache in OutDir and parse every command again
+	MergeDatabase       bool // Upsert into the database of previous runs instead of replacing it
+
+	manifest *NinjaManifest // Parsed manifest when NinjaTool is NativeNinjaTool
+	cache    *compdbCache   // Commands of the previous run, see compdbCache
 }
 
 type CompilerCommandInfo struct {
-	Command      string   `json:"command"`      // Original complete command
-	CompilerType string   `json:"compilerType"` // Compiler type: clang, gcc, javac, etc.
-	InputFiles   []string `json:"inputFiles"`   // Input files list
-	OutputFile   string   `json:"outputFile"`   // Output file
-	Flags        []string `json:"flags"`        // Compilation flags
-	Includes     []string `json:"includes"`     // Include paths
-	Defines      []string `json:"defines"`      // Macro definitions
-	WorkingDir   string   `json:"workingDir"`   // Working directory
-	Module       string   `json:"module"`       // Module name
+	Command      string     `json:"command"`               // Original complete command
+	CompilerType string     `json:"compilerType"`          // Compiler type: clang, gcc, javac, etc.
+	InputFiles   []string   `json:"inputFiles"`            // Input files list
+	OutputFile   string     `json:"outputFile"`            // Output file
+	Flags        []string   `json:"flags"`                 // Compilation flags
+	Includes     []string   `json:"includes"`              // Include paths
+	Defines      []string   `json:"defines"`               // Macro definitions
+	WorkingDir   string     `json:"workingDir"`            // Working directory
+	Module       string     `json:"module"`                // Module name
+	Arguments    []string   `json:"arguments,omitempty"`   // Compiler argument vector within Command, without launchers
+	Environment  []string   `json:"environment,omitempty"` // NAME=VALUE assignments applied to the compiler
+	Launchers    []Launcher `json:"launchers,omitempty"`   // Wrapper programs such as ccache or rewrapper, outermost first
+	Origin       string     `json:"origin,omitempty"`      // Build invocation that contributed the command, in merge mode
+	Layer        string     `json:"layer,omitempty"`       // Manifest that declared the command, LayerSoong or LayerKati
+	BuildTarget  string     `json:"buildTarget,omitempty"` // Requested ninja target that first needed the command, in module builds
+
+	// C-family driver options, see parseClangArgs
+	SystemIncludes []string         `json:"systemIncludes,omitempty"` // -isystem paths
+	QuoteIncludes  []string         `json:"quoteIncludes,omitempty"`  // -iquote paths
+	AfterIncludes  []string         `json:"afterIncludes,omitempty"`  // -idirafter paths
+	ForcedIncludes []string         `json:"forcedIncludes,omitempty"` // -include files
+	MacroIncludes  []string         `json:"macroIncludes,omitempty"`  // -imacros files
+	Undefines      []string         `json:"undefines,omitempty"`      // -U macros
+	Standard       string           `json:"standard,omitempty"`       // -std= language standard
+	Target         string           `json:"target,omitempty"`         // Target triple
+	Sysroot        string           `json:"sysroot,omitempty"`        // --sysroot or -isysroot
+	DepFile        string           `json:"depFile,omitempty"`        // -MF dependency file
+	Headers        []string         `json:"headers,omitempty"`        // Headers the last build read, see WrapperConfig.AttachHeaders
+	Options        []CompilerOption `json:"options,omitempty"`        // Every driver argument in command line order
+
+	// Java-family options, see parseJavaArgs
+	Java *JavaCommand `json:"java,omitempty"` // javac, kotlinc and turbine invocations
+
+	// Rust options, see parseRustArgs
+	Rust *RustCrate `json:"rust,omitempty"` // rustc invocations
+
+	hash string // Hash of the compdb entry the command was parsed from, see compdbEntryHash
 }
 
 // CommandDatabase stores all intercepted compile commands
@@ -55,34 +104,106 @@ func GetBuildConfig(OutDir, SoongOutDir string, SourceRootDir, Arguments []strin
 	}
 }
 
-// RunNinjaWithCommandLogging runs ninja and intercepts compile commands
-func RunNinjaWithCommandLogging(ctx context.Context, config WrapperConfig, _ bool) {
-	err := checkNinjaExists()
-	if err != nil {
-		println(err.Error())
-		return
+// RunNinjaWithCommandLogging extracts the compile commands of the build described by config
+// and writes them in the configured formats. The returned Result is never nil; the error
+// wraps one of the Err* sentinels when extraction or writing failed.
+func RunNinjaWithCommandLogging(ctx context.Context, config WrapperConfig, _ bool) (*Result, error) {
+	result := &Result{}
+
+	if config.NinjaTool != NativeNinjaTool {
+		if err := checkNinjaExists(); err != nil {
+			fmt.Printf("%v, using built-in ninja parser\n", err)
+			result.Warnings = append(result.Warnings, err)
+			config.NinjaTool = NativeNinjaTool
+		} else {
+			config.NinjaTool = "distninja"
+		}
+	}
+	result.NinjaTool = config.NinjaTool
+
+	// Clearly distinguish between full build (m) and module build (mm/mmm)
+	compileType, moduleTargets := determineCompileType(config.BuildArguments)
+	fmt.Printf("Detected compile type: %s\n", compileType)
+	result.CompileType = compileType
+
+	request := cacheRequest(config, compileType)
+	if config.ForceFullRebuild {
+		config.cache = newCompdbCache()
+	} else {
+		config.cache = loadCompdbCache(config.OutDir)
+		if config.cache.upToDate(config.cache.cachedFingerprint(config), request) {
+			fmt.Printf("Ninja manifest unchanged, reusing the cached compilation commands\n")
+			result.Targets = config.cache.Targets
+			// The database was last written from the same graph, nothing went stale since
+			if done, err := writeCachedDatabase(ctx, config, compileType, result); done {
+				return result, err
+			}
+			config.cache = newCompdbCache()
+		}
 	}
-	config.NinjaTool = "distninja"
 
-	tempNinjaFile, err := createTempNinjaFile(config.SoongNinjaFile)
+	start := time.Now()
+	ninjaFile := extractionNinjaFile(config)
+	tempNinjaFile, cleanup, err := createTempNinjaFile(config, ninjaFile)
 	if err != nil {
 		fmt.Printf("Error: Failed to create temporary ninja file: %v\n", err)
-		return
+		return result, fmt.Errorf("%w: %w", ErrManifestFailed, err)
 	}
+	defer cleanup()
 	BuildTop := os.Getenv("ANDROID_BUILD_TOP")
-	tempNinjaFile = filepath.Join(BuildTop, tempNinjaFile)
 	fmt.Printf("Temporary ninja file: %s\n", tempNinjaFile)
 
-	commands := CommandDatabase{Commands: []CompilerCommandInfo{}}
+	// The fingerprint covers every manifest file the parser reads
+	fingerprint := ""
+	manifestCtx, cancel := withPhaseTimeout(ctx, config.Timeouts.Manifest)
+	if config.NinjaTool == NativeNinjaTool {
+		config.manifest, err = LoadNinjaManifestContext(manifestCtx, tempNinjaFile, BuildTop)
+		cancel()
+		if err != nil {
+			fmt.Printf("Error: Failed to parse ninja file: %v\n", err)
+			result.Durations.Manifest = time.Since(start)
+			return result, fmt.Errorf("%w: %w", ErrManifestFailed, err)
+		}
+		config.cache.useManifest(config.manifest, tempNinjaFile)
+		fingerprint = manifestFingerprint(config, config.cache.files)
+	} else {
+		// distninja extracts the commands, scanning only tells what changed since the cached run
+		err = config.cache.scan(manifestCtx, tempNinjaFile, BuildTop, compileType == "full")
+		cancel()
+		if err != nil {
+			fmt.Printf("Warning: Failed to scan ninja file, extracting every command: %v\n", err)
+			result.Warnings = append(result.Warnings, err)
+		} else {
+			fingerprint = manifestFingerprint(config, config.cache.files)
+		}
+	}
+	result.Durations.Manifest = time.Since(start)
 
-	// Clearly distinguish between full build (m) and module build (mm/mmm)
-	compileType, moduleTargets := determineCompileType(config.BuildArguments)
-	fmt.Printf("Detected compile type: %s\n", compileType)
+	// interrupted is the error of the first phase cut short by cancellation or a deadline,
+	// the collected commands are then incomplete
+	var interrupted error
+
+	commands := CommandDatabase{Commands: []CompilerCommandInfo{}}
 
 	if compileType == "full" {
 		//Full build (m): process all targets
 		fmt.Printf("Full build mode (m): generating complete compilation database\n")
-		commands = getAllCompilationCommands(ctx, config, tempNinjaFile)
+		// Merging needs the previous database and the whole new one, everything else is streamed
+		if !config.MergeDatabase {
+			if streams := openSinkStreams(context.WithoutCancel(ctx), configuredSinks(config)); streams != nil {
+				header := config.cache.header(fingerprint, request, nil)
+				return result, streamFullBuild(ctx, config, ninjaFile, tempNinjaFile, header, streams, result)
+			}
+		}
+		start = time.Now()
+		compdbCtx, cancel := withPhaseTimeout(ctx, config.Timeouts.Compdb)
+		commands, err = getAllCompilationCommands(compdbCtx, config, tempNinjaFile)
+		interrupted = compdbCtx.Err()
+		cancel()
+		result.Durations.Compdb = time.Since(start)
+		if err != nil && interrupted == nil {
+			return result, err
+		}
 		fmt.Printf("Extracted %d compilation commands\n", len(commands.Commands))
 	} else {
 		// Module build (mm/mmm): only process targets related to specified modules
@@ -97,39 +218,153 @@ func RunNinjaWithCommandLogging(ctx context.Context, config WrapperConfig, _ boo
 			fmt.Printf("Detected module targets: %s\n", strings.Join(moduleTargets, ", "))
 		}
 
-		//  Get targets related to modules
-		moduleTargets = expandModuleTargets(moduleTargets)
-		fmt.Printf("Expanded module targets: %s\n", strings.Join(moduleTargets, ", "))
+		start = time.Now()
+		targetsCtx, cancel := withPhaseTimeout(ctx, config.Timeouts.Targets)
+
+		// Resolve modules to their real outputs through module-info.json, then the ninja graph
+		relevantTargets, unresolved := moduleInfoTargets(targetsCtx, config, tempNinjaFile, moduleTargets)
+		if len(unresolved) > 0 && config.manifest != nil {
+			var graphTargets []string
+			graphTargets, unresolved = moduleGraphTargets(config.manifest.Graph(), unresolved)
+			relevantTargets = append(relevantTargets, graphTargets...)
+		}
+
+		// Fall back to name matching only for modules that could not be resolved exactly
+		if len(unresolved) > 0 {
+			expandedTargets := expandModuleTargets(unresolved)
+			fmt.Printf("Expanded module targets: %s\n", strings.Join(expandedTargets, ", "))
+
+			var matchedTargets []string
+			if len(relevantTargets) == 0 {
+				module := strings.Join(config.BuildArguments, " ")
+				matchedTargets = getRelevantTargets(targetsCtx, config, tempNinjaFile, module)
+			}
+			if len(matchedTargets) == 0 {
+				fmt.Printf("No ninja targets found for modules, trying fallbacks\n")
+				matchedTargets = findNinjaTargetsByFuzzyMatch(targetsCtx, config, tempNinjaFile, expandedTargets)
+			}
+			relevantTargets = append(relevantTargets, matchedTargets...)
+		}
+
+		interrupted = targetsCtx.Err()
+		cancel()
+		result.Durations.Targets = time.Since(start)
+		result.Targets = relevantTargets
 
-		// Find ninja targets related to module
-		module := strings.Join(config.BuildArguments, " ")
-		relevantTargets := getRelevantTargets(ctx, config, tempNinjaFile, module)
+		if len(relevantTargets) == 0 && interrupted == nil {
+			return result, fmt.Errorf("%w: %s", ErrNoTargetsMatched, strings.Join(moduleTargets, ", "))
+		}
 
 		if len(relevantTargets) > 0 {
-			// Find ninja targets related to modules
-			commands = getCompilationDatabase(ctx, config, tempNinjaFile, relevantTargets)
-			fmt.Printf("Extracted %d compilation commands for modules\n", len(commands.Commands))
-		} else {
-			fmt.Printf("No ninja targets found for modules, trying fallbacks\n")
-			relevantTargets = findNinjaTargetsByFuzzyMatch(ctx, config, tempNinjaFile, moduleTargets)
-			if len(relevantTargets) > 0 {
-				commands = getCompilationDatabase(ctx, config, tempNinjaFile, relevantTargets)
+			start = time.Now()
+			compdbCtx, cancel := withPhaseTimeout(ctx, config.Timeouts.Compdb)
+			commands, result.TargetErrors, err = getCompilationDatabase(compdbCtx, config, tempNinjaFile, relevantTargets)
+			if interrupted == nil {
+				interrupted = compdbCtx.Err()
+			}
+			cancel()
+			result.Durations.Compdb = time.Since(start)
+			if err != nil && interrupted == nil {
+				return result, err
 			}
+			fmt.Printf("Extracted %d compilation commands for modules\n", len(commands.Commands))
 		}
+	}
+	attributeLayers(config, ninjaFile, &commands)
+	result.Commands = len(commands.Commands)
+	fmt.Printf("Reused %d cached compilation commands, parsed %d\n", config.cache.reused, config.cache.parsed)
+
+	writeCtx := ctx
+	if interrupted != nil {
+		result.Partial = true
+		interrupted = fmt.Errorf("%w: %w", ErrInterrupted, interrupted)
+		if !config.WritePartialResults {
+			fmt.Printf("Error: %v, discarding %d collected commands\n", interrupted, len(commands.Commands))
+			return result, interrupted
+		}
+		fmt.Printf("Warning: %v, writing %d commands collected so far\n", interrupted, len(commands.Commands))
+		// The partial result is still written after the caller cancelled
+		writeCtx = context.WithoutCancel(ctx)
+	} else {
+		if len(result.TargetErrors) > 0 {
+			// Failed targets may succeed next time: keep the parsed entries, but don't let the
+			// next run reuse this database as a whole
+			fingerprint = ""
+		}
+		header := config.cache.header(fingerprint, request, result.Targets)
+		if err := config.cache.save(config.OutDir, header, commands); err != nil {
+			fmt.Printf("Warning: Failed to write compile command cache: %v\n", err)
+			result.Warnings = append(result.Warnings, err)
+		}
+	}
 
+	var live func(CompilerCommandInfo) bool
+	if config.MergeDatabase {
+		live = graphOutputs(writeCtx, config, tempNinjaFile)
 	}
 
-	if err := writeCompileCommands(config.OutDir, commands); err != nil {
-		fmt.Printf("Error: Failed to write compilation command database: %v\n", err)
-	} else {
-		fmt.Printf("Compilation command database has been written to: %s/compile_commands.json\n", config.OutDir)
+	return result, errors.Join(interrupted, writeCommandDatabases(writeCtx, config, commands, live, result))
+}
+
+// writeCachedDatabase writes the cached database, streaming it to the sinks in full builds like
+// extracted commands. It returns false when the cache can't be read and the commands have to be
+// extracted after all.
+func writeCachedDatabase(ctx context.Context, config WrapperConfig, compileType string, result *Result) (bool, error) {
+	if compileType == "full" && !config.MergeDatabase {
+		if streams := openSinkStreams(context.WithoutCancel(ctx), configuredSinks(config)); streams != nil {
+			return true, streamCommands(ctx, config, streams, nil, result, func(ctx context.Context, emit func(CompilerCommandInfo)) error {
+				if err := config.cache.replay(ctx, nil, emit); err != nil {
+					return fmt.Errorf("%w: %w", ErrCompdbFailed, err)
+				}
+				return nil
+			})
+		}
+	}
+
+	commands, err := config.cache.database()
+	if err != nil {
+		fmt.Printf("Warning: %v, extracting the commands again\n", err)
+		result.Warnings = append(result.Warnings, err)
+		return false, nil
+	}
+	result.Commands = len(commands.Commands)
+	return true, writeCommandDatabases(ctx, config, commands, nil, result)
+}
+
+// writeCommandDatabases rewrites commands as configured, merges them into the previous
+// database in merge mode, delivers them to the configured sinks and records the written files
+// in result. live decides which previous commands are kept, see mergeCommandDatabases.
+func writeCommandDatabases(ctx context.Context, config WrapperConfig, commands CommandDatabase,
+	live func(CompilerCommandInfo) bool, result *Result) error {
+	start := time.Now()
+	writeCtx, cancelWrite := withPhaseTimeout(ctx, config.Timeouts.Write)
+	defer cancelWrite()
+
+	pipeline := newCommandPipeline(config, result)
+	kept := commands.Commands[:0]
+	for _, info := range commands.Commands {
+		if pipeline.process(&info) {
+			kept = append(kept, info)
+		}
+	}
+	commands.Commands = kept
+	pipeline.finish()
+
+	if config.MergeDatabase {
+		commands = mergeExistingDatabase(config, commands, live, result)
 	}
+
+	err := runSinks(writeCtx, configuredSinks(config), commands, result)
+
+	result.Durations.Write = time.Since(start)
+
+	return err
 }
 
 func checkNinjaExists() error {
 	_, err := exec.LookPath("distninja")
 	if err != nil {
-		return fmt.Errorf("distninja tool not found, please install ninja build tool first")
+		return fmt.Errorf("%w, please install ninja build tool first", ErrNinjaNotFound)
 	}
 	return nil
 }
@@ -259,35 +494,103 @@ func determineCompileType(buildArgs []string) (string, []string) {
 	return compileType, moduleTargets
 }
 
-// getAllCompilationCommands gets all compilation commands (for full build)
-func getAllCompilationCommands(ctx context.Context, config WrapperConfig, tempNinjaFile string) CommandDatabase {
+// getAllCompilationCommands collects every compile command of the manifest, see
+// forEachCompilationCommand
+func getAllCompilationCommands(ctx context.Context, config WrapperConfig, tempNinjaFile string) (CommandDatabase, error) {
 	commands := CommandDatabase{Commands: []CompilerCommandInfo{}}
+	err := forEachCompilationCommand(ctx, config, tempNinjaFile, func(info CompilerCommandInfo) {
+		commands.Commands = append(commands.Commands, info)
+	})
+	return commands, err
+}
+
+// forEachCompilationCommand calls fn with every compile command of the manifest as soon as it
+// is parsed. Cancelling ctx stops the extraction early without an error.
+func forEachCompilationCommand(ctx context.Context, config WrapperConfig, tempNinjaFile string, fn func(CompilerCommandInfo)) error {
 	executable := config.NinjaTool
 	fmt.Printf("Using ninja tool for compilation database: %s\n", executable)
 	fmt.Printf("Getting all compilation commands from ninja file\n")
 
-	cmd := exec.Command(executable, "-f", tempNinjaFile, "-t", "compdb")
-	var outBuf bytes.Buffer
-	cmd.Stdout = &outBuf
-	cmd.Stderr = os.Stderr
-	cmd.Dir = os.Getenv("ANDROID_BUILD_TOP")
-
-	// Parse JSON output
-	var compdbEntries []map[string]interface{}
-	if err := json.Unmarshal(outBuf.Bytes(), &compdbEntries); err != nil {
-		fmt.Printf("Failed to parse compilation database JSON: %v\n", err)
-		return commands
-	}
+	BuildTop := os.Getenv("ANDROID_BUILD_TOP")
 
 	// Convert to CommandDatabase form
-	for _, entry := range compdbEntries {
-		cmdInfo := parseCompdbEntry(entry, cmd.Dir)
+	add := func(entry map[string]interface{}) {
+		cmdInfo := config.cache.parseEntry(entry, BuildTop)
 		if cmdInfo.CompilerType != "" && len(cmdInfo.InputFiles) > 0 {
-			commands.Commands = append(commands.Commands, cmdInfo)
+			fn(cmdInfo)
 		}
 	}
 
-	return commands
+	if executable == NativeNinjaTool {
+		manifest, err := nativeManifest(config, tempNinjaFile)
+		if err != nil {
+			fmt.Printf("Failed to load ninja manifest: %v\n", err)
+			return fmt.Errorf("%w: %w", ErrManifestFailed, err)
+		}
+		compdbEntries := compileCommandEntries(manifest.CompileCommands(manifest.Edges))
+		for _, entry := range compdbEntries {
+			if ctx.Err() != nil {
+				break
+			}
+			add(entry)
+		}
+		return nil
+	}
+
+	// Only the edges that changed since the cached run are extracted, the others are replayed
+	fixedArgs := []string{executable, "-f", tempNinjaFile, "-t", "compdb-targets"}
+	if targets, ok := config.cache.planExtraction(fixedArgs); ok {
+		fmt.Printf("Extracting the commands of %d changed edges\n", len(targets))
+		seen := map[string]bool{}
+		for _, batch := range batchTargets(targets, fixedArgs, 0) {
+			args := append([]string{"-f", tempNinjaFile, "-t", "compdb-targets"}, targets[batch.start:batch.end]...)
+			cmd := commandContext(ctx, executable, args...)
+			cmd.Stderr = os.Stderr
+			cmd.Dir = BuildTop
+
+			// compdb-targets also prints the edges the changed ones depend on, once per batch
+			err := streamCompdb(cmd, func(entry map[string]interface{}) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				cmdInfo := config.cache.parseEntry(entry, BuildTop)
+				if cmdInfo.CompilerType != "" && len(cmdInfo.InputFiles) > 0 && !seen[cmdInfo.hash] {
+					seen[cmdInfo.hash] = true
+					fn(cmdInfo)
+				}
+				return nil
+			})
+			if err != nil {
+				fmt.Printf("Failed to get compilation database: %v\n", err)
+				return fmt.Errorf("%w: %w", ErrCompdbFailed, err)
+			}
+		}
+
+		err := config.cache.replay(ctx, func(hash string) bool { return config.cache.unchanged[hash] }, fn)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrCompdbFailed, err)
+		}
+		return nil
+	}
+
+	// Entries are converted as distninja prints them, the raw database is never held in memory
+	cmd := commandContext(ctx, executable, "-f", tempNinjaFile, "-t", "compdb")
+	cmd.Stderr = os.Stderr
+	cmd.Dir = BuildTop
+
+	err := streamCompdb(cmd, func(entry map[string]interface{}) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		add(entry)
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Failed to get compilation database: %v\n", err)
+		return fmt.Errorf("%w: %w", ErrCompdbFailed, err)
+	}
+
+	return nil
 }
 
 // detectModuleTargets detects module targets from current environment
@@ -422,170 +725,234 @@ func findNinjaTargetsByFuzzyMatch(ctx context.Context, config WrapperConfig, nin
 	return matchedTargets
 }
 
-func getCompilationDatabase(ctx context.Context, config WrapperConfig, ninjaFile string, targets []string) CommandDatabase {
+// getCompilationDatabase extracts the compile commands of targets, or of the whole manifest when
+// no targets are given. Targets that fail are reported individually; ErrCompdbFailed is returned
+// when every target failed and nothing could be extracted.
+func getCompilationDatabase(ctx context.Context, config WrapperConfig, ninjaFile string, targets []string) (CommandDatabase, []*TargetError, error) {
 	commands := CommandDatabase{Commands: []CompilerCommandInfo{}}
 	executable := config.NinjaTool
-	ninjaDir := filepath.Dir(ninjaFile)
+	// Ninja runs from the source root, ninjaFile may be a temporary copy elsewhere
 	BuildTop := os.Getenv("ANDROID_BUILD_TOP")
 
+	if executable == NativeNinjaTool {
+		return getNativeCompilationDatabase(ctx, config, ninjaFile, targets)
+	}
+
 	// If no targets specified, get all compilation commands
 	if len(targets) == 0 {
 		fmt.Println("Getting all compilation commands (no targets specified)")
 		args := []string{"-f", ninjaFile, "-t", "compdb"}
-		cmd := exec.Command(executable, args...)
+		cmd := commandContext(ctx, executable, args...)
 		cmd.Dir = BuildTop
 
-		var outBuf bytes.Buffer
-		cmd.Stdout = &outBuf
-
-		if err := cmd.Run(); err != nil {
+		// Entries are parsed as they are printed, the whole database is never held as JSON
+		err := streamCompdb(cmd, func(entry map[string]interface{}) error {
+			cmdInfo := config.cache.parseEntry(entry, BuildTop)
+			if cmdInfo.CompilerType != "" && len(cmdInfo.InputFiles) > 0 {
+				commands.Commands = append(commands.Commands, cmdInfo)
+			}
+			return nil
+		})
+		if err != nil {
 			fmt.Println("Failed to get compilation database:", err)
-			return commands
+			return commands, nil, fmt.Errorf("%w: %w", ErrCompdbFailed, err)
 		}
+		return commands, nil, nil
+	}
 
-		// Parse JSON output
-		var compdbEntries []map[string]interface{}
-		if err := json.Unmarshal(outBuf.Bytes(), &compdbEntries); err != nil {
-			fmt.Println("Failed to parse JSON", err)
-			return commands
+	// Query batches of targets concurrently, each target into its own slot so the result order
+	// follows targets
+	workers := compdbWorkers(config)
+	batches := batchTargets(targets, []string{executable, "-f", ninjaFile, "-t", "compdb-targets"},
+		compdbBatchSize(config, len(targets)))
+	fmt.Printf("Starting to get compilation commands for %d targets in %d batches with %d workers\n",
+		len(targets), len(batches), workers)
+
+	results := make([][]CompilerCommandInfo, len(targets))
+	failures := make([][]*TargetError, len(batches))
+	runParallel(len(batches), workers, func(b int) {
+		batch := batches[b]
+		if ctx.Err() != nil {
+			return
 		}
-
-		for _, entry := range compdbEntries {
-			cmdInfo := parseCompdbEntry(entry, ninjaDir)
-			if cmdInfo.CompilerType != "" && len(cmdInfo.InputFiles) > 0 {
-				commands.Commands = append(commands.Commands, cmdInfo)
+		fmt.Printf("Processing targets %d-%d/%d\n", batch.start+1, batch.end, len(targets))
+
+		batchTargets := targets[batch.start:batch.end]
+		var blocks [][]map[string]interface{}
+		blocks, failures[b] = queryTargetBatch(ctx, executable, ninjaFile, BuildTop, batchTargets)
+		for i, entries := range blocks {
+			for _, entry := range entries {
+				cmdInfo := config.cache.parseEntry(entry, BuildTop)
+				if cmdInfo.CompilerType != "" && len(cmdInfo.InputFiles) > 0 {
+					cmdInfo.BuildTarget = batchTargets[i]
+					results[batch.start+i] = append(results[batch.start+i], cmdInfo)
+				}
 			}
 		}
-		return commands
+	})
+
+	seen := commandSet{}
+	for _, result := range results {
+		for _, cmdInfo := range result {
+			seen.add(&commands, cmdInfo)
+		}
 	}
 
-	// Process targets one by one
-	fmt.Printf("Starting to get compilation commands for %d targets\n", len(targets))
-	for i, target := range targets {
-		fmt.Printf("Processing target %d/%d: %s\n", i+1, len(targets), target)
+	var targetErrors []*TargetError
+	for _, batchFailures := range failures {
+		targetErrors = append(targetErrors, batchFailures...)
+	}
 
-		args := []string{"-f", ninjaFile, "-t", "compdb-targets", target}
-		cmd := exec.Command(executable, args...)
-		cmd.Dir = BuildTop
+	fmt.Printf("Successfully got %d compilation commands for %d targets\n", len(commands.Commands), len(targets))
+	return commands, targetErrors, allTargetsFailed(ctx, targets, commands, targetErrors)
+}
 
-		var outBuf bytes.Buffer
-		cmd.Stdout = &outBuf
+// allTargetsFailed returns ErrCompdbFailed with the errors of every target when all targets
+// failed and nothing was extracted, so the previous database isn't replaced with an empty one
+func allTargetsFailed(ctx context.Context, targets []string, commands CommandDatabase, targetErrors []*TargetError) error {
+	if ctx.Err() != nil || len(targets) == 0 || len(commands.Commands) > 0 {
+		return nil
+	}
 
-		if err := cmd.Run(); err != nil {
-			fmt.Printf("Failed to get compilation commands for target %s: %v\n", target, err)
-			continue
-		}
+	failed := map[string]bool{}
+	errs := make([]error, 0, len(targetErrors))
+	for _, targetErr := range targetErrors {
+		failed[targetErr.Target] = true
+		errs = append(errs, targetErr)
+	}
+	if len(failed) < len(targets) {
+		return nil
+	}
+	return fmt.Errorf("%w: %w", ErrCompdbFailed, errors.Join(errs...))
+}
 
-		fmt.Printf("Raw output length: %d bytes\n", outBuf.Len())
-		if outBuf.Len() < 1000 {
-			fmt.Printf("Raw output content: %s\n", outBuf.String())
-		}
-		var compdbEntries []map[string]interface{}
-		if err := json.Unmarshal(outBuf.Bytes(), &compdbEntries); err != nil {
-			fmt.Printf("Failed to parse JSON for target %s: %v\n", target, err)
-			continue
+// getNativeCompilationDatabase is getCompilationDatabase for the built-in ninja parser
+func getNativeCompilationDatabase(ctx context.Context, config WrapperConfig, ninjaFile string, targets []string) (CommandDatabase, []*TargetError, error) {
+	commands := CommandDatabase{Commands: []CompilerCommandInfo{}}
+
+	manifest, err := nativeManifest(config, ninjaFile)
+	if err != nil {
+		fmt.Printf("Failed to load ninja manifest: %v\n", err)
+		return commands, nil, fmt.Errorf("%w: %w", ErrManifestFailed, err)
+	}
+
+	byTarget := [][]*NinjaEdge{manifest.Edges}
+	var targetErrors []*TargetError
+	if len(targets) > 0 {
+		var unknown []string
+		byTarget, unknown = manifest.EdgesByTarget(targets)
+		for _, target := range unknown {
+			fmt.Printf("Failed to get compilation commands for target %s: unknown target\n", target)
+			targetErrors = append(targetErrors, &TargetError{Target: target, Err: ErrUnknownTarget})
 		}
+	}
 
-		for _, entry := range compdbEntries {
-			cmdInfo := parseCompdbEntry(entry, ninjaDir)
+	seen := commandSet{}
+	for i, edges := range byTarget {
+		for _, entry := range compileCommandEntries(manifest.CompileCommands(edges)) {
+			if ctx.Err() != nil {
+				break
+			}
+			cmdInfo := config.cache.parseEntry(entry, manifest.RootDir)
 			if cmdInfo.CompilerType != "" && len(cmdInfo.InputFiles) > 0 {
-				//  Check if command already exists
-				if !isCommandExists(commands.Commands, cmdInfo) {
-					commands.Commands = append(commands.Commands, cmdInfo)
+				if len(targets) > 0 {
+					cmdInfo.BuildTarget = targets[i]
 				}
+				seen.add(&commands, cmdInfo)
 			}
 		}
 	}
 
-	fmt.Printf("Successfully got %d compilation commands for %d targets\n", len(targets), len(commands.Commands))
-	return commands
+	fmt.Printf("Successfully got %d compilation commands for %d targets\n", len(commands.Commands), len(targets))
+	return commands, targetErrors, allTargetsFailed(ctx, targets, commands, targetErrors)
 }
 
-func isCommandExists(commands []CompilerCommandInfo, newCmd CompilerCommandInfo) bool {
-	for _, cmd := range commands {
-		if cmd.Command == newCmd.Command &&
-			cmd.OutputFile == newCmd.OutputFile &&
-			strings.Join(cmd.InputFiles, ",") == strings.Join(newCmd.InputFiles, ",") {
-			return true
-		}
+// nativeManifest returns the manifest loaded for the built-in parser, parsing ninjaFile if needed
+func nativeManifest(config WrapperConfig, ninjaFile string) (*NinjaManifest, error) {
+	if config.manifest != nil {
+		return config.manifest, nil
 	}
-	return false
+	return LoadNinjaManifest(ninjaFile, os.Getenv("ANDROID_BUILD_TOP"))
 }
 
-// splitCommandLine splits command line string into argument list, handling quotes
+// splitCommandLine splits command line string into argument list, handling shell quoting.
+// Control operators such as && and | are returned as separate arguments.
 func splitCommandLine(cmdLine string) []string {
-	var args []string
-	var current string
-	var inQuote bool
-	var quoteChar rune
-
-	for _, r := range cmdLine {
-		if r == '"' || r == '\'' {
-			if inQuote && r == quoteChar {
-				inQuote = false
-			} else if !inQuote {
-				inQuote = true
-				quoteChar = r
-			} else {
-				current += string(r)
-			}
-		} else if r == ' ' && !inQuote {
-			if current != "" {
-				args = append(args, current)
-				current = ""
-			}
-		} else {
-			current += string(r)
+	tokens := lexShell(cmdLine)
+	args := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		if token.kind == shellOperator && token.text == "\n" {
+			continue
 		}
+		args = append(args, token.text)
+	}
+	return args
+}
+
+// compilerInvocation returns the argument vector of the compiler within a possibly compound
+// command line: the first simple command running a known compiler, else the first one
+func compilerInvocation(command string) []string {
+	stages := splitCommandChain(command)
+	if len(stages) == 0 {
+		return nil
 	}
 
-	if current != "" {
-		args = append(args, current)
+	for _, stage := range stages {
+		_, _, compiler := unwrapCommand(stage.Args)
+		if _, ok := LookupToolFamily(compiler); ok {
+			return stage.Args
+		}
 	}
 
-	return args
+	return stages[0].Args
 }
 
 // determineCompilerTypeFromCommand determines compiler type from command string
 func determineCompilerTypeFromCommand(command string) string {
-	compilerType := ""
+	return compilerTypeFromArgs(compilerInvocation(command))
+}
 
-	parts := strings.Fields(command)
-	if len(parts) > 0 {
-		if strings.HasPrefix(parts[0], "PWD=") {
-			compilerType = parts[1]
-		} else {
-			compilerType = parts[0]
-		}
-	} else {
-		return compilerType
+// compilerTypeFromArgs determines compiler type from the argument vector of a simple command,
+// returning "" for tools that no registered ToolFamily recognizes
+func compilerTypeFromArgs(args []string) string {
+	_, _, compiler := unwrapCommand(args)
+	if len(compiler) == 0 {
+		return ""
 	}
 
-	fmt.Printf("compilerType: %s\n", compilerType)
-
-	if strings.Contains(compilerType, "clang++") {
-		return "clang++"
-	} else if strings.Contains(compilerType, "clang") && !strings.Contains(compilerType, "++") {
-		return "clang"
-	} else if strings.Contains(compilerType, "g++") {
-		return "g++"
-	} else if strings.Contains(compilerType, "gcc") && !strings.Contains(compilerType, "++") {
-		return "gcc"
-	} else if strings.Contains(compilerType, "javac") {
-		return "javac"
-	} else if strings.Contains(compilerType, "kotlinc") {
-		return "kotlinc"
-	} else if strings.Contains(compilerType, "r8") || strings.Contains(compilerType, "d8") {
-		return "android-dex"
+	family, ok := LookupToolFamily(compiler)
+	if !ok {
+		return ""
 	}
-
-	return compilerType
+	return family.Name
 }
 
 // parseAdditionalCommandInfo parses additional information from command string
 func parseAdditionalCommandInfo(info *CompilerCommandInfo) {
-	args := splitCommandLine(info.Command)
+	args := info.Arguments
+	if len(args) == 0 {
+		args = splitCommandLine(info.Command)
+	}
+	expansion := expandResponseFiles(args, info.WorkingDir)
+	args = expansion.Args
+	family, known := LookupToolFamily(args)
+
+	// Sources passed through response files are inputs too
+	for _, input := range responseFileInputs(expansion, family.Name) {
+		if !containsString(info.InputFiles, input) {
+			info.InputFiles = append(info.InputFiles, input)
+		}
+	}
+
+	parse := parseGenericArgs
+	if known && family.Parse != nil {
+		parse = family.Parse
+	}
+	parse(info, args)
+}
 
+// parseGenericArgs extracts include paths, macro definitions and flags from arguments
+func parseGenericArgs(info *CompilerCommandInfo, args []string) {
 	for i := 0; i < len(args); i++ {
 		arg := args[i]
 
@@ -616,6 +983,15 @@ func parseAdditionalCommandInfo(info *CompilerCommandInfo) {
 	}
 }
 
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 // parseCompdbEntry parses compilation database entry to CompilerCommandInfo
 func parseCompdbEntry(entry map[string]interface{}, defaultWorkingDir string) CompilerCommandInfo {
 	info := CompilerCommandInfo{
@@ -659,8 +1035,9 @@ func parseCompdbEntry(entry map[string]interface{}, defaultWorkingDir string) Co
 		info.OutputFile = output
 	}
 
-	// Determine compiler type
-	info.CompilerType = determineCompilerTypeFromCommand(info.Command)
+	// Determine compiler type from the compiler stage of compound commands, looking through launchers
+	info.Environment, info.Launchers, info.Arguments = unwrapCommand(compilerInvocation(info.Command))
+	info.CompilerType = compilerTypeFromArgs(info.Arguments)
 
 	// Parse command line for more information
 	if info.Command != "" {
@@ -675,14 +1052,29 @@ func parseCompdbEntry(entry map[string]interface{}, defaultWorkingDir string) Co
 	return info
 }
 
+// soongVariantPattern matches the variant directory Soong nests below the directory of a module
+// in out/soong/.intermediates: the OS, an optional image such as vendor or recovery (possibly
+// versioned, e.g. vendor.31) and the architecture, e.g. android_vendor_arm64_armv8-a_shared or
+// linux_glibc_common
+var soongVariantPattern = regexp.MustCompile(`^(android(_(vendor_ramdisk|vendor_dlkm|odm_dlkm|system_dlkm|vendor|product|recovery|ramdisk|odm|system_ext)(\.[^_]+)?)?|linux_glibc|linux_musl|linux_bionic|darwin|windows)_(arm|x86|riscv64|common)|^common$`)
+
 // extractModuleNameFromPath extracts Android module name from path
 func extractModuleNameFromPath(path string) string {
+	// e.g: out/soong/.intermediates/path/to/module/variant/, the module is the directory before
+	// the first variant since the outputs below it may have any depth
+	if i := strings.Index(path, ".intermediates/"); i >= 0 {
+		parts := strings.Split(path[i+len(".intermediates/"):], "/")
+		for j := 1; j < len(parts)-1; j++ {
+			if soongVariantPattern.MatchString(parts[j]) {
+				return parts[j-1]
+			}
+		}
+	}
+
 	// Common module path patterns in Android build system
 	patterns := []*regexp.Regexp{
 		// e.g: out/target/product/XXX/obj/SHARED_LIBRARIES/libxxx_intermediates/
 		regexp.MustCompile(`/obj/([A-Z_]+)/([^/]+)_intermediates/`),
-		// e.g: out/soong/.intermediates/path/to/module/variant/
-		regexp.MustCompile(`/.intermediates/([^/]+/)*([^/]+)/[^/]+/`),
 		// Simple extraction of last meaningful directory name
 		regexp.MustCompile(`([^/]+)/_intermediates/`),
 	}
@@ -720,8 +1112,19 @@ func extractModuleNameFromPath(path string) string {
 // getNinjaTargets updated with proper cleanup
 func getNinjaTargets(ctx context.Context, config WrapperConfig, ninjaFile string) []string {
 	executable := config.NinjaTool
+	if executable == NativeNinjaTool {
+		manifest, err := nativeManifest(config, ninjaFile)
+		if err != nil {
+			fmt.Printf("Failed to get ninja targets: %v\n", err)
+			return nil
+		}
+		targets := manifest.Targets()
+		fmt.Printf("Found %d targets\n", len(targets))
+		return targets
+	}
+
 	// Run ninja -t targets command
-	cmd := exec.Command(executable, "-f", ninjaFile, "-t", "targets")
+	cmd := commandContext(ctx, executable, "-f", ninjaFile, "-t", "targets")
 	var outBuf bytes.Buffer
 	cmd.Stdout = &outBuf
 	cmd.Dir = os.Getenv("ANDROID_BUILD_TOP")
@@ -760,55 +1163,39 @@ func parseNinjaTargetsOutput(outBuf *bytes.Buffer) []string {
 	return targets
 }
 
-func writeCompileCommands(outputDir string, commands CommandDatabase) error {
-	BuildTop := os.Getenv("ANDROID_BUILD_TOP")
-	CompileCommandsFile := "compile_commands.json"
-
+// writeCompileCommands writes the internal layout to outputDir/compile_commands.json
+func writeCompileCommands(ctx context.Context, outputDir string, commands CommandDatabase) error {
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
 		return fmt.Errorf("failed to create output directory: %v", err)
 	}
 
-	jsonData, err := json.MarshalIndent(commands, "", "  ")
-	if err != nil {
-		return fmt.Errorf("JSON encoding failed: %v", err)
-	}
-
-	tempFile := filepath.Join(outputDir, ".compile_commands.tmp")
-	if err := os.WriteFile(tempFile, jsonData, 0644); err != nil {
-		return fmt.Errorf("failed to write temporary file: %v", err)
-	}
+	return writeStreamAtomic(ctx, outputDir, CompileCommandsFile, func(w io.Writer) error {
+		return encodeCommandDatabase(w, commands)
+	})
+}
 
-	finalPath := filepath.Join(outputDir, CompileCommandsFile)
-	if err := os.Rename(tempFile, finalPath); err != nil {
-		_ = os.Remove(tempFile)
-		return fmt.Errorf("failed to rename file: %v", err)
+// createTempNinjaFile writes the manifest synthesized from ninjaFile to a private temporary
+// directory, see synthesizeNinjaManifest. cleanup removes it.
+func createTempNinjaFile(config WrapperConfig, ninjaFile string) (tmpNinjaFile string, cleanup func(), err error) {
+	content, err := synthesizeNinjaManifest(config, ninjaFile)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read pools of %s: %v", ninjaFile, err)
 	}
 
-	fmt.Printf("Running proxy: proxy -w %s -c %s\n", BuildTop, CompileCommandsFile)
-	cmd := exec.Command("proxy", "-w", BuildTop, "-c", CompileCommandsFile)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to run proxy command: %v", err)
+	dir, err := os.MkdirTemp("", "boong-ninja-")
+	if err != nil {
+		return "", nil, fmt.Errorf("error creating temporary directory: %v", err)
 	}
+	cleanup = func() { _ = os.RemoveAll(dir) }
 
-	return nil
-}
-
-func createTempNinjaFile(ninjaFile string) (string, error) {
-	// Create a temporary ninja file with pool definitions and include the original ninja file
-	tmpNinjaFile := ninjaFile + ".tmp_commands"
-	// Extract pool definitions from combined.ninja file, or create default pool definitions
-	poolDefs := `
-pool highmem_pool
-  depth = 1`
-	combinedNinjaContent := poolDefs + "\nsubninja " + ninjaFile + "\n"
-	if err := os.WriteFile(tmpNinjaFile, []byte(combinedNinjaContent), 0666); err != nil {
+	tmpNinjaFile = filepath.Join(dir, filepath.Base(ninjaFile))
+	if err := os.WriteFile(tmpNinjaFile, []byte(content), 0644); err != nil {
+		cleanup()
 		fmt.Printf("Failed to create temporary ninja file: %v\n", err)
-		return "", fmt.Errorf("error creating temporary ninja file: %s", tmpNinjaFile)
+		return "", nil, fmt.Errorf("error creating temporary ninja file: %s", tmpNinjaFile)
 	}
 
-	return tmpNinjaFile, nil
+	return tmpNinjaFile, cleanup, nil
 }
 
 // findTargetsByModulePath finds targets by fuzzy matching module path
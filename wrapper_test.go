@@ -2,6 +2,7 @@ package wrapper
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"os"
 	"path/filepath"
@@ -260,6 +261,55 @@ func TestExtractModuleNameFromPath(t *testing.T) {
 			path:     "out/soong/.intermediates/system/sepolicy/apex/com.android.sepolicy.cil/android_common/com.android.sepolicy.cil",
 			expected: "com.android.sepolicy.cil",
 		},
+		{
+			path:     "out/soong/.intermediates/system/core/hello/hello/android_arm64_armv8-a/obj/system/core/hello/main.o",
+			expected: "hello",
+		},
+		{
+			path:     "out/soong/.intermediates/frameworks/base/native/android/libandroid/android_arm64_armv8-a_shared/obj/frameworks/base/native/android/asset_manager.o",
+			expected: "libandroid",
+		},
+		{
+			path:     "out/soong/.intermediates/build/soong/cmd/soong_build/soong_build/linux_glibc_x86_64/obj/main.o",
+			expected: "soong_build",
+		},
+		// Image variants, from test/compile_commands.json
+		{
+			path:     "out/soong/.intermediates/bionic/libc/libc/android_vendor_arm64_armv8-a_shared/libc.so",
+			expected: "libc",
+		},
+		{
+			path:     "out/soong/.intermediates/bionic/libm/libm/android_vendor_arm64_armv8-a_shared/obj/.intermediates/bionic/libm/libm/android_vendor_arm64_armv8-a_shared/gen/stub.o",
+			expected: "libm",
+		},
+		{
+			path:     "out/soong/.intermediates/bionic/libc/crtbegin_dynamic/android_vendor_arm64_armv8-a/addrsig/crtbegin_dynamic.o",
+			expected: "crtbegin_dynamic",
+		},
+		{
+			path:     "out/soong/.intermediates/system/core/hello/multi_module_demo/android_vendor_arm64_armv8-a/unstripped/multi_module_demo",
+			expected: "multi_module_demo",
+		},
+		{
+			path:     "out/soong/.intermediates/prebuilts/build-tools/prebuilt_py3-launcher/linux_glibc_x86_64/e0c56be2b0b4cd8e6040d6ad4670d513/meta_lic",
+			expected: "prebuilt_py3-launcher",
+		},
+		{
+			path:     "out/soong/.intermediates/packages/apps/Launcher3/Launcher3/android_product_common/javac/Launcher3.jar",
+			expected: "Launcher3",
+		},
+		{
+			path:     "out/soong/.intermediates/system/core/init/init_second_stage/android_recovery_arm64_armv8-a/obj/system/core/init/main.o",
+			expected: "init_second_stage",
+		},
+		{
+			path:     "out/soong/.intermediates/hardware/libhardware/libhardware/android_vendor.31_arm64_armv8-a_shared/libhardware.so",
+			expected: "libhardware",
+		},
+		{
+			path:     "out/soong/.intermediates/system/core/init/init_first_stage/android_vendor_ramdisk_arm64_armv8-a/init_first_stage",
+			expected: "init_first_stage",
+		},
 	}
 
 	for _, tt := range tests {
@@ -286,7 +336,7 @@ func TestWriteCompileCommands(t *testing.T) {
 		},
 	}
 
-	err := writeCompileCommands(tempDir, commands)
+	err := writeCompileCommands(context.Background(), tempDir, commands)
 	if err != nil {
 		t.Fatalf("writeCompileCommands failed: %v", err)
 	}
@@ -389,23 +439,18 @@ func TestCreateTempNinjaFile(t *testing.T) {
 		t.Fatalf("Failed to get absolute path: %v", err)
 	}
 
-	tempFile, err := createTempNinjaFile(absOrigNinja)
+	tempFile, cleanup, err := createTempNinjaFile(WrapperConfig{SoongNinjaFile: absOrigNinja}, absOrigNinja)
 	if err != nil {
 		t.Fatalf("createTempNinjaFile failed: %v", err)
 	}
 
-	defer func() {
-		if tempFile != "" {
-			if err := os.Remove(tempFile); err != nil {
-				t.Errorf("Failed to remove temp file: %v", err)
-			}
-		}
-	}()
-
-	// Verify temp file exists
+	// Verify temp file exists, away from the original manifest
 	if _, err := os.Stat(tempFile); os.IsNotExist(err) {
 		t.Fatalf("Temporary ninja file was not created")
 	}
+	if filepath.Dir(tempFile) == tempDir {
+		t.Errorf("Expected a private temporary directory, got %s", tempFile)
+	}
 
 	// Verify content
 	content, err := os.ReadFile(tempFile)
@@ -417,23 +462,18 @@ func TestCreateTempNinjaFile(t *testing.T) {
 	t.Logf("File content: %s", contentStr)
 
 	// Check if key structural elements exist
-	if !strings.Contains(contentStr, "pool highmem_pool") {
-		t.Errorf("Expected content to contain 'pool highmem_pool'")
-	}
-
-	if !strings.Contains(contentStr, "depth = 1") {
-		t.Errorf("Expected content to contain 'depth = 1'")
+	if !strings.Contains(contentStr, "pool highmem_pool\n  depth = 1\n") {
+		t.Errorf("Expected content to declare highmem_pool with depth 1")
 	}
 
-	// Checks if the file contains subninja and some part of the original file path
-	if !strings.Contains(contentStr, "subninja ") {
-		t.Errorf("Expected content to contain 'subninja' directive")
+	// Checks if the file includes the original file
+	if !strings.Contains(contentStr, "subninja "+absOrigNinja) {
+		t.Errorf("Expected content to include '%s'", absOrigNinja)
 	}
 
-	// Checks if the original filename appears in the content, not caring about the full path format
-	origFileName := filepath.Base(absOrigNinja)
-	if !strings.Contains(contentStr, origFileName) {
-		t.Errorf("Expected content to reference original file '%s'", origFileName)
+	cleanup()
+	if _, err := os.Stat(filepath.Dir(tempFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected the temporary directory to be removed, got %v", err)
 	}
 }
 